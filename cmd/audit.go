@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/fabito/azure-storage-purger/pkg/audit"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// openedAuditLog the audit log of the purge, closed by stop
+var openedAuditLog *audit.Log
+
+// openAuditLog opens the audit log at path, closed by stop even when the purge exits early
+func openAuditLog(path string) (*audit.Log, error) {
+	auditLog, err := audit.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	openedAuditLog = auditLog
+	return auditLog, nil
+}
+
+// stopAuditLog flushes and closes the audit log
+func stopAuditLog() {
+	if openedAuditLog == nil {
+		return
+	}
+	if err := openedAuditLog.Close(); err != nil {
+		log.Errorf("Error closing audit log. %s", err)
+	}
+	openedAuditLog = nil
+}
+
+// auditCmd represents the audit command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Commands for the audit log of deleted entities",
+	Long:  `Commands for the audit log written by purge --audit-log`,
+}
+
+// auditVerifyCmd represents the audit verify command
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify <audit-log>",
+	Short: "Verifies the hash chain of an audit log and summarises the deletions",
+	Long: `Verifies that no record of the audit log was modified, removed or reordered and summarises the deletions.
+
+Removing the most recent records can only be detected by comparing the last hash with a copy kept elsewhere.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		summary, err := audit.Verify(f)
+		fmt.Print(summary)
+		if err != nil {
+			log.Errorf("Audit log %s is invalid. %s", args[0], err)
+			exit(1)
+		}
+		log.Infof("Audit log %s is valid", args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+}
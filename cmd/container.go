@@ -2,7 +2,6 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var ()
@@ -16,11 +15,4 @@ var containerCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(containerCmd)
-
-	containerCmd.PersistentFlags().String("account-name", "", "The storage account name")
-	viper.BindPFlag("account-name", containerCmd.PersistentFlags().Lookup("account-name"))
-
-	containerCmd.PersistentFlags().String("account-key", "", "The storage account key")
-	viper.BindPFlag("account-key", containerCmd.PersistentFlags().Lookup("account-key"))
-
 }
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/fabito/azure-storage-purger/pkg/container"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	containerNames        string
+	containerPattern      string
+	blobPrefix            string
+	pathTemplate          string
+	blobsOlderThanDays    int
+	containerPurgeWorkers int
+	blobBatchSize         int
+	snapshotsOlderThan    int
+	versionsOlderThan     int
+	keepAtLeast           int
+	blobMetadata          string
+	blobTagQuery          string
+)
+
+// containerPurgeCmd represents the container purge command
+var containerPurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Purges blobs last modified more than num-days-to-keep days ago",
+	Long:  `Purges blobs last modified more than num-days-to-keep days ago from the containers given by name or pattern`,
+	Run: func(cmd *cobra.Command, args []string) {
+		options := container.PurgeOptions{
+			ContainerPattern: containerPattern,
+			Prefix:           blobPrefix,
+			PathTemplate:     pathTemplate,
+			TagQuery:         blobTagQuery,
+			NumDaysToKeep:    blobsOlderThanDays,
+			NumWorkers:       containerPurgeWorkers,
+			BatchSize:        blobBatchSize,
+			DryRun:           dryRun,
+
+			SnapshotsOlderThanDays: snapshotsOlderThan,
+			VersionsOlderThanDays:  versionsOlderThan,
+			KeepAtLeast:            keepAtLeast,
+		}
+		for _, name := range strings.Split(containerNames, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				options.Containers = append(options.Containers, name)
+			}
+		}
+		metadata, err := parseMetadata(blobMetadata)
+		if err != nil {
+			log.Fatal(err)
+		}
+		options.Metadata = metadata
+		blobPurger, err := container.NewBlobPurger(credentials(), options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		result, err := blobPurger.Purge()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if result.HasErrors() {
+			exit(1)
+		}
+	},
+}
+
+func init() {
+	containerCmd.AddCommand(containerPurgeCmd)
+	containerPurgeCmd.Flags().StringVar(&containerNames, "container", "", "Comma-separated names of the containers to purge")
+	containerPurgeCmd.Flags().StringVar(&containerPattern, "container-pattern", "", "Purge the containers whose name matches this pattern, i.e. logs-*")
+	containerPurgeCmd.Flags().StringVar(&blobPrefix, "prefix", "", "Only purge blobs whose name starts with this prefix")
+	containerPurgeCmd.Flags().StringVar(&pathTemplate, "path-template", "", "Expire blobs by the date in their path, after the directory of the prefix, i.e. resourceId=/**/y={yyyy}/m={MM}/d={dd}/h={HH}")
+	containerPurgeCmd.Flags().StringVar(&blobMetadata, "metadata", "", "Only purge blobs having this comma-separated metadata, i.e. retention=short,source=app")
+	containerPurgeCmd.Flags().StringVar(&blobTagQuery, "tag-query", "", `Only purge blobs whose index tags match this expression, i.e. "tenant" = 'x'`)
+	containerPurgeCmd.Flags().IntVar(&blobsOlderThanDays, "num-days-to-keep", 365, "Number of days to keep")
+	containerPurgeCmd.Flags().IntVar(&containerPurgeWorkers, "num-workers", runtime.NumCPU()*4, "Number of concurrent deletes. Default is cpus * 4")
+	containerPurgeCmd.Flags().IntVar(&blobBatchSize, "batch-size", container.MaxBatchSize, "Number of blobs deleted per Blob Batch request. 1 deletes blobs one by one")
+	containerPurgeCmd.Flags().IntVar(&snapshotsOlderThan, "snapshots-older-than", 0, "Only delete the snapshots taken more than this number of days ago, keeping the blobs")
+	containerPurgeCmd.Flags().IntVar(&versionsOlderThan, "versions-older-than", 0, "Only delete the previous versions created more than this number of days ago, keeping the blobs")
+	containerPurgeCmd.Flags().IntVar(&keepAtLeast, "keep-at-least", 1, "Number of most recent snapshots, and of previous versions, kept per blob regardless of their age")
+	containerPurgeCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Enable dry run mode")
+}
+
+// parseMetadata parses comma-separated key=value pairs
+func parseMetadata(value string) (map[string]string, error) {
+	var metadata map[string]string
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid metadata %q. Use key=value", pair)
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return metadata, nil
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"runtime"
+	"strings"
+
+	"github.com/fabito/azure-storage-purger/pkg/container"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	targetTier           string
+	tierOlderThanDays    int
+	containerTierWorkers int
+)
+
+// containerTierCmd represents the container tier command
+var containerTierCmd = &cobra.Command{
+	Use:   "tier",
+	Short: "Moves blobs last modified more than older-than days ago to a colder access tier",
+	Long:  `Moves blobs last modified more than older-than days ago, from the containers given by name or pattern, to the Cool or Archive access tier`,
+	Run: func(cmd *cobra.Command, args []string) {
+		options := container.TierOptions{
+			ContainerPattern: containerPattern,
+			Prefix:           blobPrefix,
+			PathTemplate:     pathTemplate,
+			TagQuery:         blobTagQuery,
+			OlderThanDays:    tierOlderThanDays,
+			Tier:             targetTier,
+			NumWorkers:       containerTierWorkers,
+			DryRun:           dryRun,
+		}
+		for _, name := range strings.Split(containerNames, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				options.Containers = append(options.Containers, name)
+			}
+		}
+		metadata, err := parseMetadata(blobMetadata)
+		if err != nil {
+			log.Fatal(err)
+		}
+		options.Metadata = metadata
+		blobTierer, err := container.NewBlobTierer(credentials(), options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		result, err := blobTierer.Tier()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if result.HasErrors() {
+			exit(1)
+		}
+	},
+}
+
+func init() {
+	containerCmd.AddCommand(containerTierCmd)
+	containerTierCmd.Flags().StringVar(&containerNames, "container", "", "Comma-separated names of the containers whose blobs are moved")
+	containerTierCmd.Flags().StringVar(&containerPattern, "container-pattern", "", "Move the blobs of the containers whose name matches this pattern, i.e. logs-*")
+	containerTierCmd.Flags().StringVar(&blobPrefix, "prefix", "", "Only move blobs whose name starts with this prefix")
+	containerTierCmd.Flags().StringVar(&pathTemplate, "path-template", "", "Move blobs by the date in their path, after the directory of the prefix, i.e. resourceId=/**/y={yyyy}/m={MM}/d={dd}/h={HH}")
+	containerTierCmd.Flags().StringVar(&blobMetadata, "metadata", "", "Only move blobs having this comma-separated metadata, i.e. retention=short,source=app")
+	containerTierCmd.Flags().StringVar(&blobTagQuery, "tag-query", "", `Only move blobs whose index tags match this expression, i.e. "tenant" = 'x'`)
+	containerTierCmd.Flags().StringVar(&targetTier, "to", "", "The access tier blobs are moved to: cool or archive")
+	containerTierCmd.Flags().IntVar(&tierOlderThanDays, "older-than", 30, "Move blobs older than this number of days")
+	containerTierCmd.Flags().IntVar(&containerTierWorkers, "num-workers", runtime.NumCPU()*4, "Number of concurrent Set Blob Tier requests. Default is cpus * 4")
+	containerTierCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Enable dry run mode")
+	containerTierCmd.MarkFlagRequired("to")
+}
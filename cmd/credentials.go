@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	"github.com/fabito/azure-storage-purger/pkg/faults"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// addCredentialFlags adds the flags of the supported authentication methods and endpoints and binds them to viper
+func addCredentialFlags(flags *pflag.FlagSet) {
+	flags.String("account-name", "", "The storage account name")
+	flags.String("account-key", "", "The storage account key")
+	flags.String("connection-string", "", "The storage account connection string. Defaults to AZURE_STORAGE_CONNECTION_STRING")
+	flags.String("sas-token", "", "An account or service SAS token")
+	flags.String("tenant-id", "", "The Azure AD tenant of the service principal")
+	flags.String("client-id", "", "The client ID of the service principal or of the user assigned managed identity")
+	flags.String("client-secret", "", "The client secret of the service principal")
+	flags.Bool("use-managed-identity", false, "Authenticate using the managed identity")
+	flags.String("token-endpoint", "", "Overrides the Azure AD endpoint, or the managed identity endpoint with --use-managed-identity")
+	flags.String("endpoint-suffix", "", "The storage endpoint suffix, i.e. core.chinacloudapi.cn. Defaults to the public cloud one")
+	flags.String("table-endpoint", "", "Overrides the table service endpoint, i.e. http://127.0.0.1:10002/devstoreaccount1")
+	flags.String("blob-endpoint", "", "Overrides the blob service endpoint, i.e. http://127.0.0.1:10000/devstoreaccount1")
+	flags.Bool("use-emulator", false, "Use the storage emulator (Azurite) well-known account")
+	for _, name := range []string{"account-name", "account-key", "connection-string", "sas-token", "tenant-id", "client-id", "client-secret", "use-managed-identity", "token-endpoint",
+		"endpoint-suffix", "table-endpoint", "blob-endpoint", "use-emulator"} {
+		viper.BindPFlag(name, flags.Lookup(name))
+	}
+}
+
+// credentials the storage account credentials given by flags or environment variables
+func credentials() auth.Credentials {
+	c := auth.Credentials{
+		AccountName:        viper.GetString("account-name"),
+		AccountKey:         viper.GetString("account-key"),
+		ConnectionString:   viper.GetString("connection-string"),
+		SASToken:           viper.GetString("sas-token"),
+		TenantID:           viper.GetString("tenant-id"),
+		ClientID:           viper.GetString("client-id"),
+		ClientSecret:       viper.GetString("client-secret"),
+		UseManagedIdentity: viper.GetBool("use-managed-identity"),
+		TokenEndpoint:      viper.GetString("token-endpoint"),
+		EndpointSuffix:     viper.GetString("endpoint-suffix"),
+		TableEndpoint:      viper.GetString("table-endpoint"),
+		BlobEndpoint:       viper.GetString("blob-endpoint"),
+		UseEmulator:        viper.GetBool("use-emulator"),
+	}
+	if recordingSender != nil {
+		c.Sender = recordingSender
+	}
+	if injector != nil {
+		c.Transport = injectFaults
+	}
+	if c.ConnectionString == "" {
+		c.ConnectionString = os.Getenv("AZURE_STORAGE_CONNECTION_STRING")
+	}
+	return c
+}
+
+// injectFaults injects faults into the requests sent by the transport of the clients
+func injectFaults(next http.RoundTripper) http.RoundTripper {
+	return faults.Transport(next, injector)
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/fabito/azure-storage-purger/pkg/faults"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	faultSpecs  string
+	faultConfig string
+	faultSeed   int64
+	injector    *faults.Injector
+)
+
+// setUpFaults injects the faults of the fault config file and of the --fault flags into the storage requests
+func setUpFaults() error {
+	if faultConfig == "" && faultSpecs == "" {
+		return nil
+	}
+	var config faults.Config
+	if faultConfig != "" {
+		v := viper.New()
+		v.SetConfigFile(faultConfig)
+		if err := v.ReadInConfig(); err != nil {
+			return err
+		}
+		if err := v.Unmarshal(&config); err != nil {
+			return err
+		}
+	}
+	for _, spec := range strings.Split(faultSpecs, ",") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		rule, err := faults.ParseRule(strings.TrimSpace(spec))
+		if err != nil {
+			return err
+		}
+		config.Rules = append(config.Rules, rule)
+	}
+	if faultSeed != 0 {
+		config.Seed = faultSeed
+	}
+	var err error
+	injector, err = faults.NewInjector(config)
+	if err != nil {
+		return err
+	}
+	logrus.Warnf("Injecting faults into the storage requests: %s", config.Rules)
+	return nil
+}
+
+// stopFaults logs the faults injected
+func stopFaults() {
+	if injector == nil {
+		return
+	}
+	logrus.Infof("Faults injected: %s", injector)
+	injector = nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&faultSpecs, "fault", "", "Comma separated faults to inject into a share of the storage requests, as operation:fault[=value]:rate, i.e. batch:status=503:0.1,query:latency=2s:0.05")
+	rootCmd.PersistentFlags().StringVar(&faultConfig, "fault-config", "", "A YAML file with the faults to inject into the storage requests")
+	rootCmd.PersistentFlags().Int64Var(&faultSeed, "fault-seed", 0, "Seed of the fault injection random decisions, for reproducible runs")
+}
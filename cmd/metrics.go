@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/metrics"
+	"github.com/spf13/cobra"
+)
+
+var (
+	metricsAddr    string
+	pushGatewayURL string
+	pushJob        string
+	statsdAddr     string
+	graphiteAddr   string
+	pushPrefix     string
+	pushInterval   time.Duration
+	exporter       *metrics.Exporter
+)
+
+// setUpMetrics serves and pushes the metrics according to the flags
+func setUpMetrics(cmd *cobra.Command) {
+	labels := map[string]string{
+		"account":   credentials().Account(),
+		"operation": cmd.Name(),
+	}
+	if metricsAddr != "" {
+		metrics.ServePrometheus(metricsAddr, labels)
+	}
+
+	var pushers []metrics.Pusher
+	if pushGatewayURL != "" {
+		pushers = append(pushers, metrics.NewPushgatewayPusher(pushGatewayURL, pushJob, labels))
+	}
+	if statsdAddr != "" {
+		pushers = append(pushers, metrics.NewStatsdPusher(statsdAddr, pushPrefix, labels))
+	}
+	if graphiteAddr != "" {
+		pushers = append(pushers, metrics.NewGraphitePusher(graphiteAddr, pushPrefix, labels))
+	}
+	if len(pushers) > 0 {
+		exporter = metrics.NewExporter(pushInterval, pushers...)
+		exporter.Start()
+	}
+}
+
+// stopMetrics pushes the final values of the metrics
+func stopMetrics() {
+	if exporter != nil {
+		exporter.Stop()
+	}
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&metricsAddr, "metrics-addr", "", "The address to serve Prometheus metrics on (i.e. :9090). Disabled by default")
+	rootCmd.PersistentFlags().StringVar(&pushGatewayURL, "push-gateway-url", "", "The Prometheus Pushgateway URL to push metrics to")
+	rootCmd.PersistentFlags().StringVar(&pushJob, "push-job", "azp", "The job name used when pushing to the Pushgateway")
+	rootCmd.PersistentFlags().StringVar(&statsdAddr, "statsd-addr", "", "The StatsD address (host:port) to push metrics to")
+	rootCmd.PersistentFlags().StringVar(&graphiteAddr, "graphite-addr", "", "The Graphite address (host:port) to push metrics to")
+	rootCmd.PersistentFlags().StringVar(&pushPrefix, "push-prefix", "azp", "The prefix of the metric names pushed to StatsD and Graphite")
+	rootCmd.PersistentFlags().DurationVar(&pushInterval, "push-interval", 10*time.Second, "How often metrics are pushed")
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/fabito/azure-storage-purger/pkg/populator"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var (
@@ -21,9 +20,6 @@ var populateCmd = &cobra.Command{
 	Long:  `This is used for testing the purge command`,
 	Run: func(cmd *cobra.Command, args []string) {
 
-		accountName := viper.GetString("account-name")
-		accountKey := viper.GetString("account-key")
-
 		start := time.Date(startYear, 1, 1, 0, 0, 0, 0, time.UTC)
 		end := time.Now().UTC()
 
@@ -31,7 +27,7 @@ var populateCmd = &cobra.Command{
 			log.Fatalf("Start %s cannot be in the future", start)
 		}
 
-		err := populator.PopulateTable(accountName, accountKey, tableName, start, end, maxNumberOfEntitiesPerPartition, numWorkers)
+		err := populator.PopulateTable(credentials(), tableName, start, end, maxNumberOfEntitiesPerPartition, numWorkers)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -1,15 +1,27 @@
 package cmd
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/fabito/azure-storage-purger/pkg/audit"
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	"github.com/fabito/azure-storage-purger/pkg/distributed"
+	"github.com/fabito/azure-storage-purger/pkg/lock"
+	"github.com/fabito/azure-storage-purger/pkg/metrics"
+	"github.com/fabito/azure-storage-purger/pkg/progress"
 	"github.com/fabito/azure-storage-purger/pkg/purger"
 	"github.com/fabito/azure-storage-purger/pkg/util"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
+const exitCodeAlreadyRunning = 2
+
 var (
 	purgeEntitiesOlderThanDays int
 	periodLengthInHours        int
@@ -17,6 +29,19 @@ var (
 	usePool                    bool
 	startDate                  string
 	endDate                    string
+	useLock                    bool
+	lockContainer              string
+	lockLeaseDuration          int
+	coordinator                bool
+	worker                     bool
+	jobID                      string
+	stateTableName             string
+	splitLeaseDuration         time.Duration
+	pollInterval               time.Duration
+	maxAttempts                int
+	progressFlag               string
+	auditLogPath               string
+	backendFlag                string
 )
 
 // purgeCmd represents the purge command
@@ -27,36 +52,193 @@ var purgeCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Info("Starting purge")
 
-		accountName := viper.GetString("account-name")
-		accountKey := viper.GetString("account-key")
+		creds := credentials()
 
-		tablePurger, err := purger.NewTablePurger(accountName, accountKey, tableName, purgeEntitiesOlderThanDays, periodLengthInHours, numWorkers, usePool, dryRun)
+		progressMode, err := progress.ParseMode(progressFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backend, err := purger.ParseBackend(backendFlag)
 		if err != nil {
 			log.Fatal(err)
 		}
+		var auditLog *audit.Log
+		if auditLogPath != "" {
+			auditLog, err = openAuditLog(auditLogPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 
-		var result purger.PurgeResult
-		if startDate == "" && endDate == "" {
-			result, err = tablePurger.PurgeEntities()
-		} else {
-			period, err := util.ParsePeriod(startDate, endDate)
+		if coordinator || worker {
+			if coordinator && worker {
+				log.Fatal("--coordinator and --worker are mutually exclusive")
+			}
+			if useLock {
+				log.Fatal("--lock cannot be used with --coordinator or --worker")
+			}
+			runDistributed(creds, progressMode, auditLog, backend)
+			return
+		}
+
+		var period *util.Period
+		if startDate != "" || endDate != "" {
+			period, err = util.ParsePeriod(startDate, endDate)
 			if err != nil {
 				log.Fatal(err)
 			}
-			result, err = tablePurger.PurgeEntitiesWithin(period)
 		}
 
+		ctx := context.Background()
+		var tableLock *lock.BlobLock
+		if useLock {
+			tableLock, err = acquireTableLock(creds, tableName)
+			if err == lock.ErrAlreadyLocked {
+				log.Errorf("A purge of table %s is already running", tableName)
+				exit(exitCodeAlreadyRunning)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			var cancel context.CancelFunc
+			ctx, cancel = lockContext(tableLock, tableName)
+			defer cancel()
+		}
+
+		tablePurger, err := purger.NewTablePurger(creds, tableName, purgeEntitiesOlderThanDays, periodLengthInHours, numWorkers, usePool, dryRun, progressMode, auditLog, backend)
+		if err != nil {
+			releaseTableLock(tableLock)
+			log.Fatal(err)
+		}
+		defer tablePurger.Finish()
+
+		var result purger.PurgeResult
+		if period == nil {
+			result, err = tablePurger.PurgeEntitiesContext(ctx)
+		} else {
+			result, err = tablePurger.PurgeEntitiesWithinContext(ctx, period)
+		}
+		tablePurger.Finish()
+		// the lock is released once the purge stopped deleting
+		releaseTableLock(tableLock)
+
+		if ctx.Err() != nil {
+			exit(1)
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		if result.HasErrors() {
-			os.Exit(1)
+			exit(1)
 		}
 
 	},
 }
 
+// runDistributed either writes the splits of the purge (coordinator) or processes them (worker)
+func runDistributed(creds auth.Credentials, progressMode progress.Mode, auditLog *audit.Log, backend purger.Backend) {
+	client, err := creds.NewClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jobID == "" {
+		jobID = tableName
+	}
+	store := distributed.NewSplitStore(client, stateTableName, jobID)
+
+	if coordinator {
+		var period *util.Period
+		if startDate == "" && endDate == "" {
+			var tablePurger purger.AzureTablePurger
+			tablePurger, err = purger.NewTablePurger(creds, tableName, purgeEntitiesOlderThanDays, periodLengthInHours, numWorkers, usePool, dryRun, progressMode, auditLog, backend)
+			if err != nil {
+				log.Fatal(err)
+			}
+			period, err = tablePurger.PurgePeriod()
+			tablePurger.Finish()
+		} else {
+			period, err = util.ParsePeriod(startDate, endDate)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if period == nil {
+			return
+		}
+		if err := distributed.Coordinate(store, period, time.Duration(periodLengthInHours)*time.Hour); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	process := func(ctx context.Context, period *util.Period) (purger.PurgeResult, error) {
+		p, err := purger.NewTablePurger(creds, tableName, purgeEntitiesOlderThanDays, periodLengthInHours, numWorkers, usePool, dryRun, progressMode, auditLog, backend)
+		if err != nil {
+			return purger.PurgeResult{}, err
+		}
+		defer p.Finish()
+		return p.PurgeEntitiesWithinContext(ctx, period)
+	}
+	w := distributed.NewWorker(store, process, splitLeaseDuration, pollInterval, maxAttempts)
+	result, err := w.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Worker %s deleted %d entities in %d batches. Errors in %d batches", w.ID, result.RowCount, result.BatchCount, result.BatchErrorCount)
+	for _, line := range strings.Split(strings.TrimSpace(metrics.Aggregate().String()), "\n") {
+		log.Info(line)
+	}
+	if result.HasErrors() {
+		exit(1)
+	}
+}
+
+// acquireTableLock acquires the table lock, renewed until released
+func acquireTableLock(creds auth.Credentials, tableName string) (*lock.BlobLock, error) {
+	client, err := creds.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	l := lock.NewBlobLock(client, lockContainer, lock.TableLockName(creds.Account(), tableName), lockLeaseDuration)
+	if err := l.Acquire(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// lockContext returns a context cancelled when the lock is lost or on SIGINT/SIGTERM.
+// The purge then stops after its in-flight batches, before the lock is released.
+func lockContext(l *lock.BlobLock, tableName string) (context.Context, context.CancelFunc) {
+	ctx, cancel := l.Context(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case s := <-signals:
+			log.Warnf("Received %s. Stopping the purge", s)
+			cancel()
+		case <-l.Lost():
+			log.Errorf("Lost lock for table %s. Stopping the purge", tableName)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// releaseTableLock releases l, if any, logging the error
+func releaseTableLock(l *lock.BlobLock) {
+	if l == nil {
+		return
+	}
+	if err := l.Release(); err != nil {
+		log.Error(err)
+	}
+}
+
 func init() {
 	tableCmd.AddCommand(purgeCmd)
 	purgeCmd.Flags().IntVar(&purgeEntitiesOlderThanDays, "num-days-to-keep", 365, "Number of days to keep")
@@ -67,4 +249,19 @@ func init() {
 
 	purgeCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Enable dry run mode")
 	purgeCmd.Flags().BoolVar(&usePool, "use-pool", false, "Enable worker pool mode")
+	purgeCmd.Flags().StringVar(&auditLogPath, "audit-log", "", "Append a hash-chained record of every deleted batch to this JSONL file")
+	purgeCmd.Flags().StringVar(&backendFlag, "backend", string(purger.StorageBackend), "The service behind the table: storage or cosmos (Cosmos DB Table API)")
+	purgeCmd.Flags().StringVar(&progressFlag, "progress", string(progress.Auto), "How progress is reported: auto, bar, log or none")
+
+	purgeCmd.Flags().BoolVar(&useLock, "lock", false, "Prevent concurrent purges of the same table using a blob lease")
+	purgeCmd.Flags().StringVar(&lockContainer, "lock-container", lock.DefaultContainerName, "The container holding the lock blobs")
+	purgeCmd.Flags().IntVar(&lockLeaseDuration, "lock-lease-duration", lock.DefaultLeaseDuration, "The lock lease duration in seconds (15-60)")
+
+	purgeCmd.Flags().BoolVar(&coordinator, "coordinator", false, "Write the splits of the purge into the state table for workers to process")
+	purgeCmd.Flags().BoolVar(&worker, "worker", false, "Claim and process splits written by a coordinator")
+	purgeCmd.Flags().StringVar(&jobID, "job-id", "", "The distributed purge job ID. Default is the table name")
+	purgeCmd.Flags().StringVar(&stateTableName, "state-table", distributed.DefaultStateTableName, "The table holding the splits of distributed purges")
+	purgeCmd.Flags().DurationVar(&splitLeaseDuration, "split-lease-duration", 5*time.Minute, "How long a worker holds a split without renewing its lease")
+	purgeCmd.Flags().DurationVar(&pollInterval, "poll-interval", 30*time.Second, "How often a worker checks for splits whose lease expired")
+	purgeCmd.Flags().IntVar(&maxAttempts, "max-attempts", 3, "Number of attempts before a split is marked as failed")
 }
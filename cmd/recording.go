@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/dnaeon/go-vcr/cassette"
+	"github.com/fabito/azure-storage-purger/pkg/recording"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	recordPath      string
+	replayPath      string
+	recorded        *cassette.Cassette
+	recordingSender func(storage.Sender) storage.Sender
+)
+
+// setUpRecording records the storage requests to, or replays them from, a cassette if one is given
+func setUpRecording() error {
+	switch {
+	case recordPath != "" && replayPath != "":
+		return errors.New("--record and --replay are mutually exclusive")
+	case recordPath != "":
+		recorded = recording.Record(recordPath)
+		recordingSender = func(s storage.Sender) storage.Sender {
+			return recording.SenderWithRecording(s, recorded)
+		}
+	case replayPath != "":
+		c, err := recording.Replay(replayPath)
+		if err != nil {
+			return err
+		}
+		recordingSender = func(storage.Sender) storage.Sender {
+			return recording.SenderWithReplay(c)
+		}
+	}
+	return nil
+}
+
+// stopRecording saves the recorded requests
+func stopRecording() {
+	if recorded == nil {
+		return
+	}
+	if err := recorded.Save(); err != nil {
+		logrus.Errorf("Error saving cassette %s. %s", recorded.File, err)
+	} else {
+		logrus.Infof("Recorded %d requests to %s", len(recorded.Interactions), recorded.File)
+	}
+	recorded = nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&recordPath, "record", "", "Record the storage requests and responses, with keys and signatures scrubbed, to this cassette file")
+	rootCmd.PersistentFlags().StringVar(&replayPath, "replay", "", "Replay the storage responses recorded in this cassette file instead of sending the requests")
+}
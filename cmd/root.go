@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -12,7 +14,13 @@ import (
 	"github.com/spf13/viper"
 )
 
-var v string
+var (
+	v         string
+	logFormat string
+	logFile   string
+	// openedLogFile the file of --log-file, closed by stop
+	openedLogFile *os.File
+)
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -26,20 +34,73 @@ var rootCmd = &cobra.Command{
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		logrus.Println(err)
-		os.Exit(1)
+		exit(1)
 	}
 }
 
-func setUpLogs(out io.Writer, level string) error {
+// stop closes the audit log, pushes the final values of the metrics, flushes the traces,
+// saves the recorded requests, logs the faults injected and finally closes the log file
+func stop() {
+	stopAuditLog()
+	stopMetrics()
+	stopTracing()
+	stopRecording()
+	stopFaults()
+	stopLogs()
+}
+
+// exit stops before exiting, as deferred functions and PersistentPostRun don't run
+func exit(code int) {
+	stop()
+	os.Exit(code)
+}
+
+func setUpLogs(out io.Writer, level, format string) error {
 	logrus.SetOutput(out)
 	lvl, err := logrus.ParseLevel(level)
 	if err != nil {
 		return err
 	}
 	logrus.SetLevel(lvl)
+	switch format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	default:
+		return fmt.Errorf("invalid log format %q. Expected json or text", format)
+	}
 	return nil
 }
 
+// logOutput the log file, opened for appending, or stdout
+func logOutput(file string) (io.Writer, error) {
+	if file == "" {
+		return os.Stdout, nil
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	openedLogFile = f
+	return f, nil
+}
+
+// stopLogs syncs and closes the log file. Later logs go to stderr.
+func stopLogs() {
+	if openedLogFile == nil {
+		return
+	}
+	logrus.SetOutput(os.Stderr)
+	if err := openedLogFile.Sync(); err != nil {
+		logrus.Errorf("Error syncing log file %s. %s", openedLogFile.Name(), err)
+	}
+	if err := openedLogFile.Close(); err != nil {
+		logrus.Errorf("Error closing log file %s. %s", openedLogFile.Name(), err)
+	}
+	openedLogFile = nil
+}
+
 func init() {
 	cobra.OnInitialize(func() {
 		viper.SetEnvPrefix("azp") // Set the environment prefix to AZP_*
@@ -50,12 +111,32 @@ func init() {
 	})
 
 	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
-		if err := setUpLogs(os.Stdout, v); err != nil {
+		out, err := logOutput(logFile)
+		if err != nil {
+			return err
+		}
+		if err := setUpLogs(out, v, logFormat); err != nil {
 			return err
 		}
-		return nil
+		setUpMetrics(cmd)
+		if err := setUpRecording(); err != nil {
+			return err
+		}
+		if err := setUpFaults(); err != nil {
+			return err
+		}
+		return setUpTracing()
+	}
+	rootCmd.PersistentPostRun = func(cmd *cobra.Command, args []string) {
+		stop()
 	}
+	// log.Fatal exits without running deferred functions
+	logrus.RegisterExitHandler(stop)
 	rootCmd.PersistentFlags().StringVarP(&v, "verbosity", "v", logrus.InfoLevel.String(), "Log level (debug, info, warn, error, fatal, panic")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "Log format (json, text)")
+	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "Append logs to this file instead of stdout")
+	// shared by all commands, as viper binds each key to a single flag
+	addCredentialFlags(rootCmd.PersistentFlags())
 }
 
 func postInitCommands(commands []*cobra.Command) {
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/metrics"
+	"github.com/fabito/azure-storage-purger/pkg/purger"
+	"github.com/fabito/azure-storage-purger/pkg/scheduler"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	scheduleFile string
+	serveAddr    string
+	historySize  int
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Runs purge jobs periodically based on cron schedules",
+	Long: `Runs as a daemon executing the purge jobs configured in the schedule file.
+
+The schedule file lists the jobs to run:
+
+jobs:
+  - name: logs
+    schedule: "0 2 * * *"
+    jitter: 10m
+    table-name: logs
+    num-days-to-keep: 30
+
+The last results of each job are exposed at http://<addr>/jobs`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jobs, err := loadJobs(scheduleFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s := scheduler.New(historySize, scheduler.PurgeRunFunc)
+		for _, job := range jobs {
+			if err := s.Add(job); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/jobs", s)
+		mux.Handle("/jobs/", s)
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		mux.HandleFunc("/summary", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(metrics.Aggregate())
+		})
+		server := &http.Server{Addr: serveAddr, Handler: mux}
+
+		s.Start()
+		go func() {
+			log.Infof("Listening on %s", serveAddr)
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		<-stop
+
+		log.Info("Shutting down. Waiting for running jobs to complete")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+		s.Stop()
+	},
+}
+
+func loadJobs(file string) ([]scheduler.Job, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var jobs []scheduler.Job
+	if err := v.UnmarshalKey("jobs", &jobs); err != nil {
+		return nil, err
+	}
+	for i := range jobs {
+		applyJobDefaults(&jobs[i])
+	}
+	return jobs, nil
+}
+
+func applyJobDefaults(job *scheduler.Job) {
+	job.Credentials = job.Credentials.WithDefaults(credentials())
+	if job.Name == "" {
+		job.Name = job.TableName
+	}
+	if job.NumDaysToKeep == 0 {
+		job.NumDaysToKeep = 365
+	}
+	if job.PeriodLengthInHours == 0 {
+		job.PeriodLengthInHours = 24
+	}
+	if job.NumWorkers == 0 {
+		job.NumWorkers = runtime.NumCPU() * 4
+	}
+	if job.Backend == "" {
+		job.Backend = string(purger.StorageBackend)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().StringVar(&scheduleFile, "schedule", "", "The schedule file with the jobs to run")
+	serveCmd.MarkFlagRequired("schedule")
+	serveCmd.Flags().StringVar(&serveAddr, "addr", ":8080", "The address to expose the jobs status")
+	serveCmd.Flags().IntVar(&historySize, "history-size", 10, "Number of results to keep per job")
+}
@@ -4,10 +4,12 @@ import (
 	"github.com/fabito/azure-storage-purger/pkg/container"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
-var ()
+var (
+	statsDepth int
+	statsTop   int
+)
 
 // statsCmd represents the stats command
 var statsCmd = &cobra.Command{
@@ -16,22 +18,25 @@ var statsCmd = &cobra.Command{
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
 
-		accountName := viper.GetString("account-name")
-		accountKey := viper.GetString("account-key")
-
-		s, err := container.NewStatsGatherer(accountName, accountKey)
+		s, err := container.NewStatsGatherer(credentials(), container.StatsOptions{Depth: statsDepth, Top: statsTop})
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		containers, _ := s.GatherStatistics()
+		// the stats of the containers listed are reported even when others failed
+		containers, err := s.GatherStatistics()
 		for _, c := range containers {
 			log.Info(c)
 		}
+		if err != nil {
+			log.Fatal(err)
+		}
 
 	},
 }
 
 func init() {
 	containerCmd.AddCommand(statsCmd)
+	statsCmd.Flags().IntVar(&statsDepth, "depth", 0, "Break the usage of containers down by this number of leading path segments. Disabled when 0")
+	statsCmd.Flags().IntVar(&statsTop, "top", 10, "Number of largest prefixes reported per container")
 }
@@ -4,7 +4,6 @@ import (
 	"runtime"
 
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var (
@@ -22,12 +21,6 @@ var tableCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(tableCmd)
 
-	tableCmd.PersistentFlags().String("account-name", "", "The storage account name")
-	viper.BindPFlag("account-name", tableCmd.PersistentFlags().Lookup("account-name"))
-
-	tableCmd.PersistentFlags().String("account-key", "", "The storage account key")
-	viper.BindPFlag("account-key", tableCmd.PersistentFlags().Lookup("account-key"))
-
 	tableCmd.PersistentFlags().StringVar(&tableName, "table-name", "", "The storage table name")
 	tableCmd.MarkPersistentFlagRequired("table-name")
 
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	otlpEndpoint    string
+	otlpInsecure    bool
+	shutdownTracing func(context.Context) error
+)
+
+// setUpTracing exports traces to the OTLP collector if one is configured
+func setUpTracing() error {
+	if otlpEndpoint == "" {
+		return nil
+	}
+	shutdown, err := tracing.Init(otlpEndpoint, otlpInsecure)
+	if err != nil {
+		return err
+	}
+	shutdownTracing = shutdown
+	return nil
+}
+
+// stopTracing flushes the pending spans
+func stopTracing() {
+	if shutdownTracing == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		logrus.Errorf("Error flushing traces. %s", err)
+	}
+	shutdownTracing = nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&otlpEndpoint, "otlp-endpoint", "", "The OTLP/HTTP collector address (host:port) to export traces to. Disabled by default")
+	rootCmd.PersistentFlags().BoolVar(&otlpInsecure, "otlp-insecure", false, "Export traces over plain HTTP")
+}
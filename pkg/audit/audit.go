@@ -0,0 +1,220 @@
+// Package audit keeps a tamper-evident log of the deleted entities.
+// Each record holds the hash of the previous one so removing or editing a record breaks the chain.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record one successful batch deletion
+type Record struct {
+	Seq          int64     `json:"seq"`
+	Time         time.Time `json:"time"`
+	RunID        string    `json:"run_id"`
+	Table        string    `json:"table"`
+	PartitionKey string    `json:"partition_key"`
+	RowKeys      []string  `json:"row_keys"`
+	PrevHash     string    `json:"prev_hash"`
+	Hash         string    `json:"hash,omitempty"`
+}
+
+// computeHash the hash of the record, which covers every field but Hash itself
+func (r Record) computeHash() (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log appends hash-chained records to a JSONL file
+type Log struct {
+	sync.Mutex
+	file     *os.File
+	seq      int64
+	lastHash string
+}
+
+// Open opens the audit log at path for appending, continuing the chain of the existing records
+func Open(path string) (*Log, error) {
+	l := &Log{}
+	if f, err := os.Open(path); err == nil {
+		last, err := lastRecord(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading audit log %s: %s", path, err)
+		}
+		if last != nil {
+			l.seq = last.Seq
+			l.lastHash = last.Hash
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.file = f
+	return l, nil
+}
+
+func lastRecord(r io.Reader) (*Record, error) {
+	var last *Record
+	scanner := newScanner(r)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		record := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, err
+		}
+		last = record
+	}
+	return last, scanner.Err()
+}
+
+func newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	// a batch holds up to 100 row keys of up to 1KiB each
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return scanner
+}
+
+// Append chains and writes a record of the deleted rowKeys
+func (l *Log) Append(runID, table, partitionKey string, rowKeys []string) error {
+	l.Lock()
+	defer l.Unlock()
+	record := Record{
+		Seq:          l.seq + 1,
+		Time:         time.Now().UTC(),
+		RunID:        runID,
+		Table:        table,
+		PartitionKey: partitionKey,
+		RowKeys:      rowKeys,
+		PrevHash:     l.lastHash,
+	}
+	hash, err := record.computeHash()
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	l.seq = record.Seq
+	l.lastHash = hash
+	return nil
+}
+
+// Close flushes and closes the audit log
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// Summary of the deletions recorded in an audit log
+type Summary struct {
+	Records  int64
+	Entities int64
+	Runs     int
+	Tables   map[string]int64
+	First    time.Time
+	Last     time.Time
+	// LastHash can be kept elsewhere to detect the removal of the last records
+	LastHash string
+}
+
+func (s Summary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d record(s), %d entities deleted in %d run(s)", s.Records, s.Entities, s.Runs)
+	if s.Records > 0 {
+		fmt.Fprintf(&b, " between %s and %s", s.First.Format(time.RFC3339), s.Last.Format(time.RFC3339))
+	}
+	b.WriteString("\n")
+	if s.LastHash != "" {
+		fmt.Fprintf(&b, "last hash %s\n", s.LastHash)
+	}
+	tables := make([]string, 0, len(s.Tables))
+	for table := range s.Tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		fmt.Fprintf(&b, "  %-30s %12d\n", table, s.Tables[table])
+	}
+	return b.String()
+}
+
+// Verify checks the hash chain of an audit log and summarises the deletions.
+// Returns the summary of the records up to the first broken one along with the error.
+func Verify(r io.Reader) (Summary, error) {
+	summary := Summary{Tables: make(map[string]int64)}
+	runs := make(map[string]bool)
+	var prev Record
+	line := 0
+	scanner := newScanner(r)
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return summary, fmt.Errorf("line %d: %s", line, err)
+		}
+		if record.Seq != prev.Seq+1 {
+			return summary, fmt.Errorf("line %d: expected sequence %d but found %d", line, prev.Seq+1, record.Seq)
+		}
+		if record.PrevHash != prev.Hash {
+			return summary, fmt.Errorf("line %d: previous hash does not match record %d", line, prev.Seq)
+		}
+		hash, err := record.computeHash()
+		if err != nil {
+			return summary, fmt.Errorf("line %d: %s", line, err)
+		}
+		if hash != record.Hash {
+			return summary, fmt.Errorf("line %d: hash mismatch, record %d was modified", line, record.Seq)
+		}
+
+		summary.Records++
+		summary.Entities += int64(len(record.RowKeys))
+		summary.Tables[record.Table] += int64(len(record.RowKeys))
+		runs[record.RunID] = true
+		summary.Runs = len(runs)
+		if summary.First.IsZero() || record.Time.Before(summary.First) {
+			summary.First = record.Time
+		}
+		if record.Time.After(summary.Last) {
+			summary.Last = record.Time
+		}
+		summary.LastHash = record.Hash
+		prev = record
+	}
+	if err := scanner.Err(); err != nil {
+		return summary, fmt.Errorf("line %d: %s", line+1, err)
+	}
+	return summary, nil
+}
@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeLog(t *testing.T, path string, records int) {
+	l, err := Open(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for i := 0; i < records; i++ {
+		assert.NoError(t, l.Append("run1", "logs", "0636603290790000000", []string{"1", "2"}))
+	}
+	assert.NoError(t, l.Close())
+}
+
+func TestAppendAndVerify(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "audit")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	writeLog(t, path, 2)
+	// reopening continues the chain
+	writeLog(t, path, 1)
+
+	f, _ := os.Open(path)
+	defer f.Close()
+	summary, err := Verify(f)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), summary.Records)
+	assert.Equal(t, int64(6), summary.Entities)
+	assert.Equal(t, int64(6), summary.Tables["logs"])
+	assert.Equal(t, 1, summary.Runs)
+	assert.NotEmpty(t, summary.LastHash)
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "audit")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+	writeLog(t, path, 3)
+	content, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+
+	modified := append([]string{}, lines...)
+	modified[1] = strings.Replace(modified[1], `"row_keys":["1","2"]`, `"row_keys":["1"]`, 1)
+	summary, err := Verify(strings.NewReader(strings.Join(modified, "\n")))
+	assert.EqualError(t, err, "line 2: hash mismatch, record 2 was modified")
+	assert.Equal(t, int64(1), summary.Records)
+	assert.Equal(t, 1, summary.Runs)
+
+	removed := []string{lines[0], lines[2]}
+	_, err = Verify(strings.NewReader(strings.Join(removed, "\n")))
+	assert.EqualError(t, err, "line 2: expected sequence 2 but found 3")
+
+	var b bytes.Buffer
+	b.WriteString(strings.Join(lines[1:], "\n"))
+	_, err = Verify(&b)
+	assert.EqualError(t, err, "line 1: expected sequence 1 but found 2")
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// Authorizer authorizes requests built outside the storage client, such as the sub-requests of blob batches.
+// Requests must carry their x-ms-date and x-ms-version headers already.
+type Authorizer func(r *http.Request) error
+
+// NewAuthorizer the Authorizer of the credentials: a SharedKey signature, the SAS token or an Azure AD token
+func (c Credentials) NewAuthorizer() (Authorizer, error) {
+	switch {
+	case c.UseEmulator:
+		return sharedKeyAuthorizer(storage.StorageEmulatorAccountName, storage.StorageEmulatorAccountKey)
+	case c.ConnectionString != "":
+		if token := c.connectionStringValue("SharedAccessSignature"); token != "" {
+			return sasAuthorizer(token)
+		}
+		return sharedKeyAuthorizer(c.connectionStringValue("AccountName"), c.connectionStringValue("AccountKey"))
+	case c.SASToken != "":
+		return sasAuthorizer(c.SASToken)
+	case c.ClientID != "" || c.UseManagedIdentity:
+		token, err := c.servicePrincipalToken()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *http.Request) error {
+			if err := token.EnsureFresh(); err != nil {
+				return fmt.Errorf("refreshing Azure AD token: %s", err)
+			}
+			r.Header.Set("Authorization", "Bearer "+token.OAuthToken())
+			return nil
+		}, nil
+	case c.AccountKey != "":
+		return sharedKeyAuthorizer(c.AccountName, c.AccountKey)
+	}
+	return nil, errors.New("no credentials. Set an account key, connection string, SAS token or Azure AD credentials")
+}
+
+func sasAuthorizer(sasToken string) (Authorizer, error) {
+	token, err := url.ParseQuery(strings.TrimPrefix(sasToken, "?"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAS token: %s", err)
+	}
+	return func(r *http.Request) error {
+		query := r.URL.Query()
+		for k, v := range token {
+			query[k] = v
+		}
+		r.URL.RawQuery = query.Encode()
+		return nil
+	}, nil
+}
+
+// sharedKeyAuthorizer signs blob requests with the SharedKey scheme
+func sharedKeyAuthorizer(account, key string) (Authorizer, error) {
+	secret, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid account key: %s", err)
+	}
+	return func(r *http.Request) error {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(stringToSign(account, r)))
+		r.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", account, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+		return nil
+	}, nil
+}
+
+// stringToSign the string signed by the SharedKey scheme of the blob service
+func stringToSign(account string, r *http.Request) string {
+	header := func(name string) string {
+		for k, v := range r.Header {
+			if strings.EqualFold(k, name) && len(v) > 0 {
+				return v[0]
+			}
+		}
+		return ""
+	}
+	contentLength := header("Content-Length")
+	if r.ContentLength > 0 {
+		contentLength = strconv.FormatInt(r.ContentLength, 10)
+	}
+	if contentLength == "0" {
+		contentLength = ""
+	}
+	var b strings.Builder
+	b.WriteString(r.Method + "\n")
+	for _, value := range []string{
+		header("Content-Encoding"), header("Content-Language"), contentLength, header("Content-MD5"), header("Content-Type"),
+		header("Date"), header("If-Modified-Since"), header("If-Match"), header("If-None-Match"), header("If-Unmodified-Since"), header("Range"),
+	} {
+		b.WriteString(value + "\n")
+	}
+
+	// x-ms- headers, lowercase and sorted
+	msHeaders := make(map[string]string)
+	var names []string
+	for k, v := range r.Header {
+		name := strings.ToLower(k)
+		if strings.HasPrefix(name, "x-ms-") && len(v) > 0 {
+			msHeaders[name] = strings.TrimSpace(v[0])
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString(name + ":" + msHeaders[name] + "\n")
+	}
+
+	// the resource, followed by the query parameters sorted by name with their sorted values
+	b.WriteString("/" + account + r.URL.EscapedPath())
+	query := r.URL.Query()
+	params := make([]string, 0, len(query))
+	for k := range query {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		b.WriteString("\n" + strings.ToLower(k) + ":" + strings.Join(values, ","))
+	}
+	return b.String()
+}
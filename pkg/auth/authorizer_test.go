@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// signed the requests signed by the storage client of c, answered with a 404
+func signed(t *testing.T, c Credentials) []*http.Request {
+	var requests []*http.Request
+	c.Sender = func(storage.Sender) storage.Sender {
+		return util.SenderFunc(func(client *storage.Client, r *http.Request) (*http.Response, error) {
+			requests = append(requests, r)
+			return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+		})
+	}
+	client, err := c.NewClient()
+	assert.NoError(t, err)
+	blobService := client.GetBlobService()
+	container := blobService.GetContainerReference("logs")
+	container.ListBlobs(storage.ListBlobsParameters{Prefix: "app/", Include: &storage.IncludeBlobDataset{Metadata: true}, MaxResults: 10})
+	include := true
+	container.GetBlobReference("app/2020/01/01.json").Delete(&storage.DeleteBlobOptions{DeleteSnapshots: &include})
+	return requests
+}
+
+func TestSharedKeyAuthorizer(t *testing.T) {
+	for _, c := range []Credentials{
+		{AccountName: "acme", AccountKey: "YWNtZQ=="},
+		{UseEmulator: true},
+		{ConnectionString: "DefaultEndpointsProtocol=https;AccountName=acme;AccountKey=YWNtZQ==;EndpointSuffix=core.windows.net"},
+	} {
+		authorize, err := c.NewAuthorizer()
+		assert.NoError(t, err)
+		requests := signed(t, c)
+		assert.Len(t, requests, 2)
+		for _, r := range requests {
+			expected := r.Header.Get("Authorization")
+			r.Header.Del("Authorization")
+			assert.NoError(t, authorize(r))
+			assert.Equal(t, expected, r.Header.Get("Authorization"), r.URL.String())
+		}
+	}
+}
+
+func TestSASAuthorizer(t *testing.T) {
+	authorize, err := Credentials{AccountName: "acme", SASToken: "?sv=2019-02-02&sig=c2ln"}.NewAuthorizer()
+	assert.NoError(t, err)
+	r, _ := http.NewRequest(http.MethodDelete, "/logs/app.json?snapshot=2020-01-01T00:00:00.0000000Z", nil)
+	assert.NoError(t, authorize(r))
+	assert.Equal(t, "c2ln", r.URL.Query().Get("sig"))
+	assert.Equal(t, "2020-01-01T00:00:00.0000000Z", r.URL.Query().Get("snapshot"))
+	assert.Empty(t, r.Header.Get("Authorization"))
+
+	_, err = Credentials{}.NewAuthorizer()
+	assert.Error(t, err)
+}
@@ -0,0 +1,330 @@
+// Package auth creates storage clients from shared keys, connection strings, SAS tokens or Azure AD credentials.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+)
+
+// StorageResource the Azure AD resource of Azure Storage
+const StorageResource = "https://storage.azure.com/"
+
+// Credentials how to authenticate against a storage account and where to reach it.
+// The first method set wins: emulator, connection string, SAS token, Azure AD (service principal or managed identity) and account key.
+type Credentials struct {
+	AccountName      string `mapstructure:"account-name" json:"account_name"`
+	AccountKey       string `mapstructure:"account-key" json:"-"`
+	ConnectionString string `mapstructure:"connection-string" json:"-"`
+	// SASToken either an account or a service SAS
+	SASToken     string `mapstructure:"sas-token" json:"-"`
+	TenantID     string `mapstructure:"tenant-id" json:"tenant_id,omitempty"`
+	ClientID     string `mapstructure:"client-id" json:"client_id,omitempty"`
+	ClientSecret string `mapstructure:"client-secret" json:"-"`
+	// UseManagedIdentity uses the managed identity, or the user assigned one with ClientID
+	UseManagedIdentity bool `mapstructure:"use-managed-identity" json:"use_managed_identity,omitempty"`
+	// TokenEndpoint the Azure AD endpoint for service principals, the managed identity endpoint otherwise
+	TokenEndpoint string `mapstructure:"token-endpoint" json:"token_endpoint,omitempty"`
+	// EndpointSuffix the storage endpoint suffix of sovereign clouds, ignored with a connection string
+	EndpointSuffix string `mapstructure:"endpoint-suffix" json:"endpoint_suffix,omitempty"`
+	// TableEndpoint and BlobEndpoint override the scheme, host and base path of the services
+	TableEndpoint string `mapstructure:"table-endpoint" json:"table_endpoint,omitempty"`
+	BlobEndpoint  string `mapstructure:"blob-endpoint" json:"blob_endpoint,omitempty"`
+	// UseEmulator uses the well-known account of the storage emulator (Azurite)
+	UseEmulator bool `mapstructure:"use-emulator" json:"use_emulator,omitempty"`
+	// Sender decorates the sender of the clients, i.e. to record or replay their requests
+	Sender func(storage.Sender) storage.Sender `mapstructure:"-" json:"-"`
+	// Transport decorates the HTTP transport of the clients, below the retries of their sender, i.e. to inject faults
+	Transport func(http.RoundTripper) http.RoundTripper `mapstructure:"-" json:"-"`
+}
+
+// Account the storage account name, taken from the connection string when not set
+func (c Credentials) Account() string {
+	switch {
+	case c.UseEmulator:
+		return storage.StorageEmulatorAccountName
+	case c.AccountName != "":
+		return c.AccountName
+	}
+	return c.connectionStringValue("AccountName")
+}
+
+// connectionStringValue the value of key in the connection string
+func (c Credentials) connectionStringValue(key string) string {
+	for _, pair := range strings.Split(c.ConnectionString, ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), key) {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
+// NewClient creates a storage client authenticated with the credentials.
+// Requests are sent to the table and blob endpoints when set, or to the ones of the connection string.
+func (c Credentials) NewClient() (storage.Client, error) {
+	client, err := c.newClientWithEndpoints()
+	if err != nil {
+		return client, err
+	}
+	if c.Transport != nil {
+		httpClient := http.Client{}
+		if client.HTTPClient != nil {
+			httpClient = *client.HTTPClient
+		}
+		next := httpClient.Transport
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		httpClient.Transport = c.Transport(next)
+		client.HTTPClient = &httpClient
+	}
+	if c.Sender != nil {
+		client.Sender = c.Sender(client.Sender)
+	}
+	return client, nil
+}
+
+func (c Credentials) newClientWithEndpoints() (storage.Client, error) {
+	client, err := c.newClient()
+	if err != nil {
+		return client, err
+	}
+	tableEndpoint, blobEndpoint := c.TableEndpoint, c.BlobEndpoint
+	if tableEndpoint == "" && !c.UseEmulator {
+		tableEndpoint = c.connectionStringValue("TableEndpoint")
+	}
+	if blobEndpoint == "" && !c.UseEmulator {
+		blobEndpoint = c.connectionStringValue("BlobEndpoint")
+	}
+	if tableEndpoint == "" && blobEndpoint == "" {
+		return client, nil
+	}
+	endpoints := make(map[string]*url.URL)
+	for service, endpoint := range map[string]string{TableService: tableEndpoint, BlobService: blobEndpoint} {
+		if endpoint == "" {
+			continue
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return storage.Client{}, fmt.Errorf("invalid %s endpoint %q", service, endpoint)
+		}
+		endpoints[service] = u
+	}
+	client.Sender = SenderWithEndpoints(client.Sender, endpoints)
+	return client, nil
+}
+
+func (c Credentials) newClient() (storage.Client, error) {
+	switch {
+	case c.UseEmulator:
+		return storage.NewEmulatorClient()
+	case c.ConnectionString != "":
+		return storage.NewClientFromConnectionString(c.ConnectionString)
+	case c.SASToken != "":
+		if c.AccountName == "" {
+			return storage.Client{}, errors.New("the account name is required with a SAS token")
+		}
+		token, err := url.ParseQuery(strings.TrimPrefix(c.SASToken, "?"))
+		if err != nil {
+			return storage.Client{}, fmt.Errorf("invalid SAS token: %s", err)
+		}
+		client := c.unsignedClient()
+		client.Sender = SenderWithSASToken(client.Sender, token)
+		return client, nil
+	case c.ClientID != "" || c.UseManagedIdentity:
+		return c.newOAuthClient()
+	case c.AccountKey != "":
+		return storage.NewClient(c.AccountName, c.AccountKey, c.environment().StorageEndpointSuffix, storage.DefaultAPIVersion, true)
+	}
+	return storage.Client{}, errors.New("no credentials. Set an account key, connection string, SAS token or Azure AD credentials")
+}
+
+func (c Credentials) newOAuthClient() (storage.Client, error) {
+	if c.AccountName == "" {
+		return storage.Client{}, errors.New("the account name is required with Azure AD credentials")
+	}
+	token, err := c.servicePrincipalToken()
+	if err != nil {
+		return storage.Client{}, err
+	}
+	client := c.unsignedClient()
+	client.Sender = SenderWithBearerToken(client.Sender, token)
+	return client, nil
+}
+
+// unsignedClient a client which doesn't sign requests. A SAS client with an empty token does just that.
+// The storage client only appends SAS tokens to blob requests so the Senders take care of the authorization.
+func (c Credentials) unsignedClient() storage.Client {
+	return storage.NewAccountSASClient(c.AccountName, url.Values{}, c.environment())
+}
+
+// environment the Azure cloud of the endpoint suffix, the public one by default.
+// Unknown suffixes get the endpoints of the public cloud but their own storage endpoint suffix.
+func (c Credentials) environment() azure.Environment {
+	if c.EndpointSuffix == "" {
+		return azure.PublicCloud
+	}
+	for _, env := range []azure.Environment{azure.PublicCloud, azure.ChinaCloud, azure.USGovernmentCloud, azure.GermanCloud} {
+		if strings.EqualFold(env.StorageEndpointSuffix, c.EndpointSuffix) {
+			return env
+		}
+	}
+	env := azure.PublicCloud
+	env.StorageEndpointSuffix = c.EndpointSuffix
+	return env
+}
+
+func (c Credentials) servicePrincipalToken() (*adal.ServicePrincipalToken, error) {
+	if c.UseManagedIdentity {
+		endpoint := c.TokenEndpoint
+		if endpoint == "" {
+			var err error
+			if endpoint, err = adal.GetMSIEndpoint(); err != nil {
+				return nil, err
+			}
+		}
+		if c.ClientID != "" {
+			return adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(endpoint, StorageResource, c.ClientID)
+		}
+		return adal.NewServicePrincipalTokenFromMSI(endpoint, StorageResource)
+	}
+	if c.TenantID == "" || c.ClientSecret == "" {
+		return nil, errors.New("the tenant ID and client secret are required with a client ID")
+	}
+	endpoint := c.TokenEndpoint
+	if endpoint == "" {
+		endpoint = c.environment().ActiveDirectoryEndpoint
+	}
+	config, err := adal.NewOAuthConfig(endpoint, c.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	return adal.NewServicePrincipalToken(*config, c.ClientID, c.ClientSecret, StorageResource)
+}
+
+// SenderWithBearerToken returns a Sender decorator authorizing requests with an Azure AD token, refreshed when needed
+func SenderWithBearerToken(s storage.Sender, token *adal.ServicePrincipalToken) storage.Sender {
+	return util.SenderFunc(func(c *storage.Client, r *http.Request) (*http.Response, error) {
+		if err := token.EnsureFresh(); err != nil {
+			return nil, fmt.Errorf("refreshing Azure AD token: %s", err)
+		}
+		r.Header.Set("Authorization", "Bearer "+token.OAuthToken())
+		setDefaultAPIVersion(r.Header)
+		return s.Send(c, r)
+	})
+}
+
+// SenderWithSASToken returns a Sender decorator appending the account or service SAS token to requests
+func SenderWithSASToken(s storage.Sender, token url.Values) storage.Sender {
+	return util.SenderFunc(func(c *storage.Client, r *http.Request) (*http.Response, error) {
+		query := r.URL.Query()
+		for k, v := range token {
+			query[k] = v
+		}
+		r.URL.RawQuery = query.Encode()
+		setDefaultAPIVersion(r.Header)
+		return s.Send(c, r)
+	})
+}
+
+// The services told apart by RequestService
+const (
+	TableService = "table"
+	BlobService  = "blob"
+)
+
+// emulatorServices the services of the default emulator ports
+var emulatorServices = map[string]string{"10000": BlobService, "10002": TableService}
+
+// serviceKey the context key of the service of requests sent to an overridden endpoint
+type serviceKey struct{}
+
+// Service the service of r. Requests sent to an overridden endpoint keep the service of their original URL.
+func Service(r *http.Request) string {
+	if service, ok := r.Context().Value(serviceKey{}).(string); ok {
+		return service
+	}
+	return RequestService(r.URL)
+}
+
+// RequestService the service a request is sent to, given by the first subdomain or the port of the emulator
+func RequestService(u *url.URL) string {
+	if service, ok := emulatorServices[u.Port()]; ok && u.Hostname() == "127.0.0.1" {
+		return service
+	}
+	labels := strings.Split(u.Hostname(), ".")
+	if len(labels) < 2 {
+		return ""
+	}
+	return labels[1]
+}
+
+// SenderWithEndpoints returns a Sender decorator sending the requests of each service to its endpoint.
+// The endpoint path is prepended unless the request path already starts with it,
+// as with emulator requests which are prefixed by the account name.
+func SenderWithEndpoints(s storage.Sender, endpoints map[string]*url.URL) storage.Sender {
+	return util.SenderFunc(func(c *storage.Client, r *http.Request) (*http.Response, error) {
+		service := RequestService(r.URL)
+		if endpoint, ok := endpoints[service]; ok {
+			r = r.WithContext(context.WithValue(r.Context(), serviceKey{}, service))
+			r.URL.Scheme = endpoint.Scheme
+			r.URL.Host = endpoint.Host
+			r.Host = endpoint.Host
+			prefix := strings.TrimSuffix(endpoint.Path, "/")
+			if prefix != "" && r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+				r.URL.Path = prefix + r.URL.Path
+				r.URL.RawPath = ""
+			}
+		}
+		return s.Send(c, r)
+	})
+}
+
+// setDefaultAPIVersion sets x-ms-version when empty. SAS clients take the version from the token, which is empty here.
+// Blob requests set the header bypassing the canonical form, so both forms are checked.
+func setDefaultAPIVersion(h http.Header) {
+	for k, v := range h {
+		if strings.EqualFold(k, "x-ms-version") {
+			if len(v) > 0 && v[0] != "" {
+				return
+			}
+			delete(h, k)
+		}
+	}
+	h["x-ms-version"] = []string{storage.DefaultAPIVersion}
+}
+
+// WithDefaults fills the unset fields with the ones of defaults
+func (c Credentials) WithDefaults(defaults Credentials) Credentials {
+	fill := func(v *string, d string) {
+		if *v == "" {
+			*v = d
+		}
+	}
+	fill(&c.AccountName, defaults.AccountName)
+	fill(&c.AccountKey, defaults.AccountKey)
+	fill(&c.ConnectionString, defaults.ConnectionString)
+	fill(&c.SASToken, defaults.SASToken)
+	fill(&c.TenantID, defaults.TenantID)
+	fill(&c.ClientID, defaults.ClientID)
+	fill(&c.ClientSecret, defaults.ClientSecret)
+	fill(&c.TokenEndpoint, defaults.TokenEndpoint)
+	fill(&c.EndpointSuffix, defaults.EndpointSuffix)
+	fill(&c.TableEndpoint, defaults.TableEndpoint)
+	fill(&c.BlobEndpoint, defaults.BlobEndpoint)
+	c.UseManagedIdentity = c.UseManagedIdentity || defaults.UseManagedIdentity
+	c.UseEmulator = c.UseEmulator || defaults.UseEmulator
+	if c.Sender == nil {
+		c.Sender = defaults.Sender
+	}
+	return c
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// tokenHandler stubs the Azure AD and managed identity token endpoints
+func tokenHandler(t *testing.T, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assert.Equal(t, StorageResource, r.Form.Get("resource"))
+		w.Header().Set("Content-Type", "application/json")
+		expiresOn := time.Now().Add(time.Hour).Unix()
+		fmt.Fprintf(w, `{"access_token":%q,"expires_in":"3600","expires_on":"%d","not_before":"%d","resource":%q,"token_type":"Bearer"}`,
+			token, expiresOn, time.Now().Unix(), StorageResource)
+	}
+}
+
+// send sends a request through the client Sender to a server recording it
+func send(t *testing.T, c Credentials) *http.Request {
+	client, err := c.NewClient()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var received *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer server.Close()
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/logs?$top=1", nil)
+	req.Header.Add("x-ms-version", "")
+	_, err = client.Sender.Send(&client, req)
+	assert.NoError(t, err)
+	return received
+}
+
+func TestServicePrincipal(t *testing.T) {
+	aad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/my-tenant/oauth2/token", r.URL.Path)
+		tokenHandler(t, "sp-token")(w, r)
+	}))
+	defer aad.Close()
+
+	req := send(t, Credentials{AccountName: "acme", TenantID: "my-tenant", ClientID: "id", ClientSecret: "secret", TokenEndpoint: aad.URL})
+	assert.Equal(t, "Bearer sp-token", req.Header.Get("Authorization"))
+	assert.Equal(t, []string{"2018-03-28"}, req.Header.Values("x-ms-version"))
+}
+
+func TestManagedIdentity(t *testing.T) {
+	msi := httptest.NewServer(tokenHandler(t, "msi-token"))
+	defer msi.Close()
+
+	req := send(t, Credentials{AccountName: "acme", UseManagedIdentity: true, TokenEndpoint: msi.URL})
+	assert.Equal(t, "Bearer msi-token", req.Header.Get("Authorization"))
+}
+
+func TestSASToken(t *testing.T) {
+	req := send(t, Credentials{AccountName: "acme", SASToken: "?sv=2018-03-28&sig=abc&se=2030-01-01"})
+	assert.Equal(t, "abc", req.URL.Query().Get("sig"))
+	assert.Equal(t, "1", req.URL.Query().Get("$top"))
+	assert.Empty(t, req.Header.Get("Authorization"))
+}
+
+func TestAccount(t *testing.T) {
+	c := Credentials{ConnectionString: "DefaultEndpointsProtocol=https;AccountName=acme;AccountKey=a2V5;EndpointSuffix=core.windows.net"}
+	assert.Equal(t, "acme", c.Account())
+	_, err := c.NewClient()
+	assert.NoError(t, err)
+}
+
+func TestNoCredentials(t *testing.T) {
+	_, err := Credentials{AccountName: "acme"}.NewClient()
+	assert.Error(t, err)
+	_, err = Credentials{ClientID: "id"}.NewClient()
+	assert.EqualError(t, err, "the account name is required with Azure AD credentials")
+}
+
+// record records the requests sent to a test server along with their Authorization header
+func record(t *testing.T, paths *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*paths = append(*paths, r.URL.Path)
+		assert.NotEmpty(t, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+}
+
+func TestEmulatorEndpoints(t *testing.T) {
+	var paths []string
+	server := record(t, &paths)
+	defer server.Close()
+
+	client, err := Credentials{UseEmulator: true, TableEndpoint: server.URL + "/devstoreaccount1", BlobEndpoint: server.URL}.NewClient()
+	assert.NoError(t, err)
+	tableService := client.GetTableService()
+	tableService.GetTableReference("logs").Get(5, storage.MinimalMetadata)
+	blobService := client.GetBlobService()
+	blobService.GetContainerReference("backups").Exists()
+	assert.Equal(t, []string{"/devstoreaccount1/Tables('logs')", "/devstoreaccount1/backups"}, paths)
+}
+
+func TestTableEndpoint(t *testing.T) {
+	var paths []string
+	server := record(t, &paths)
+	defer server.Close()
+
+	client, err := Credentials{AccountName: "acme", AccountKey: "a2V5", TableEndpoint: server.URL + "/acme/"}.NewClient()
+	assert.NoError(t, err)
+	tableService := client.GetTableService()
+	tableService.GetTableReference("logs").Get(5, storage.MinimalMetadata)
+	assert.Equal(t, []string{"/acme/Tables('logs')"}, paths)
+
+	_, err = Credentials{AccountName: "acme", AccountKey: "a2V5", BlobEndpoint: "127.0.0.1:10000"}.NewClient()
+	assert.Error(t, err)
+}
+
+// roundTripperFunc an http.RoundTripper calling the function
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestTransport(t *testing.T) {
+	var paths []string
+	server := record(t, &paths)
+	defer server.Close()
+
+	var services []string
+	credentials := Credentials{AccountName: "acme", AccountKey: "a2V5", TableEndpoint: server.URL, BlobEndpoint: server.URL}
+	credentials.Transport = func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			services = append(services, Service(r))
+			return next.RoundTrip(r)
+		})
+	}
+	client, err := credentials.NewClient()
+	assert.NoError(t, err)
+	tableService := client.GetTableService()
+	tableService.GetTableReference("logs").Get(5, storage.MinimalMetadata)
+	blobService := client.GetBlobService()
+	blobService.GetContainerReference("backups").Exists()
+	assert.Equal(t, []string{TableService, BlobService}, services, "services of the original URLs")
+	assert.Len(t, paths, 2)
+}
+
+func TestEndpointSuffix(t *testing.T) {
+	client, err := Credentials{AccountName: "acme", AccountKey: "a2V5", EndpointSuffix: "core.chinacloudapi.cn"}.NewClient()
+	assert.NoError(t, err)
+	var host string
+	client.Sender = util.SenderFunc(func(c *storage.Client, r *http.Request) (*http.Response, error) {
+		host = r.URL.Host
+		return nil, errors.New("not sent")
+	})
+	tableService := client.GetTableService()
+	tableService.GetTableReference("logs").Get(5, storage.MinimalMetadata)
+	assert.Equal(t, "acme.table.core.chinacloudapi.cn", host)
+	assert.Equal(t, azure.ChinaCloud.ActiveDirectoryEndpoint, Credentials{EndpointSuffix: "core.chinacloudapi.cn"}.environment().ActiveDirectoryEndpoint)
+}
@@ -0,0 +1,142 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	uuid "github.com/satori/go.uuid"
+)
+
+// MaxBatchSize the maximum number of sub-requests of a blob batch
+const MaxBatchSize = util.MaxBlobBatchSize
+
+// errBatchNotSupported the blob service rejected a batch, as older emulators do
+type errBatchNotSupported struct {
+	err error
+}
+
+func (e errBatchNotSupported) Error() string {
+	return fmt.Sprintf("blob batches aren't supported: %v", e.err)
+}
+
+// unsupportedBatchCodes the error codes of services which don't support blob batches
+var unsupportedBatchCodes = map[string]bool{
+	"InvalidQueryParameterValue": true,
+	"UnsupportedQueryParameter":  true,
+	"InvalidUri":                 true,
+	"InvalidHeaderValue":         true,
+	"UnsupportedHeader":          true,
+	"NotImplemented":             true,
+}
+
+// deleteBlobs deletes up to MaxBatchSize blobs in a single batch. Base blobs are deleted along with their snapshots,
+// snapshots and versions on their own. Returns the error of each blob, nil when it was deleted, or the error of the whole batch.
+func (c *restClient) deleteBlobs(blobs []listedBlob) ([]error, error) {
+	date := time.Now().UTC().Format(http.TimeFormat)
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	if err := writer.SetBoundary("batch_" + uuid.NewV4().String()); err != nil {
+		return nil, err
+	}
+	for i, blob := range blobs {
+		u, err := url.Parse(blob.GetURL())
+		if err != nil {
+			return nil, err
+		}
+		sub := &http.Request{Method: http.MethodDelete, URL: &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: blob.query().Encode()}, Header: make(http.Header)}
+		sub.Header["x-ms-date"] = []string{date}
+		if blob.isBase() {
+			sub.Header["x-ms-delete-snapshots"] = []string{"include"}
+		}
+		if err := c.authorize(sub); err != nil {
+			return nil, err
+		}
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Type", "application/http")
+		h.Set("Content-Transfer-Encoding", "binary")
+		h.Set("Content-ID", strconv.Itoa(i))
+		part, _ := writer.CreatePart(h)
+		fmt.Fprintf(part, "%s %s HTTP/1.1\r\n", sub.Method, sub.URL.RequestURI())
+		names := make([]string, 0, len(sub.Header))
+		for name := range sub.Header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(part, "%s: %s\r\n", name, sub.Header[name][0])
+		}
+		fmt.Fprint(part, "Content-Length: 0\r\n\r\n")
+	}
+	writer.Close()
+
+	req, err := http.NewRequest(http.MethodPost, c.endpoint+"?comp=batch", bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	req.Header["x-ms-date"] = []string{date}
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		err := serviceError(resp)
+		if resp.StatusCode == http.StatusNotImplemented || resp.StatusCode == http.StatusMethodNotAllowed ||
+			(resp.StatusCode == http.StatusBadRequest && unsupportedBatchCodes[err.Code]) {
+			return nil, errBatchNotSupported{err}
+		}
+		return nil, err
+	}
+	return readBatchResponse(resp, len(blobs))
+}
+
+// readBatchResponse the error of each sub-request, identified by its Content-ID or by its position
+func readBatchResponse(resp *http.Response, size int) ([]error, error) {
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return nil, fmt.Errorf("invalid batch response content type %q", resp.Header.Get("Content-Type"))
+	}
+	errs := make([]error, size)
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+	n := 0
+	for ; ; n++ {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading batch response: %v", err)
+		}
+		i := n
+		if id, err := strconv.Atoi(part.Header.Get("Content-ID")); err == nil {
+			i = id
+		}
+		if i < 0 || i >= size {
+			return nil, fmt.Errorf("unexpected batch sub-response %d", i)
+		}
+		subResponse, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			return nil, fmt.Errorf("reading batch sub-response %d: %v", i, err)
+		}
+		if subResponse.StatusCode != http.StatusAccepted {
+			errs[i] = serviceError(subResponse)
+		}
+		subResponse.Body.Close()
+	}
+	if n != size {
+		return nil, fmt.Errorf("expected %d batch sub-responses, got %d", size, n)
+	}
+	return errs, nil
+}
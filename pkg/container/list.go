@@ -0,0 +1,123 @@
+package container
+
+import (
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/metrics"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// lister lists containers and pages through their blobs, recording the list metrics.
+// Blobs are listed by rest, when set, to read what the storage client doesn't, such as versions and access tiers.
+type lister struct {
+	blobService *storage.BlobStorageClient
+	rest        *restClient
+	Metrics     *metrics.Metrics
+}
+
+// listContainers the containers whose name starts with prefix
+func (c *lister) listContainers(prefix string) ([]storage.Container, error) {
+	log.Debug("Listing containers")
+	containers := make([]storage.Container, 0)
+	listParams := storage.ListContainersParameters{Prefix: prefix}
+	containerListresponse, err := c.blobService.ListContainers(listParams)
+	if err != nil {
+		return nil, err
+	}
+	containers = append(containers, containerListresponse.Containers...)
+	for containerListresponse.NextMarker != "" {
+		listParams = storage.ListContainersParameters{Prefix: prefix, Marker: containerListresponse.NextMarker}
+		containerListresponse, err = c.blobService.ListContainers(listParams)
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, containerListresponse.Containers...)
+	}
+	log.Debugf("Found %d container(s)", len(containers))
+	return containers, nil
+}
+
+type callback func(blob storage.Blob)
+
+func (c *lister) listBlobs(container *storage.Container, listParams storage.ListBlobsParameters) (storage.BlobListResponse, error) {
+	c.Metrics.RegisterBlobPageAttempt()
+	start := time.Now()
+	response, err := container.ListBlobs(listParams)
+	if err != nil {
+		c.Metrics.RegisterBlobPageFailed()
+	} else {
+		c.Metrics.RegisterBlobPageDurationSince(start)
+	}
+	return response, err
+}
+
+// forEachPage calls cb for each page of the blobs listed with listParams
+func (c *lister) forEachPage(container *storage.Container, listParams storage.ListBlobsParameters, cb func(response storage.BlobListResponse) error) error {
+	response, err := c.listBlobs(container, listParams)
+	if err != nil {
+		util.WithError(log.WithField(util.LogFieldContainer, container.Name), err).Error("Error listing blobs")
+		return err
+	}
+	if err := cb(response); err != nil {
+		return err
+	}
+
+	for response.NextMarker != "" {
+		listParams.Marker = response.NextMarker
+		response, err = c.listBlobs(container, listParams)
+		if err != nil {
+			util.WithError(log.WithField(util.LogFieldContainer, container.Name), err).Errorf("Error retrieving marker %s", listParams.Marker)
+			return err
+		}
+		if err := cb(response); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachBlobInContainer calls cb for each blob listed with listParams, page by page
+func (c *lister) forEachBlobInContainer(container *storage.Container, listParams storage.ListBlobsParameters, cb callback) error {
+	return c.forEachPage(container, listParams, func(response storage.BlobListResponse) error {
+		for _, blob := range response.Blobs {
+			cb(blob)
+		}
+		return nil
+	})
+}
+
+// forEachPrefixInContainer calls cb for each virtual directory right under prefix, which ends with /
+func (c *lister) forEachPrefixInContainer(container *storage.Container, prefix string, cb func(prefix string) error) error {
+	return c.forEachPage(container, storage.ListBlobsParameters{Prefix: prefix, Delimiter: "/"}, func(response storage.BlobListResponse) error {
+		for _, blobPrefix := range response.BlobPrefixes {
+			if err := cb(blobPrefix); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// forEachListedBlob calls cb for each blob under prefix listed by the REST client along with the datasets of include
+func (c *lister) forEachListedBlob(container *storage.Container, prefix, include string, cb func(blob listedBlob)) error {
+	marker := ""
+	for {
+		c.Metrics.RegisterBlobPageAttempt()
+		start := time.Now()
+		response, err := c.rest.listBlobs(container, prefix, marker, include)
+		if err != nil {
+			c.Metrics.RegisterBlobPageFailed()
+			util.WithError(log.WithField(util.LogFieldContainer, container.Name), err).Error("Error listing blobs")
+			return err
+		}
+		c.Metrics.RegisterBlobPageDurationSince(start)
+		for _, blob := range response.Blobs {
+			cb(blob)
+		}
+		if marker = response.NextMarker; marker == "" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,581 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/dustin/go-humanize"
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	"github.com/fabito/azure-storage-purger/pkg/metrics"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// PurgeOptions selects the blobs deleted by a BlobPurger
+type PurgeOptions struct {
+	// Containers the names of the containers to purge
+	Containers []string
+	// ContainerPattern selects the containers to purge by name, using the syntax of path.Match, i.e. logs-*
+	ContainerPattern string
+	// Prefix only blobs whose name starts with Prefix are deleted
+	Prefix string
+	// PathTemplate maps the paths of blobs, after the virtual directory of Prefix, to dates. See PathTemplate.
+	// Only the directories starting with Prefix are walked.
+	// When set blobs expire by the date of their path instead of their last modification.
+	PathTemplate string
+	// Metadata only blobs having all these metadata keys, case insensitively, and values are deleted
+	Metadata map[string]string
+	// TagQuery only blobs whose index tags match this Find Blobs by Tags expression are deleted, i.e. "tenant" = 'x'
+	TagQuery string
+	// NumDaysToKeep blobs modified, or dated by their path, within this number of days are kept
+	NumDaysToKeep int
+	// NumWorkers the number of concurrent deletes, 1 when 0
+	NumWorkers int
+	// BatchSize the number of blobs deleted per Blob Batch request, up to MaxBatchSize.
+	// Blobs are deleted one by one when 0 or 1, or when the service doesn't support batches.
+	BatchSize int
+	// SnapshotsOlderThanDays snapshots taken before this number of days are deleted, disabled when 0
+	SnapshotsOlderThanDays int
+	// VersionsOlderThanDays previous versions created before this number of days are deleted, disabled when 0
+	VersionsOlderThanDays int
+	// KeepAtLeast the number of most recent snapshots, and of previous versions, kept for each blob regardless of their age
+	KeepAtLeast int
+	// DryRun lists the expired blobs without deleting them
+	DryRun bool
+}
+
+// purgesCopies whether the snapshots and previous versions of blobs are purged instead of the blobs themselves
+func (o PurgeOptions) purgesCopies() bool {
+	return o.SnapshotsOlderThanDays > 0 || o.VersionsOlderThanDays > 0
+}
+
+// PurgeResult the outcome of a container purge
+type PurgeResult struct {
+	ContainerCount int64     `json:"container_count"`
+	BlobCount      int64     `json:"blob_count"`
+	ExpiredCount   int64     `json:"expired_count"`
+	ExpiredBytes   int64     `json:"expired_bytes"`
+	DeletedCount   int64     `json:"deleted_count"`
+	DeletedBytes   int64     `json:"deleted_bytes"`
+	ErrorCount     int64     `json:"error_count"`
+	BatchCount     int64     `json:"batch_count"`
+	DryRun         bool      `json:"dry_run,omitempty"`
+	StartTime      time.Time `json:"start_time"`
+	EndTime        time.Time `json:"end_time"`
+}
+
+func (p *PurgeResult) end(metrics *metrics.Metrics) {
+	p.EndTime = time.Now().UTC()
+	p.ContainerCount = metrics.ContainerCount()
+	p.BlobCount = metrics.BlobCount()
+	p.DeletedCount = metrics.DeletedBlobCount()
+	p.DeletedBytes = metrics.DeletedBlobBytes()
+	p.ErrorCount = metrics.BlobDeleteErrorCount() + metrics.BlobPageErrorCount()
+	p.BatchCount = metrics.BlobBatchCount()
+}
+
+// HasErrors whether or not any list or delete failed during the purge
+func (p PurgeResult) HasErrors() bool {
+	return p.ErrorCount > 0
+}
+
+func (p PurgeResult) String() string {
+	if p.DryRun {
+		return fmt.Sprintf("Dry run: %s of %s blob(s) listed in %d container(s) would be deleted, %s. Errors: %d",
+			humanize.Comma(p.ExpiredCount), humanize.Comma(p.BlobCount), p.ContainerCount, humanize.Bytes(uint64(p.ExpiredBytes)), p.ErrorCount)
+	}
+	return fmt.Sprintf("Deleted %s of %s expired blob(s) listed in %d container(s), %s. Errors: %d",
+		humanize.Comma(p.DeletedCount), humanize.Comma(p.ExpiredCount), p.ContainerCount, humanize.Bytes(uint64(p.DeletedBytes)), p.ErrorCount)
+}
+
+// BlobPurger deletes the blobs of containers older than a retention period
+type BlobPurger struct {
+	lister
+	options      PurgeOptions
+	template     *PathTemplate
+	expiredCount int64
+	expiredBytes int64
+	// batchUnsupported set to 1 once the service rejected a batch
+	batchUnsupported int32
+	// action names what is done to expired blobs in logs
+	action string
+	// process deletes, or otherwise processes, expired blobs
+	process func(logger *log.Entry, blobs []listedBlob)
+	// accept filters the expired blobs passed to process, all of them when nil
+	accept func(blob listedBlob) bool
+	// listTiers lists blobs with the REST client, which reads their access tier
+	listTiers bool
+	// metadata the metadata selecting blobs, with lowercase keys
+	metadata map[string]string
+}
+
+// NewBlobPurger creates a BlobPurger deleting the blobs selected by options
+func NewBlobPurger(credentials auth.Credentials, options PurgeOptions) (*BlobPurger, error) {
+	if options.SnapshotsOlderThanDays < 0 || options.VersionsOlderThanDays < 0 {
+		return nil, errors.New("invalid number of days. Snapshots and versions can't be older than a negative number of days")
+	}
+	if options.KeepAtLeast < 0 {
+		return nil, fmt.Errorf("invalid number of snapshots and versions to keep %d", options.KeepAtLeast)
+	}
+	if options.purgesCopies() && options.PathTemplate != "" {
+		return nil, errors.New("path templates don't apply to snapshots and versions")
+	}
+	if options.BatchSize > MaxBatchSize {
+		return nil, fmt.Errorf("invalid batch size %d. Batches hold up to %d blobs", options.BatchSize, MaxBatchSize)
+	}
+	if options.BatchSize < 1 {
+		options.BatchSize = 1
+	}
+	needsREST := options.BatchSize > 1 || options.purgesCopies() || options.TagQuery != ""
+	purger, err := newBlobPurger(credentials, options, metrics.NewBlobPurgeMetrics(metrics.NewRunID()), needsREST)
+	if err != nil {
+		return nil, err
+	}
+	purger.action = "Purging"
+	purger.process = purger.deleteBlobs
+	return purger, nil
+}
+
+// newBlobPurger validates the selection of options and creates a BlobPurger with a REST client when needed
+func newBlobPurger(credentials auth.Credentials, options PurgeOptions, m *metrics.Metrics, needsREST bool) (*BlobPurger, error) {
+	if len(options.Containers) == 0 && options.ContainerPattern == "" {
+		return nil, errors.New("either containers or a container pattern are required")
+	}
+	if _, err := path.Match(options.ContainerPattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid container pattern %q: %v", options.ContainerPattern, err)
+	}
+	if options.NumDaysToKeep < 0 {
+		return nil, fmt.Errorf("invalid number of days to keep %d", options.NumDaysToKeep)
+	}
+	if options.NumWorkers < 1 {
+		options.NumWorkers = 1
+	}
+	var template *PathTemplate
+	if options.PathTemplate != "" {
+		var err error
+		if template, err = ParsePathTemplate(options.PathTemplate); err != nil {
+			return nil, err
+		}
+	}
+	client, err := credentials.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	blobService := client.GetBlobService()
+	purger := &BlobPurger{
+		lister:   lister{blobService: &blobService, Metrics: m},
+		options:  options,
+		template: template,
+	}
+	if len(options.Metadata) > 0 {
+		// the storage client lowercases the metadata keys of listed blobs
+		purger.metadata = make(map[string]string, len(options.Metadata))
+		for k, v := range options.Metadata {
+			purger.metadata[strings.ToLower(k)] = v
+		}
+	}
+	if needsREST {
+		authorize, err := credentials.NewAuthorizer()
+		if err != nil {
+			return nil, err
+		}
+		purger.lister.rest = newRESTClient(&client, authorize)
+	}
+	return purger, nil
+}
+
+// selectContainers the containers named in the options followed by the ones matching the pattern
+func (p *BlobPurger) selectContainers() ([]*storage.Container, error) {
+	selected := make(map[string]bool)
+	var containers []*storage.Container
+	for _, name := range p.options.Containers {
+		if !selected[name] {
+			selected[name] = true
+			containers = append(containers, p.blobService.GetContainerReference(name))
+		}
+	}
+	if p.options.ContainerPattern == "" {
+		return containers, nil
+	}
+	// only the containers starting with the literal part of the pattern are listed
+	prefix := p.options.ContainerPattern
+	if i := strings.IndexAny(prefix, `*?[\`); i >= 0 {
+		prefix = prefix[:i]
+	}
+	listed, err := p.listContainers(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range listed {
+		if matched, _ := path.Match(p.options.ContainerPattern, container.Name); matched && !selected[container.Name] {
+			selected[container.Name] = true
+			containers = append(containers, p.blobService.GetContainerReference(container.Name))
+		}
+	}
+	return containers, nil
+}
+
+// Purge deletes the blobs of the selected containers older than the retention period.
+// Containers are purged one after the other, their blobs are deleted concurrently, in batches, while they are listed.
+func (p *BlobPurger) Purge() (PurgeResult, error) {
+	defer p.Metrics.Finish()
+	if p.options.DryRun {
+		log.Warn("Dry run is ENABLED")
+	}
+	result := PurgeResult{DryRun: p.options.DryRun, StartTime: time.Now().UTC()}
+	containers, err := p.selectContainers()
+	if err != nil {
+		return result, err
+	}
+	cutoff := result.StartTime.AddDate(0, 0, -p.options.NumDaysToKeep)
+	switch {
+	case p.options.purgesCopies():
+		log.Infof("Purging snapshots older than %d day(s) and previous versions older than %d day(s), keeping at least %d of each per blob, from %d container(s)",
+			p.options.SnapshotsOlderThanDays, p.options.VersionsOlderThanDays, p.options.KeepAtLeast, len(containers))
+	case p.template != nil:
+		log.Infof("Purging blobs whose path %s dates before %s from %d container(s)", p.template, cutoff.Format(time.RFC3339), len(containers))
+	default:
+		log.Infof("Purging blobs last modified before %s from %d container(s)", cutoff.Format(time.RFC3339), len(containers))
+	}
+	for _, container := range containers {
+		p.purgeContainer(container, result.StartTime)
+	}
+	result.ExpiredCount = atomic.LoadInt64(&p.expiredCount)
+	result.ExpiredBytes = atomic.LoadInt64(&p.expiredBytes)
+	result.end(p.Metrics)
+	log.Info(result)
+	return result, nil
+}
+
+// cutoff the time days before start, the zero time when days is 0
+func cutoff(start time.Time, days int) time.Time {
+	if days == 0 {
+		return time.Time{}
+	}
+	return start.AddDate(0, 0, -days)
+}
+
+func (p *BlobPurger) purgeContainer(container *storage.Container, start time.Time) {
+	logger := log.WithField(util.LogFieldContainer, container.Name)
+	logger.Infof("%s blobs", p.action)
+	// the blobs found by tags, whose properties Find Blobs by Tags doesn't return, are selected while listing
+	var tagged map[string]bool
+	if p.options.TagQuery != "" {
+		var err error
+		if tagged, err = p.findBlobsByTags(container); err != nil {
+			p.Metrics.RegisterContainerProcessed()
+			return
+		}
+	}
+	expired := make(chan []listedBlob, p.options.NumWorkers)
+	var wg sync.WaitGroup
+	for w := 0; w < p.options.NumWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blobs := range expired {
+				p.process(logger, blobs)
+			}
+		}()
+	}
+
+	blobCount := int64(0)
+	visit := func(blob storage.Blob) {
+		blobCount++
+		p.Metrics.RegisterBlobProcessed(blob.Properties.ContentLength)
+		if blobCount%10000 == 0 {
+			logger.Debugf("Visited %s blobs", humanize.Comma(blobCount))
+		}
+	}
+	var pending []listedBlob
+	expire := func(blob listedBlob) {
+		if !p.matchesMetadata(blob) || (tagged != nil && !tagged[blob.Name]) {
+			return
+		}
+		if p.accept != nil && !p.accept(blob) {
+			return
+		}
+		atomic.AddInt64(&p.expiredCount, 1)
+		atomic.AddInt64(&p.expiredBytes, blob.Properties.ContentLength)
+		pending = append(pending, blob)
+		if len(pending) == p.options.BatchSize {
+			expired <- pending
+			pending = nil
+		}
+	}
+	var err error
+	switch {
+	case p.options.purgesCopies():
+		snapshotCutoff, versionCutoff := cutoff(start, p.options.SnapshotsOlderThanDays), cutoff(start, p.options.VersionsOlderThanDays)
+		err = p.forEachBlobWithCopies(container, p.options.Prefix, func(blobs []listedBlob) {
+			for _, blob := range blobs {
+				visit(blob.Blob)
+			}
+			p.expireCopies(blobs, snapshotCutoff, versionCutoff, expire)
+		})
+	case p.template != nil:
+		err = p.walkTemplate(container, p.options.Prefix, 0, nil, start.AddDate(0, 0, -p.options.NumDaysToKeep), func(blob listedBlob) {
+			visit(blob.Blob)
+			expire(blob)
+		})
+	default:
+		modifiedCutoff := start.AddDate(0, 0, -p.options.NumDaysToKeep)
+		err = p.forEachBlob(container, p.options.Prefix, func(blob listedBlob) {
+			visit(blob.Blob)
+			if time.Time(blob.Properties.LastModified).Before(modifiedCutoff) {
+				expire(blob)
+			}
+		})
+	}
+	if len(pending) > 0 {
+		expired <- pending
+	}
+	close(expired)
+	wg.Wait()
+	p.Metrics.RegisterContainerProcessed()
+	if err == nil {
+		logger.Infof("Visited %s blobs", humanize.Comma(blobCount))
+	}
+}
+
+// walkTemplate descends the virtual directories under prefix matching the segments of the template from the i-th one.
+// Segments are matched from the directory of prefix, so a prefix such as resourceId only narrows the directories walked.
+// All the blobs under a directory whose date ends before cutoff are passed to expire. Directories whose date
+// starts after cutoff aren't listed. Directories of the smallest date unit of the template straddling cutoff are kept.
+func (p *BlobPurger) walkTemplate(container *storage.Container, prefix string, i int, date pathDate, cutoff time.Time, expire func(blob listedBlob)) error {
+	if len(date) > 0 {
+		if !date.start().Before(cutoff) {
+			return nil
+		}
+		if !date.end().After(cutoff) {
+			log.WithField(util.LogFieldContainer, container.Name).Debugf("%s blobs under %s", p.action, prefix)
+			return p.forEachBlob(container, prefix, expire)
+		}
+	}
+	segments := p.template.segments
+	if i == len(segments) {
+		return nil
+	}
+	return p.forEachPrefixInContainer(container, prefix, func(child string) error {
+		name := strings.TrimSuffix(child[strings.LastIndex(prefix, "/")+1:], "/")
+		if segments[i].raw == "**" {
+			// ** ends at the first directory matching the next segment
+			if matched, ok := segments[i+1].match(name, date); ok {
+				return p.walkTemplate(container, child, i+2, matched, cutoff, expire)
+			}
+			return p.walkTemplate(container, child, i, date, cutoff, expire)
+		}
+		if matched, ok := segments[i].match(name, date); ok {
+			return p.walkTemplate(container, child, i+1, matched, cutoff, expire)
+		}
+		return nil
+	})
+}
+
+// forEachBlob calls cb for each blob under prefix. Blobs are listed by the REST client when their access tier is needed.
+func (p *BlobPurger) forEachBlob(container *storage.Container, prefix string, cb func(blob listedBlob)) error {
+	if p.listTiers {
+		include := ""
+		if p.metadata != nil {
+			include = "metadata"
+		}
+		return p.forEachListedBlob(container, prefix, include, cb)
+	}
+	listParams := storage.ListBlobsParameters{Prefix: prefix}
+	if p.metadata != nil {
+		listParams.Include = &storage.IncludeBlobDataset{Metadata: true}
+	}
+	return p.forEachBlobInContainer(container, listParams, func(blob storage.Blob) {
+		cb(listedBlob{Blob: blob})
+	})
+}
+
+// forEachBlobWithCopies calls cb with each blob under prefix along with its snapshots and previous versions,
+// which the service lists right before the blob. Copies of deleted blobs are passed on their own.
+func (p *BlobPurger) forEachBlobWithCopies(container *storage.Container, prefix string, cb func(blobs []listedBlob)) error {
+	var blobs []listedBlob
+	include := "snapshots,versions"
+	if p.metadata != nil {
+		include += ",metadata"
+	}
+	err := p.forEachListedBlob(container, prefix, include, func(blob listedBlob) {
+		if len(blobs) > 0 && blobs[0].Name != blob.Name {
+			cb(blobs)
+			blobs = nil
+		}
+		blobs = append(blobs, blob)
+	})
+	if err != nil {
+		return err
+	}
+	if len(blobs) > 0 {
+		cb(blobs)
+	}
+	return nil
+}
+
+// matchesMetadata whether blob has the metadata selecting blobs
+func (p *BlobPurger) matchesMetadata(blob listedBlob) bool {
+	for k, v := range p.metadata {
+		if value, ok := blob.Metadata[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// findBlobsByTags the names of the blobs of container whose index tags match the tag query
+func (p *BlobPurger) findBlobsByTags(container *storage.Container) (map[string]bool, error) {
+	logger := log.WithField(util.LogFieldContainer, container.Name)
+	where := fmt.Sprintf("@container = '%s' AND %s", container.Name, p.options.TagQuery)
+	tagged := make(map[string]bool)
+	marker := ""
+	for {
+		p.Metrics.RegisterBlobPageAttempt()
+		start := time.Now()
+		response, err := p.rest.findBlobsByTags(where, marker)
+		if err != nil {
+			p.Metrics.RegisterBlobPageFailed()
+			util.WithError(logger, err).Error("Error finding blobs by tags")
+			return nil, err
+		}
+		p.Metrics.RegisterBlobPageDurationSince(start)
+		for _, blob := range response.Blobs {
+			if blob.ContainerName == container.Name {
+				tagged[blob.Name] = true
+			}
+		}
+		if marker = response.NextMarker; marker == "" {
+			break
+		}
+	}
+	logger.Debugf("Found %s blob(s) by tags", humanize.Comma(int64(len(tagged))))
+	return tagged, nil
+}
+
+// expireCopies passes to expire the snapshots taken before snapshotCutoff and the previous versions created before
+// versionCutoff, except for the KeepAtLeast most recent snapshots and versions. Blobs themselves never expire.
+func (p *BlobPurger) expireCopies(blobs []listedBlob, snapshotCutoff, versionCutoff time.Time, expire func(blob listedBlob)) {
+	var snapshots, versions []listedBlob
+	for _, blob := range blobs {
+		switch {
+		case !blob.Snapshot.IsZero():
+			snapshots = append(snapshots, blob)
+		case !blob.isBase():
+			versions = append(versions, blob)
+		}
+	}
+	expireOlder := func(copies []listedBlob, created func(blob listedBlob) time.Time, cutoff time.Time) {
+		sort.Slice(copies, func(i, j int) bool { return created(copies[i]).After(created(copies[j])) })
+		for i, blob := range copies {
+			if i >= p.options.KeepAtLeast && created(blob).Before(cutoff) {
+				expire(blob)
+			}
+		}
+	}
+	expireOlder(snapshots, func(blob listedBlob) time.Time { return blob.Snapshot }, snapshotCutoff)
+	expireOlder(versions, versionTime, versionCutoff)
+}
+
+// versionTime the creation time of a version, which its ID is made of, falling back to its last modification
+func versionTime(blob listedBlob) time.Time {
+	if created, err := time.Parse(time.RFC3339Nano, blob.VersionID); err == nil {
+		return created
+	}
+	return time.Time(blob.Properties.LastModified)
+}
+
+// blobLogger adds the name of blob, and the snapshot or the version it is, to logger
+func blobLogger(logger *log.Entry, blob listedBlob) *log.Entry {
+	logger = logger.WithField(util.LogFieldBlob, blob.Name)
+	query := blob.query()
+	if snapshot := query.Get("snapshot"); snapshot != "" {
+		logger = logger.WithField(util.LogFieldSnapshot, snapshot)
+	}
+	if version := query.Get("versionid"); version != "" {
+		logger = logger.WithField(util.LogFieldVersion, version)
+	}
+	return logger
+}
+
+// deleteBlobs deletes blobs in a batch, or one by one when there's a single blob or batches aren't supported
+func (p *BlobPurger) deleteBlobs(logger *log.Entry, blobs []listedBlob) {
+	if p.options.DryRun {
+		for _, blob := range blobs {
+			blobLogger(logger, blob).Debug("Expired blob")
+		}
+		return
+	}
+	if len(blobs) > 1 && atomic.LoadInt32(&p.batchUnsupported) == 0 && p.deleteBatch(logger, blobs) {
+		return
+	}
+	for _, blob := range blobs {
+		p.deleteBlob(logger, blob)
+	}
+}
+
+// deleteBatch deletes blobs in a single batch, counting the failure of each blob.
+// Returns false when the service doesn't support batches.
+func (p *BlobPurger) deleteBatch(logger *log.Entry, blobs []listedBlob) bool {
+	start := time.Now()
+	errs, err := p.rest.deleteBlobs(blobs)
+	if _, ok := err.(errBatchNotSupported); ok {
+		if atomic.CompareAndSwapInt32(&p.batchUnsupported, 0, 1) {
+			util.WithError(logger, err).Warn("Deleting blobs one by one")
+		}
+		return false
+	}
+	p.Metrics.RegisterBlobBatchAttempt()
+	if err != nil {
+		util.WithError(logger.WithField(util.LogFieldBatchSize, len(blobs)), err).Error("Error executing blob batch")
+		p.Metrics.RegisterBlobBatchFailed()
+		for range blobs {
+			p.Metrics.RegisterBlobDeleteAttempt()
+			p.Metrics.RegisterBlobDeleteFailed()
+		}
+		return true
+	}
+	p.Metrics.RegisterBlobBatchDurationSince(start)
+	for i, blob := range blobs {
+		p.Metrics.RegisterBlobDeleteAttempt()
+		switch {
+		case errs[i] == nil:
+			p.Metrics.RegisterBlobDeleted(blob.Properties.ContentLength)
+		case util.ErrorCode(errs[i]) != "BlobNotFound":
+			util.WithError(blobLogger(logger, blob), errs[i]).Error("Error deleting blob")
+			p.Metrics.RegisterBlobDeleteFailed()
+		}
+	}
+	return true
+}
+
+// deleteBlob deletes blob along with its snapshots, or the snapshot or version it is. Blobs already gone are skipped.
+func (p *BlobPurger) deleteBlob(logger *log.Entry, blob listedBlob) {
+	logger = blobLogger(logger, blob)
+	p.Metrics.RegisterBlobDeleteAttempt()
+	start := time.Now()
+	var deleted bool
+	var err error
+	if blob.isBase() {
+		includeSnapshots := true
+		deleted, err = blob.DeleteIfExists(&storage.DeleteBlobOptions{DeleteSnapshots: &includeSnapshots})
+	} else {
+		deleted, err = p.rest.deleteBlob(blob)
+	}
+	if err != nil {
+		util.WithError(logger, err).Error("Error deleting blob")
+		p.Metrics.RegisterBlobDeleteFailed()
+		return
+	}
+	p.Metrics.RegisterBlobDeleteDurationSince(start)
+	if deleted {
+		p.Metrics.RegisterBlobDeleted(blob.Properties.ContentLength)
+	}
+}
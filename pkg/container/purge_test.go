@@ -0,0 +1,334 @@
+package container
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	"github.com/fabito/azure-storage-purger/pkg/fakestorage"
+	"github.com/stretchr/testify/assert"
+)
+
+// populate adds a blob of 100 bytes per day over the last days to container, under prefix
+func populate(server *fakestorage.BlobServer, container, prefix string, days int) {
+	now := time.Now().UTC()
+	for d := 0; d < days; d++ {
+		server.PutBlob(container, storage.Blob{
+			Name: fmt.Sprintf("%s%03d.json", prefix, d),
+			Properties: storage.BlobProperties{
+				LastModified:  storage.TimeRFC1123(now.AddDate(0, 0, -d).Add(-time.Hour)),
+				ContentLength: 100,
+			},
+		})
+	}
+}
+
+func newBlobServer() (*fakestorage.BlobServer, auth.Credentials) {
+	server := fakestorage.NewBlobServer()
+	server.PageSize = 7
+	populate(server, "logs-app", "app/", 30)
+	populate(server, "logs-app", "web/", 30)
+	populate(server, "logs-db", "", 30)
+	populate(server, "metrics", "", 30)
+	return server, auth.Credentials{AccountName: "acme", AccountKey: "YWNtZQ==", BlobEndpoint: server.URL}
+}
+
+func TestPurge(t *testing.T) {
+	server, credentials := newBlobServer()
+	defer server.Close()
+
+	purger, err := NewBlobPurger(credentials, PurgeOptions{ContainerPattern: "logs-*", Prefix: "app/", NumDaysToKeep: 10, NumWorkers: 4})
+	assert.NoError(t, err)
+	result, err := purger.Purge()
+	assert.NoError(t, err)
+	assert.False(t, result.HasErrors())
+	assert.Equal(t, int64(2), result.ContainerCount)
+	assert.Equal(t, int64(30), result.BlobCount)
+	assert.Equal(t, int64(20), result.DeletedCount)
+	assert.Equal(t, int64(20*100), result.DeletedBytes)
+	assert.Equal(t, result.ExpiredCount, result.DeletedCount)
+
+	// blobs outside the prefix or the matching containers are kept
+	assert.Len(t, server.Blobs("logs-app"), 10+30)
+	assert.Len(t, server.Blobs("logs-db"), 30)
+	assert.Len(t, server.Blobs("metrics"), 30)
+	for _, blob := range server.Blobs("logs-app") {
+		assert.NotEqual(t, "app/010.json", blob.Name)
+	}
+}
+
+func TestPurgeContainers(t *testing.T) {
+	server, credentials := newBlobServer()
+	defer server.Close()
+
+	purger, err := NewBlobPurger(credentials, PurgeOptions{Containers: []string{"metrics", "missing"}, ContainerPattern: "logs-d?", NumDaysToKeep: 5})
+	assert.NoError(t, err)
+	result, err := purger.Purge()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), result.ContainerCount)
+	assert.Equal(t, int64(2*25), result.DeletedCount)
+	assert.Len(t, server.Blobs("metrics"), 5)
+	assert.Len(t, server.Blobs("logs-db"), 5)
+	assert.Len(t, server.Blobs("logs-app"), 60)
+
+	// listing the missing container failed
+	assert.True(t, result.HasErrors())
+	assert.Equal(t, int64(1), result.ErrorCount)
+}
+
+func TestPurgeDryRun(t *testing.T) {
+	server, credentials := newBlobServer()
+	defer server.Close()
+
+	purger, err := NewBlobPurger(credentials, PurgeOptions{Containers: []string{"metrics"}, NumDaysToKeep: 10, NumWorkers: 2, DryRun: true})
+	assert.NoError(t, err)
+	result, err := purger.Purge()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), result.ExpiredCount)
+	assert.Equal(t, int64(20*100), result.ExpiredBytes)
+	assert.Equal(t, int64(0), result.DeletedCount)
+	assert.Contains(t, result.String(), "Dry run: 20 of 30 blob(s)")
+	assert.Len(t, server.Blobs("metrics"), 30)
+}
+
+func TestNewBlobPurger(t *testing.T) {
+	credentials := auth.Credentials{AccountName: "acme", AccountKey: "YWNtZQ=="}
+	_, err := NewBlobPurger(credentials, PurgeOptions{NumDaysToKeep: 10})
+	assert.Error(t, err)
+	_, err = NewBlobPurger(credentials, PurgeOptions{ContainerPattern: "logs-[", NumDaysToKeep: 10})
+	assert.Error(t, err)
+}
+
+func TestPurgeByPathTemplate(t *testing.T) {
+	// the template applies from the directory of the prefix
+	for prefix, template := range map[string]string{
+		"":             "resourceId=/**/y={yyyy}/m={MM}/d={dd}/h={HH}",
+		"resourceId":   "resourceId=/**/y={yyyy}/m={MM}/d={dd}/h={HH}",
+		"resourceId=/": "**/y={yyyy}/m={MM}/d={dd}/h={HH}",
+	} {
+		server := fakestorage.NewBlobServer()
+		server.PageSize = 5
+		credentials := auth.Credentials{AccountName: "acme", AccountKey: "YWNtZQ==", BlobEndpoint: server.URL}
+
+		// hourly exports of two resources over 40 days, all modified now
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		cutoff := time.Now().UTC().AddDate(0, 0, -30)
+		expired := 0
+		for _, resource := range []string{"SUBSCRIPTIONS/S1/RESOURCEGROUPS/RG/PROVIDERS/MICROSOFT.WEB/SITES/APP", "SUBSCRIPTIONS/S1/PROVIDERS/MICROSOFT.SQL/SERVERS/DB"} {
+			for d := 0; d < 40; d++ {
+				for _, h := range []int{0, 12} {
+					date := today.AddDate(0, 0, -d).Add(time.Duration(h) * time.Hour)
+					server.PutBlob("insights-logs-x", storage.Blob{
+						Name:       fmt.Sprintf("resourceId=/%s/y=%d/m=%02d/d=%02d/h=%02d/m=00/PT1H.json", resource, date.Year(), date.Month(), date.Day(), h),
+						Properties: storage.BlobProperties{LastModified: storage.TimeRFC1123(time.Now()), ContentLength: 10},
+					})
+					if !date.Add(time.Hour).After(cutoff) {
+						expired++
+					}
+				}
+			}
+		}
+		server.PutBlob("insights-logs-x", storage.Blob{Name: "resourceId=/README.txt"})
+
+		purger, err := NewBlobPurger(credentials, PurgeOptions{Containers: []string{"insights-logs-x"}, Prefix: prefix, PathTemplate: template, NumDaysToKeep: 30, NumWorkers: 4})
+		assert.NoError(t, err)
+		result, err := purger.Purge()
+		assert.NoError(t, err)
+		assert.False(t, result.HasErrors())
+		assert.Equal(t, int64(expired), result.DeletedCount, "prefix %q", prefix)
+		// only the blobs of expired hours are listed
+		assert.Equal(t, result.DeletedCount, result.BlobCount)
+		assert.Len(t, server.Blobs("insights-logs-x"), 2*40*2-expired+1)
+		server.Close()
+	}
+}
+
+func TestParsePathTemplate(t *testing.T) {
+	template, err := ParsePathTemplate("logs/*/{yyyy}-{MM}-{dd}/")
+	assert.NoError(t, err)
+	date, ok := template.segments[2].match("2020-02-29", nil)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC), date.start())
+	assert.Equal(t, time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC), date.end())
+	_, ok = template.segments[2].match("2021-02-29", nil)
+	assert.False(t, ok)
+	_, ok = template.segments[2].match("2020-02-29.bak", nil)
+	assert.False(t, ok)
+
+	template, err = ParsePathTemplate("y={yyyy}/m={MM}")
+	assert.NoError(t, err)
+	date, _ = template.segments[0].match("y=2020", nil)
+	date, ok = template.segments[1].match("m=12", date)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), date.end())
+
+	for _, invalid := range []string{"logs/*", "{MM}/{yyyy}", "{yyyy}/{dd}", "{yyyy}//{MM}", "**/**/{yyyy}", "{yyyy}/**", "{yyyy}/**/*", "**/*/{yyyy}", "{yyyy}/{mm}"} {
+		_, err := ParsePathTemplate(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPurgeInBatches(t *testing.T) {
+	server := fakestorage.NewBlobServer()
+	defer server.Close()
+	credentials := auth.Credentials{AccountName: "acme", AccountKey: "YWNtZQ==", BlobEndpoint: server.URL}
+	old := storage.TimeRFC1123(time.Now().AddDate(0, 0, -60))
+	for i := 0; i < 600; i++ {
+		blob := storage.Blob{Name: fmt.Sprintf("logs/%04d.json", i), Properties: storage.BlobProperties{LastModified: old, ContentLength: 10}}
+		if i%200 == 0 {
+			blob.Properties.LeaseState = "leased"
+		}
+		server.PutBlob("logs", blob)
+	}
+
+	purger, err := NewBlobPurger(credentials, PurgeOptions{Containers: []string{"logs"}, NumDaysToKeep: 30, NumWorkers: 2, BatchSize: MaxBatchSize})
+	assert.NoError(t, err)
+	result, err := purger.Purge()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), result.BatchCount)
+	assert.Equal(t, int64(600-3), result.DeletedCount)
+	assert.Equal(t, int64((600-3)*10), result.DeletedBytes)
+	// the leased blobs failed
+	assert.Equal(t, int64(3), result.ErrorCount)
+	assert.Len(t, server.Blobs("logs"), 3)
+
+	// services without batches get single deletes
+	server.DisableBatch = true
+	for i := 0; i < 10; i++ {
+		server.PutBlob("logs", storage.Blob{Name: fmt.Sprintf("app/%04d.json", i), Properties: storage.BlobProperties{LastModified: old}})
+	}
+	purger, err = NewBlobPurger(credentials, PurgeOptions{Containers: []string{"logs"}, Prefix: "app/", NumDaysToKeep: 30, BatchSize: 4})
+	assert.NoError(t, err)
+	result, err = purger.Purge()
+	assert.NoError(t, err)
+	assert.False(t, result.HasErrors())
+	assert.Equal(t, int64(0), result.BatchCount)
+	assert.Equal(t, int64(10), result.DeletedCount)
+	assert.Len(t, server.Blobs("logs"), 3)
+
+	_, err = NewBlobPurger(credentials, PurgeOptions{Containers: []string{"logs"}, BatchSize: MaxBatchSize + 1})
+	assert.Error(t, err)
+}
+
+func TestPurgeSnapshotsAndVersions(t *testing.T) {
+	server := fakestorage.NewBlobServer()
+	defer server.Close()
+	server.PageSize = 2
+	credentials := auth.Credentials{AccountName: "acme", AccountKey: "YWNtZQ==", BlobEndpoint: server.URL}
+	now := time.Now().UTC()
+	for _, name := range []string{"a.bak", "b.bak", "c.bak"} {
+		server.PutBlob("backups", storage.Blob{Name: name, Properties: storage.BlobProperties{ContentLength: 100}})
+		for _, days := range []int{1, 10, 40, 50, 60} {
+			server.PutSnapshot("backups", name, now.AddDate(0, 0, -days), storage.BlobProperties{ContentLength: 10})
+			server.PutVersion("backups", name, now.AddDate(0, 0, -days).Format(snapshotFormat), storage.BlobProperties{ContentLength: 10})
+		}
+	}
+	// the versions of a deleted blob
+	for _, days := range []int{40, 50, 60} {
+		server.PutVersion("backups", "d.bak", now.AddDate(0, 0, -days).Format(snapshotFormat), storage.BlobProperties{ContentLength: 10})
+	}
+
+	purger, err := NewBlobPurger(credentials, PurgeOptions{Containers: []string{"backups"}, SnapshotsOlderThanDays: 30, VersionsOlderThanDays: 30, KeepAtLeast: 1, NumWorkers: 2, BatchSize: MaxBatchSize})
+	assert.NoError(t, err)
+	result, err := purger.Purge()
+	assert.NoError(t, err)
+	assert.False(t, result.HasErrors())
+	assert.Equal(t, int64(3*11+3), result.BlobCount)
+	assert.Equal(t, int64(3*6+2), result.DeletedCount)
+	assert.Equal(t, int64((3*6+2)*10), result.DeletedBytes)
+	assert.Equal(t, int64(1), result.BatchCount)
+
+	// blobs, and the copies within the retention period or kept at least, are left
+	assert.Len(t, server.Blobs("backups"), 3)
+	for _, name := range []string{"a.bak", "b.bak", "c.bak"} {
+		assert.Len(t, server.Snapshots("backups", name), 2)
+		assert.Len(t, server.Versions("backups", name), 2)
+	}
+	assert.Equal(t, []string{now.AddDate(0, 0, -40).Format(snapshotFormat)}, server.Versions("backups", "d.bak"))
+
+	// keep at least wins over the age, snapshots are left alone when only versions are purged
+	for _, days := range []int{70, 80, 90} {
+		server.PutSnapshot("backups", "a.bak", now.AddDate(0, 0, -days), storage.BlobProperties{ContentLength: 10})
+		server.PutVersion("backups", "a.bak", now.AddDate(0, 0, -days).Format(snapshotFormat), storage.BlobProperties{ContentLength: 10})
+	}
+	purger, err = NewBlobPurger(credentials, PurgeOptions{Containers: []string{"backups"}, Prefix: "a", VersionsOlderThanDays: 30, KeepAtLeast: 4})
+	assert.NoError(t, err)
+	result, err = purger.Purge()
+	assert.NoError(t, err)
+	assert.False(t, result.HasErrors())
+	assert.Equal(t, int64(1), result.DeletedCount)
+	assert.Len(t, server.Snapshots("backups", "a.bak"), 5)
+	assert.Len(t, server.Versions("backups", "a.bak"), 4)
+
+	// snapshots deleted one by one
+	purger, err = NewBlobPurger(credentials, PurgeOptions{Containers: []string{"backups"}, Prefix: "a", SnapshotsOlderThanDays: 30, KeepAtLeast: 1, BatchSize: 1})
+	assert.NoError(t, err)
+	result, err = purger.Purge()
+	assert.NoError(t, err)
+	assert.False(t, result.HasErrors())
+	assert.Equal(t, int64(3), result.DeletedCount)
+	assert.Len(t, server.Snapshots("backups", "a.bak"), 2)
+	assert.Len(t, server.Blobs("backups"), 3)
+
+	_, err = NewBlobPurger(credentials, PurgeOptions{Containers: []string{"backups"}, SnapshotsOlderThanDays: 30, KeepAtLeast: -1})
+	assert.Error(t, err)
+	_, err = NewBlobPurger(credentials, PurgeOptions{Containers: []string{"backups"}, SnapshotsOlderThanDays: 30, PathTemplate: "{yyyy}"})
+	assert.Error(t, err)
+}
+
+func TestPurgeByMetadataAndTags(t *testing.T) {
+	server := fakestorage.NewBlobServer()
+	defer server.Close()
+	server.PageSize = 3
+	credentials := auth.Credentials{AccountName: "acme", AccountKey: "YWNtZQ==", BlobEndpoint: server.URL}
+	old := storage.TimeRFC1123(time.Now().AddDate(0, 0, -60))
+	for i := 0; i < 10; i++ {
+		retention := "long"
+		if i%2 == 0 {
+			retention = "short"
+		}
+		name := fmt.Sprintf("%02d.json", i)
+		server.PutBlob("logs", storage.Blob{Name: name, Properties: storage.BlobProperties{LastModified: old, ContentLength: 10}, Metadata: storage.BlobMetadata{"Retention": retention}})
+		server.SetTags("logs", name, map[string]string{"tenant": fmt.Sprintf("t%d", i%3)})
+	}
+	// the same tags in another container
+	server.PutBlob("other", storage.Blob{Name: "00.json", Properties: storage.BlobProperties{LastModified: old}})
+	server.SetTags("other", "00.json", map[string]string{"tenant": "t0"})
+
+	purger, err := NewBlobPurger(credentials, PurgeOptions{Containers: []string{"logs"}, Metadata: map[string]string{"retention": "short"}, NumDaysToKeep: 30, DryRun: true})
+	assert.NoError(t, err)
+	result, err := purger.Purge()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), result.BlobCount)
+	assert.Equal(t, int64(5), result.ExpiredCount)
+
+	// 00, 03, 06 and 09 are tagged t0, of which 00 and 06 are short-lived
+	purger, err = NewBlobPurger(credentials, PurgeOptions{Containers: []string{"logs", "other"}, Metadata: map[string]string{"Retention": "short"}, TagQuery: `"tenant" = 't0'`, NumDaysToKeep: 30, BatchSize: MaxBatchSize})
+	assert.NoError(t, err)
+	result, err = purger.Purge()
+	assert.NoError(t, err)
+	assert.False(t, result.HasErrors())
+	assert.Equal(t, int64(2), result.DeletedCount)
+	assert.Len(t, server.Blobs("logs"), 8)
+	assert.Len(t, server.Blobs("other"), 1)
+
+	tierer, err := NewBlobTierer(credentials, TierOptions{Containers: []string{"logs"}, TagQuery: `"tenant" >= 't1'`, Metadata: map[string]string{"retention": "long"}, OlderThanDays: 30, Tier: "Archive"})
+	assert.NoError(t, err)
+	tierResult, err := tierer.Tier()
+	assert.NoError(t, err)
+	assert.False(t, tierResult.HasErrors())
+	// 01, 05 and 07
+	assert.Equal(t, int64(3), tierResult.TieredCount)
+	assert.Equal(t, "Archive", server.Tier("logs", "05.json"))
+	assert.Equal(t, "Hot", server.Tier("logs", "03.json"))
+
+	// invalid tag queries fail the listing of each container
+	purger, err = NewBlobPurger(credentials, PurgeOptions{Containers: []string{"logs"}, TagQuery: "tenant", NumDaysToKeep: 30})
+	assert.NoError(t, err)
+	result, err = purger.Purge()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), result.ErrorCount)
+	assert.Len(t, server.Blobs("logs"), 8)
+}
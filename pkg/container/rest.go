@@ -0,0 +1,225 @@
+package container
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+)
+
+const (
+	// restAPIVersion a service version supporting blob batches and versions, the default version of the storage client doesn't
+	restAPIVersion = "2019-12-12"
+	// snapshotFormat the format of snapshot times in query parameters
+	snapshotFormat = "2006-01-02T15:04:05.0000000Z"
+)
+
+// listedBlob a blob, one of its snapshots or one of its versions as listed by service versions supporting blob versioning
+type listedBlob struct {
+	storage.Blob
+	VersionID        string `xml:"VersionId"`
+	IsCurrentVersion bool   `xml:"IsCurrentVersion"`
+	// AccessTier the access tier of block blobs, which the properties of the storage client lack
+	AccessTier string `xml:"-"`
+}
+
+// isBase whether the listed blob is the blob itself rather than a snapshot or a previous version
+func (b listedBlob) isBase() bool {
+	return b.Snapshot.IsZero() && (b.VersionID == "" || b.IsCurrentVersion)
+}
+
+// query the query parameters addressing the snapshot or the version
+func (b listedBlob) query() url.Values {
+	query := make(url.Values)
+	switch {
+	case !b.Snapshot.IsZero():
+		query.Set("snapshot", b.Snapshot.UTC().Format(snapshotFormat))
+	case b.VersionID != "" && !b.IsCurrentVersion:
+		query.Set("versionid", b.VersionID)
+	}
+	return query
+}
+
+// blobListResponse a page of blobs listed along with their snapshots and versions
+type blobListResponse struct {
+	XMLName    xml.Name     `xml:"EnumerationResults"`
+	Prefix     string       `xml:"Prefix"`
+	Marker     string       `xml:"Marker"`
+	NextMarker string       `xml:"NextMarker"`
+	Blobs      []listedBlob `xml:"Blobs>Blob"`
+}
+
+// restClient sends the requests the storage client doesn't support: blob batches, listing versions and deleting them.
+// Requests are authorized by the Authorizer and go through the Sender of the client like the requests of the client.
+type restClient struct {
+	client    *storage.Client
+	endpoint  string
+	authorize auth.Authorizer
+}
+
+func newRESTClient(client *storage.Client, authorize auth.Authorizer) *restClient {
+	blobService := client.GetBlobService()
+	// the URL of the root container is the one of the service
+	endpoint := strings.TrimSuffix(blobService.GetContainerReference("").GetURL(), "$root")
+	return &restClient{client: client, endpoint: endpoint, authorize: authorize}
+}
+
+// send authorizes and sends req, which must carry its x-ms-date header
+func (c *restClient) send(req *http.Request) (*http.Response, error) {
+	if _, ok := req.Header["x-ms-date"]; !ok {
+		req.Header["x-ms-date"] = []string{time.Now().UTC().Format(http.TimeFormat)}
+	}
+	req.Header["x-ms-version"] = []string{restAPIVersion}
+	if err := c.authorize(req); err != nil {
+		return nil, err
+	}
+	return c.client.Sender.Send(c.client, req)
+}
+
+// listBlobs lists a page of the blobs of container starting with prefix, along with the datasets of include,
+// i.e. snapshots,versions
+func (c *restClient) listBlobs(container *storage.Container, prefix, marker, include string) (blobListResponse, error) {
+	var response blobListResponse
+	query := url.Values{
+		"restype": {"container"},
+		"comp":    {"list"},
+	}
+	if include != "" {
+		query.Set("include", include)
+	}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if marker != "" {
+		query.Set("marker", marker)
+	}
+	req, err := http.NewRequest(http.MethodGet, container.GetURL()+"?"+query.Encode(), nil)
+	if err != nil {
+		return response, err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return response, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return response, serviceError(resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return response, err
+	}
+	if err := xml.Unmarshal(body, &response); err != nil {
+		return response, err
+	}
+	// the access tiers are read on their own as they belong to the properties of the storage client
+	var tiers struct {
+		Blobs []struct {
+			AccessTier string `xml:"Properties>AccessTier"`
+		} `xml:"Blobs>Blob"`
+	}
+	if err := xml.Unmarshal(body, &tiers); err != nil {
+		return response, err
+	}
+	for i := range response.Blobs {
+		response.Blobs[i].Container = container
+		response.Blobs[i].AccessTier = tiers.Blobs[i].AccessTier
+	}
+	return response, nil
+}
+
+// deleteBlob deletes a snapshot or a version. Returns false when it doesn't exist.
+func (c *restClient) deleteBlob(blob listedBlob) (bool, error) {
+	u, err := url.Parse(blob.GetURL())
+	if err != nil {
+		return false, err
+	}
+	u.RawQuery = blob.query().Encode()
+	req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusAccepted {
+		return true, nil
+	}
+	if err := serviceError(resp); err.Code != "BlobNotFound" {
+		return false, err
+	}
+	return false, nil
+}
+
+// taggedBlobsResponse a page of the blobs found by their index tags
+type taggedBlobsResponse struct {
+	XMLName xml.Name `xml:"EnumerationResults"`
+	Blobs   []struct {
+		Name          string `xml:"Name"`
+		ContainerName string `xml:"ContainerName"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// findBlobsByTags lists a page of the blobs of the account whose index tags match the where expression
+func (c *restClient) findBlobsByTags(where, marker string) (taggedBlobsResponse, error) {
+	var response taggedBlobsResponse
+	query := url.Values{"comp": {"blobs"}, "where": {where}}
+	if marker != "" {
+		query.Set("marker", marker)
+	}
+	req, err := http.NewRequest(http.MethodGet, c.endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return response, err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return response, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return response, serviceError(resp)
+	}
+	return response, xml.NewDecoder(resp.Body).Decode(&response)
+}
+
+// setTier sets the access tier of a block blob
+func (c *restClient) setTier(blob listedBlob, tier string) error {
+	req, err := http.NewRequest(http.MethodPut, blob.GetURL()+"?comp=tier", nil)
+	if err != nil {
+		return err
+	}
+	req.Header["x-ms-access-tier"] = []string{tier}
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// archived blobs being rehydrated are accepted rather than moved right away
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return serviceError(resp)
+	}
+	return nil
+}
+
+// serviceError the storage error of an error response
+func serviceError(resp *http.Response) storage.AzureStorageServiceError {
+	serviceErr := storage.AzureStorageServiceError{
+		StatusCode: resp.StatusCode,
+		Code:       resp.Header.Get("x-ms-error-code"),
+		RequestID:  resp.Header.Get("x-ms-request-id"),
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	xml.Unmarshal(body, &serviceErr)
+	if serviceErr.Message == "" {
+		serviceErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return serviceErr
+}
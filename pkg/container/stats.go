@@ -3,95 +3,163 @@ package container
 import (
 	"fmt"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	"github.com/fabito/azure-storage-purger/pkg/metrics"
+	"github.com/fabito/azure-storage-purger/pkg/util"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/Azure/azure-sdk-for-go/storage"
 	"github.com/dustin/go-humanize"
 )
 
+// ageBuckets the upper bounds, in days, of the age histogram of blobs. Older blobs fall in a last bucket.
+var ageBuckets = []int{7, 30, 90, 365}
+
+// StatsOptions the breakdown of container usage by prefix
+type StatsOptions struct {
+	// Depth the number of leading path segments blobs are aggregated by, no breakdown when 0
+	Depth int
+	// Top the number of largest prefixes reported per container, 10 when 0
+	Top int
+}
+
 // StatsGatherer simple implementation
 type StatsGatherer struct {
-	blobService *storage.BlobStorageClient
+	lister
+	options StatsOptions
 }
 
 // NewStatsGatherer creates a new StatsGatherer
-func NewStatsGatherer(accountName, accountKey string) (*StatsGatherer, error) {
-	client, err := storage.NewBasicClient(accountName, accountKey)
+func NewStatsGatherer(credentials auth.Credentials, options StatsOptions) (*StatsGatherer, error) {
+	if options.Depth < 0 || options.Top < 0 {
+		return nil, fmt.Errorf("invalid depth %d or top %d", options.Depth, options.Top)
+	}
+	if options.Top == 0 {
+		options.Top = 10
+	}
+	client, err := credentials.NewClient()
 	if err != nil {
 		return nil, err
 	}
-	blobService := client.GetBlobService()
-	return &StatsGatherer{blobService: &blobService}, nil
-}
-
-func (c *StatsGatherer) listContainers() ([]storage.Container, error) {
-	log.Debug("Listing containers")
-	containers := make([]storage.Container, 0)
-	listParams := storage.ListContainersParameters{}
-	containerListresponse, err := c.blobService.ListContainers(listParams)
+	// blobs are listed by the REST client, which reads their access tier
+	authorize, err := credentials.NewAuthorizer()
 	if err != nil {
 		return nil, err
 	}
-	containers = append(containers, containerListresponse.Containers...)
-	for containerListresponse != nil && containerListresponse.NextMarker != "" {
-		listParams = storage.ListContainersParameters{Marker: containerListresponse.NextMarker}
-		containerListresponse, err = c.blobService.ListContainers(listParams)
-		containers = append(containers, containerListresponse.Containers...)
-	}
-	log.Debugf("Found %d container(s)", len(containers))
-	return containers, nil
+	blobService := client.GetBlobService()
+	return &StatsGatherer{lister: lister{
+		blobService: &blobService,
+		rest:        newRESTClient(&client, authorize),
+		Metrics:     metrics.NewContainerMetrics(metrics.NewRunID()),
+	}, options: options}, nil
 }
 
-type callback func(blob storage.Blob)
-
-func (c *StatsGatherer) forEachBlobInContainer(container *storage.Container, cb callback) error {
-	listParams := storage.ListBlobsParameters{}
-	response, err := container.ListBlobs(listParams)
-	if err != nil {
-		log.Errorf("Error listing blobs for %s. %s", container.Name, err)
-		return err
+func (c *StatsGatherer) computeStats(container *storage.Container, now time.Time) (Stats, error) {
+	logger := log.WithField(util.LogFieldContainer, container.Name)
+	logger.Info("Computing stats")
+	ct := newStats(container.Name)
+	prefixes := make(map[string]*Usage)
+	sizer := func(blob listedBlob) {
+		ct.add(blob, now)
+		if c.options.Depth > 0 {
+			prefix := pathPrefix(blob.Name, c.options.Depth)
+			usage, ok := prefixes[prefix]
+			if !ok {
+				usage = &Usage{}
+				prefixes[prefix] = usage
+			}
+			usage.Count++
+			usage.Size += uint64(blob.Properties.ContentLength)
+		}
+		c.Metrics.RegisterBlobProcessed(blob.Properties.ContentLength)
+		if ct.BlobCount%10000 == 0 {
+			logger.Debugf("Visited %s blobs = %s", humanize.Comma(ct.BlobCount), humanize.Bytes(ct.Size))
+		}
+	}
+	err := c.forEachListedBlob(container, "", "", sizer)
+	c.Metrics.RegisterContainerProcessed()
+	if c.options.Depth > 0 {
+		ct.Prefixes = topPrefixes(prefixes, c.options.Top)
 	}
-	for _, blob := range response.Blobs {
-		cb(blob)
+	if err != nil {
+		return ct, err
 	}
+	logger.Info(ct)
+	return ct, nil
+}
 
-	for response.NextMarker != "" {
-		listParams = storage.ListBlobsParameters{Marker: response.NextMarker}
-		response, err = container.ListBlobs(listParams)
-		if err != nil {
-			log.Errorf("Error retrieving marker %s for %s. %s", response.NextMarker, container.Name, err)
-			return err
-		}
-		for _, blob := range response.Blobs {
-			cb(blob)
+// pathPrefix the first depth virtual directories of name, ending with /. Blobs of shallower directories get their own.
+func pathPrefix(name string, depth int) string {
+	end := 0
+	for i := 0; i < depth; i++ {
+		next := strings.Index(name[end:], "/")
+		if next < 0 {
+			break
 		}
+		end += next + 1
 	}
-	return nil
+	return name[:end]
 }
 
-func (c *StatsGatherer) computeStats(container *storage.Container) (Stats, error) {
-	log.Infof("Computing stats for %s", container.Name)
-	ct := Stats{Name: container.Name}
-	totalSize := int64(0)
-	blobCount := int64(0)
-	sizer := func(blob storage.Blob) {
-		totalSize += blob.Properties.ContentLength
-		blobCount++
-		if blobCount%10000 == 0 {
-			log.Debugf("Visited %s blobs in %s = %s", humanize.Comma(blobCount), container.Name, humanize.Bytes(uint64(totalSize)))
+// topPrefixes the top largest prefixes, ordered by size then by name
+func topPrefixes(prefixes map[string]*Usage, top int) []PrefixUsage {
+	sorted := make([]PrefixUsage, 0, len(prefixes))
+	for prefix, usage := range prefixes {
+		sorted = append(sorted, PrefixUsage{Prefix: prefix, Usage: *usage})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Size != sorted[j].Size {
+			return sorted[i].Size > sorted[j].Size
 		}
+		return sorted[i].Prefix < sorted[j].Prefix
+	})
+	if len(sorted) > top {
+		sorted = sorted[:top]
+	}
+	return sorted
+}
 
+// Usage the number and total size of blobs
+type Usage struct {
+	Count int64
+	Size  uint64
+}
+
+func (u Usage) String() string {
+	return fmt.Sprintf("%s (%s)", humanize.Comma(u.Count), humanize.Bytes(u.Size))
+}
+
+// PrefixUsage the blobs under a prefix
+type PrefixUsage struct {
+	// Prefix the leading virtual directories of the blobs, empty for the blobs at the root of the container
+	Prefix string
+	Usage
+}
+
+func (p PrefixUsage) String() string {
+	if p.Prefix == "" {
+		return fmt.Sprintf("/: %s", p.Usage)
 	}
-	err := c.forEachBlobInContainer(container, sizer)
-	ct.BlobCount = blobCount
-	ct.Size = uint64(totalSize)
-	if err != nil {
-		return ct, err
+	return fmt.Sprintf("%s: %s", p.Prefix, p.Usage)
+}
+
+// AgeBucket the blobs last modified within an age range
+type AgeBucket struct {
+	// MaxDays the exclusive upper bound of the age of the blobs in days, 0 for the blobs older than the last bound
+	MaxDays int
+	Usage
+}
+
+func (a AgeBucket) String() string {
+	if a.MaxDays == 0 {
+		return fmt.Sprintf(">= %dd: %s", ageBuckets[len(ageBuckets)-1], a.Usage)
 	}
-	log.Info(ct)
-	return ct, nil
+	return fmt.Sprintf("< %dd: %s", a.MaxDays, a.Usage)
 }
 
 // Stats holds the computed stats
@@ -99,54 +167,149 @@ type Stats struct {
 	Name      string
 	Size      uint64
 	BlobCount int64
-	Oldest    time.Time
-	Newest    time.Time
+	// Oldest and Newest the earliest and latest Last-Modified of the blobs, zero when there are no blobs
+	Oldest time.Time
+	Newest time.Time
+	// Ages the age histogram of the blobs, by their Last-Modified
+	Ages []AgeBucket
+	// Tiers the blobs per access tier. Blobs without tier, such as page and append blobs, are under None.
+	Tiers map[string]Usage
+	// BlobTypes the blobs per blob type: BlockBlob, AppendBlob or PageBlob
+	BlobTypes map[string]Usage
+	// Prefixes the largest prefixes of StatsOptions.Depth segments, when requested
+	Prefixes []PrefixUsage
+	// Err the error listing the blobs of the container, whose stats are then partial
+	Err error
+}
+
+func newStats(name string) Stats {
+	ct := Stats{Name: name, Tiers: make(map[string]Usage), BlobTypes: make(map[string]Usage)}
+	for _, days := range ageBuckets {
+		ct.Ages = append(ct.Ages, AgeBucket{MaxDays: days})
+	}
+	ct.Ages = append(ct.Ages, AgeBucket{})
+	return ct
+}
+
+// add counts blob, whose age is relative to now
+func (c *Stats) add(blob listedBlob, now time.Time) {
+	size := blob.Properties.ContentLength
+	c.BlobCount++
+	c.Size += uint64(size)
+	lastModified := time.Time(blob.Properties.LastModified)
+	if c.Oldest.IsZero() || lastModified.Before(c.Oldest) {
+		c.Oldest = lastModified
+	}
+	if lastModified.After(c.Newest) {
+		c.Newest = lastModified
+	}
+	bucket := len(ageBuckets)
+	for i, days := range ageBuckets {
+		if lastModified.After(now.AddDate(0, 0, -days)) {
+			bucket = i
+			break
+		}
+	}
+	c.Ages[bucket].Count++
+	c.Ages[bucket].Size += uint64(size)
+	tier := blob.AccessTier
+	if tier == "" {
+		tier = "None"
+	}
+	c.Tiers[tier] = Usage{Count: c.Tiers[tier].Count + 1, Size: c.Tiers[tier].Size + uint64(size)}
+	blobType := string(blob.Properties.BlobType)
+	c.BlobTypes[blobType] = Usage{Count: c.BlobTypes[blobType].Count + 1, Size: c.BlobTypes[blobType].Size + uint64(size)}
 }
 
 func (c Stats) String() string {
-	return fmt.Sprintf("%s contains %s blob(s) using a total of %s", c.Name, humanize.Comma(c.BlobCount), humanize.Bytes(c.Size))
+	if c.Err != nil {
+		return fmt.Sprintf("%s partially listed, %s blob(s) using %s. %s", c.Name, humanize.Comma(c.BlobCount), humanize.Bytes(c.Size), c.Err)
+	}
+	if c.BlobCount == 0 {
+		return fmt.Sprintf("%s contains no blobs", c.Name)
+	}
+	ages := make([]string, 0, len(c.Ages))
+	for _, bucket := range c.Ages {
+		ages = append(ages, bucket.String())
+	}
+	stats := fmt.Sprintf("%s contains %s blob(s) using a total of %s, last modified from %s to %s. Ages: %s. Tiers: %s. Blob types: %s",
+		c.Name, humanize.Comma(c.BlobCount), humanize.Bytes(c.Size), c.Oldest.Format(time.RFC3339), c.Newest.Format(time.RFC3339),
+		strings.Join(ages, ", "), formatUsages(c.Tiers), formatUsages(c.BlobTypes))
+	if len(c.Prefixes) == 0 {
+		return stats
+	}
+	prefixes := make([]string, 0, len(c.Prefixes))
+	for _, prefix := range c.Prefixes {
+		prefixes = append(prefixes, prefix.String())
+	}
+	return stats + ". Largest prefixes: " + strings.Join(prefixes, ", ")
 }
 
-// GatherStatistics Compute stats for all containers
+// formatUsages the usages sorted by name
+func formatUsages(usages map[string]Usage) string {
+	names := make([]string, 0, len(usages))
+	for name := range usages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	formatted := make([]string, 0, len(names))
+	for _, name := range names {
+		formatted = append(formatted, fmt.Sprintf("%s: %s", name, usages[name]))
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// GatherStatistics Compute stats for all containers, sorted by name. Containers whose listing failed keep
+// their partial stats, along with their error, and an error naming them is returned.
 func (c *StatsGatherer) GatherStatistics() ([]Stats, error) {
 	numWorkers := runtime.NumCPU() * 2
-	done := make(chan interface{})
-	defer close(done)
+	defer c.Metrics.Finish()
 
-	containerSlice, _ := c.listContainers()
-	numJobs := len(containerSlice)
-	jobs := make(chan storage.Container, numJobs)
-	results := make(chan Stats, numJobs)
+	containerSlice, err := c.listContainers("")
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	jobs := make(chan storage.Container, len(containerSlice))
+	results := make(chan Stats, len(containerSlice))
 
+	var wg sync.WaitGroup
 	for w := 1; w <= numWorkers; w++ {
-		go func(id int, done chan interface{}, jobs chan storage.Container, results chan Stats) {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
 			for j := range jobs {
-				log.Debugf("Worker %d started job %s", id, j.Name)
+				j := j
+				log.WithField(util.LogFieldContainer, j.Name).Debugf("Worker %d started job", id)
 				start := time.Now().UTC()
-				ct, _ := c.computeStats(&j)
-				log.Debugf("Worker %d finished job %s in %s", id, j.Name, time.Since(start))
-				select {
-				case <-done:
-					return
-				case results <- ct:
-				}
+				ct, err := c.computeStats(&j, now)
+				log.WithField(util.LogFieldContainer, j.Name).Debugf("Worker %d finished job in %s", id, time.Since(start))
+				ct.Err = err
+				results <- ct
 			}
-		}(w, done, jobs, results)
+		}(w)
 	}
 
 	for _, container := range containerSlice {
-		select {
-		case <-done:
-			break
-		case jobs <- container:
-		}
+		jobs <- container
 	}
 	close(jobs)
+	wg.Wait()
+	close(results)
 
-	containers := make([]Stats, numJobs)
+	containers := make([]Stats, 0, len(containerSlice))
 	for result := range results {
 		containers = append(containers, result)
 	}
-
+	sort.Slice(containers, func(i, j int) bool { return containers[i].Name < containers[j].Name })
+	var failed []string
+	for _, ct := range containers {
+		if ct.Err != nil {
+			failed = append(failed, ct.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return containers, fmt.Errorf("error listing the blobs of %d container(s): %s", len(failed), strings.Join(failed, ", "))
+	}
 	return containers, nil
 }
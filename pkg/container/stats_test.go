@@ -0,0 +1,134 @@
+package container
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	"github.com/fabito/azure-storage-purger/pkg/fakestorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGatherStatistics(t *testing.T) {
+	server, credentials := newBlobServer()
+	defer server.Close()
+	server.CreateContainer("empty")
+	server.SetTier("metrics", "000.json", "Cool")
+	server.SetTier("metrics", "001.json", "Archive")
+	old := time.Now().UTC().AddDate(-2, 0, 0)
+	server.PutBlob("metrics", storage.Blob{Name: "disk.vhd", Properties: storage.BlobProperties{
+		BlobType: storage.BlobTypePage, ContentLength: 1000, LastModified: storage.TimeRFC1123(old),
+	}})
+
+	gatherer, err := NewStatsGatherer(credentials, StatsOptions{})
+	assert.NoError(t, err)
+	stats, err := gatherer.GatherStatistics()
+	assert.NoError(t, err)
+	assert.Len(t, stats, 4)
+	names := make([]string, 0, len(stats))
+	for _, s := range stats {
+		names = append(names, s.Name)
+	}
+	assert.Equal(t, []string{"empty", "logs-app", "logs-db", "metrics"}, names)
+	assert.Equal(t, int64(0), stats[0].BlobCount)
+	assert.True(t, stats[0].Oldest.IsZero())
+	assert.Equal(t, int64(60), stats[1].BlobCount)
+	assert.Equal(t, uint64(6000), stats[1].Size)
+
+	metrics := stats[3]
+	assert.Equal(t, int64(31), metrics.BlobCount)
+	assert.Equal(t, uint64(30*100+1000), metrics.Size)
+	assert.Equal(t, old.Unix(), metrics.Oldest.Unix())
+	// Last-Modified has a precision of one second
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), metrics.Newest, 2*time.Second)
+	// blobs modified 0 to 29 days and 1 hour ago, and 2 years ago
+	counts := make([]int64, 0, len(metrics.Ages))
+	for _, bucket := range metrics.Ages {
+		counts = append(counts, bucket.Count)
+	}
+	assert.Equal(t, []int64{7, 23, 0, 0, 1}, counts)
+	assert.Equal(t, uint64(1000), metrics.Ages[4].Size)
+	assert.Equal(t, map[string]Usage{
+		"Hot":     {Count: 28, Size: 2800},
+		"Cool":    {Count: 1, Size: 100},
+		"Archive": {Count: 1, Size: 100},
+		"None":    {Count: 1, Size: 1000},
+	}, metrics.Tiers)
+	assert.Equal(t, map[string]Usage{
+		"BlockBlob": {Count: 30, Size: 3000},
+		"PageBlob":  {Count: 1, Size: 1000},
+	}, metrics.BlobTypes)
+	assert.Contains(t, metrics.String(), "Archive: 1 (100 B)")
+	assert.Empty(t, metrics.Prefixes)
+}
+
+// roundTripperFunc an http.RoundTripper calling the function
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestGatherStatisticsListingError(t *testing.T) {
+	server, credentials := newBlobServer()
+	defer server.Close()
+	// listing the blobs of logs-db is forbidden
+	credentials.Transport = func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if strings.Contains(r.URL.Path, "logs-db") {
+				return &http.Response{StatusCode: http.StatusForbidden, Header: make(http.Header), Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+			}
+			return next.RoundTrip(r)
+		})
+	}
+
+	gatherer, err := NewStatsGatherer(credentials, StatsOptions{})
+	assert.NoError(t, err)
+	stats, err := gatherer.GatherStatistics()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "logs-db")
+	}
+	assert.Len(t, stats, 3)
+	assert.NoError(t, stats[0].Err)
+	assert.Equal(t, "logs-db", stats[1].Name)
+	assert.Error(t, stats[1].Err)
+	assert.Contains(t, stats[1].String(), "partially listed")
+}
+
+func TestGatherStatisticsByPrefix(t *testing.T) {
+	server := fakestorage.NewBlobServer()
+	defer server.Close()
+	credentials := auth.Credentials{AccountName: "acme", AccountKey: "YWNtZQ==", BlobEndpoint: server.URL}
+	for name, size := range map[string]int64{
+		"app/2020/01.json": 10,
+		"app/2020/02.json": 10,
+		"app/2021/01.json": 50,
+		"app/readme.txt":   1,
+		"web/2020/01.json": 5,
+		"root.json":        7,
+	} {
+		server.PutBlob("logs", storage.Blob{Name: name, Properties: storage.BlobProperties{ContentLength: size}})
+	}
+
+	gatherer, err := NewStatsGatherer(credentials, StatsOptions{Depth: 2, Top: 3})
+	assert.NoError(t, err)
+	stats, err := gatherer.GatherStatistics()
+	assert.NoError(t, err)
+	assert.Equal(t, []PrefixUsage{
+		{Prefix: "app/2021/", Usage: Usage{Count: 1, Size: 50}},
+		{Prefix: "app/2020/", Usage: Usage{Count: 2, Size: 20}},
+		{Prefix: "", Usage: Usage{Count: 1, Size: 7}},
+	}, stats[0].Prefixes)
+	assert.Contains(t, stats[0].String(), "Largest prefixes: app/2021/: 1 (50 B), app/2020/: 2 (20 B), /: 1 (7 B)")
+
+	assert.Equal(t, "app/", pathPrefix("app/readme.txt", 2))
+	assert.Equal(t, "app/2020/", pathPrefix("app/2020/01/02.json", 2))
+	assert.Equal(t, "", pathPrefix("root.json", 1))
+
+	_, err = NewStatsGatherer(credentials, StatsOptions{Depth: -1})
+	assert.Error(t, err)
+}
@@ -0,0 +1,141 @@
+package container
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateUnits the placeholders of path templates, from the largest date unit to the smallest
+var dateUnits = []string{"{yyyy}", "{MM}", "{dd}", "{HH}"}
+
+// placeholders matches the placeholders of a path template segment
+var placeholders = regexp.MustCompile(`\{[^}]*\}`)
+
+// PathTemplate maps the segments of blob paths to dates, i.e. resourceId=/**/y={yyyy}/m={MM}/d={dd}/h={HH}.
+// A segment is either * matching any single segment, ** matching any number of segments,
+// or a literal which may embed the placeholders {yyyy}, {MM}, {dd} and {HH}.
+// Placeholders must appear in that order, starting with {yyyy}.
+type PathTemplate struct {
+	template string
+	segments []templateSegment
+}
+
+type templateSegment struct {
+	raw string
+	// pattern matches the segment, capturing the values of units
+	pattern *regexp.Regexp
+	units   []int
+}
+
+// ParsePathTemplate parses a path template, see PathTemplate
+func ParsePathTemplate(template string) (*PathTemplate, error) {
+	t := &PathTemplate{template: template}
+	next := 0
+	for _, raw := range strings.Split(strings.Trim(template, "/"), "/") {
+		segment := templateSegment{raw: raw}
+		switch {
+		case raw == "":
+			return nil, fmt.Errorf("invalid path template %q. Empty segment", template)
+		case raw == "*" || raw == "**":
+			if len(t.segments) > 0 && t.segments[len(t.segments)-1].raw == "**" {
+				// ** ends at the first directory matching the next segment, which * always does
+				return nil, fmt.Errorf("invalid path template %q. ** followed by %s never descends", template, raw)
+			}
+		default:
+			var pattern strings.Builder
+			pattern.WriteString("^")
+			last := 0
+			for _, loc := range placeholders.FindAllStringIndex(raw, -1) {
+				pattern.WriteString(regexp.QuoteMeta(raw[last:loc[0]]))
+				placeholder := raw[loc[0]:loc[1]]
+				if next == len(dateUnits) || placeholder != dateUnits[next] {
+					return nil, fmt.Errorf("invalid path template %q. Unexpected placeholder %s", template, placeholder)
+				}
+				if next == 0 {
+					pattern.WriteString(`(\d{4})`)
+				} else {
+					pattern.WriteString(`(\d{2})`)
+				}
+				segment.units = append(segment.units, next)
+				next++
+				last = loc[1]
+			}
+			pattern.WriteString(regexp.QuoteMeta(raw[last:]))
+			pattern.WriteString("$")
+			segment.pattern = regexp.MustCompile(pattern.String())
+		}
+		t.segments = append(t.segments, segment)
+	}
+	if next == 0 {
+		return nil, fmt.Errorf("invalid path template %q. {yyyy} is required", template)
+	}
+	if t.segments[len(t.segments)-1].raw == "**" {
+		return nil, fmt.Errorf("invalid path template %q. It can't end with **", template)
+	}
+	return t, nil
+}
+
+func (t *PathTemplate) String() string {
+	return t.template
+}
+
+// pathDate the date units read from the segments of a path so far: year, month, day and hour
+type pathDate []int
+
+// match matches name against segment, returning the date extended with the units of the segment
+func (s templateSegment) match(name string, date pathDate) (pathDate, bool) {
+	if s.pattern == nil {
+		return date, true
+	}
+	values := s.pattern.FindStringSubmatch(name)
+	if values == nil {
+		return nil, false
+	}
+	matched := append(pathDate{}, date...)
+	for _, value := range values[1:] {
+		n, _ := strconv.Atoi(value)
+		matched = append(matched, n)
+	}
+	if !matched.valid() {
+		return nil, false
+	}
+	return matched, true
+}
+
+func (d pathDate) valid() bool {
+	limits := [][2]int{{0, 9999}, {1, 12}, {1, 31}, {0, 23}}
+	for i, v := range d {
+		if v < limits[i][0] || v > limits[i][1] {
+			return false
+		}
+	}
+	if len(d) >= 3 {
+		return d.start().Day() == d[2]
+	}
+	return true
+}
+
+// start the beginning of the date unit, in UTC
+func (d pathDate) start() time.Time {
+	values := []int{0, 1, 1, 0}
+	copy(values, d)
+	return time.Date(values[0], time.Month(values[1]), values[2], values[3], 0, 0, 0, time.UTC)
+}
+
+// end the beginning of the next date unit
+func (d pathDate) end() time.Time {
+	start := d.start()
+	switch len(d) {
+	case 1:
+		return start.AddDate(1, 0, 0)
+	case 2:
+		return start.AddDate(0, 1, 0)
+	case 3:
+		return start.AddDate(0, 0, 1)
+	default:
+		return start.Add(time.Hour)
+	}
+}
@@ -0,0 +1,229 @@
+package container
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/dustin/go-humanize"
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	"github.com/fabito/azure-storage-purger/pkg/metrics"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// accessTiers the access tiers of block blobs, from the hottest to the coldest
+var accessTiers = []string{"Hot", "Cool", "Archive"}
+
+// ParseAccessTier the access tier named tier, case insensitively
+func ParseAccessTier(tier string) (string, error) {
+	for _, t := range accessTiers {
+		if strings.EqualFold(t, tier) {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("invalid access tier %q. Use one of %s", tier, strings.Join(accessTiers, ", "))
+}
+
+// tierRank the position of tier from the hottest, -1 when unknown
+func tierRank(tier string) int {
+	for i, t := range accessTiers {
+		if strings.EqualFold(t, tier) {
+			return i
+		}
+	}
+	return -1
+}
+
+// TierOptions selects the blobs moved to another access tier by a BlobTierer
+type TierOptions struct {
+	// Containers the names of the containers whose blobs are moved
+	Containers []string
+	// ContainerPattern selects the containers by name, using the syntax of path.Match, i.e. logs-*
+	ContainerPattern string
+	// Prefix only blobs whose name starts with Prefix are moved
+	Prefix string
+	// PathTemplate maps the paths of blobs, after the virtual directory of Prefix, to dates. See PathTemplate.
+	PathTemplate string
+	// Metadata only blobs having all these metadata keys, case insensitively, and values are moved
+	Metadata map[string]string
+	// TagQuery only blobs whose index tags match this Find Blobs by Tags expression are moved, i.e. "tenant" = 'x'
+	TagQuery string
+	// OlderThanDays blobs modified, or dated by their path, more than this number of days ago are moved
+	OlderThanDays int
+	// Tier the access tier blobs are moved to, Cool or Archive
+	Tier string
+	// NumWorkers the number of concurrent Set Blob Tier requests, 1 when 0
+	NumWorkers int
+	// DryRun lists the blobs to move without moving them
+	DryRun bool
+}
+
+// TierResult the outcome of moving blobs to another access tier
+type TierResult struct {
+	Tier           string `json:"tier"`
+	ContainerCount int64  `json:"container_count"`
+	BlobCount      int64  `json:"blob_count"`
+	ExpiredCount   int64  `json:"expired_count"`
+	// SkippedCount the expired blobs left as they were already in the tier, or in a colder one, or aren't block blobs
+	SkippedCount int64 `json:"skipped_count"`
+	TieredCount  int64 `json:"tiered_count"`
+	TieredBytes  int64 `json:"tiered_bytes"`
+	// TieredBytesByTier the bytes moved out of each access tier, or which would be with a dry run
+	TieredBytesByTier map[string]int64 `json:"tiered_bytes_by_tier"`
+	ErrorCount        int64            `json:"error_count"`
+	DryRun            bool             `json:"dry_run,omitempty"`
+	StartTime         time.Time        `json:"start_time"`
+	EndTime           time.Time        `json:"end_time"`
+}
+
+// HasErrors whether or not any list or Set Blob Tier request failed
+func (t TierResult) HasErrors() bool {
+	return t.ErrorCount > 0
+}
+
+func (t TierResult) String() string {
+	var total int64
+	tiers := make([]string, 0, len(t.TieredBytesByTier))
+	for _, tier := range accessTiers {
+		if bytes, ok := t.TieredBytesByTier[tier]; ok {
+			total += bytes
+			tiers = append(tiers, fmt.Sprintf("%s from %s", humanize.Bytes(uint64(bytes)), tier))
+		}
+	}
+	if t.DryRun {
+		return fmt.Sprintf("Dry run: %s of %s expired blob(s) listed in %d container(s) would be moved to %s, %s (%s). Skipped: %s. Errors: %d",
+			humanize.Comma(t.ExpiredCount-t.SkippedCount), humanize.Comma(t.ExpiredCount), t.ContainerCount, t.Tier,
+			humanize.Bytes(uint64(total)), strings.Join(tiers, ", "), humanize.Comma(t.SkippedCount), t.ErrorCount)
+	}
+	return fmt.Sprintf("Moved %s of %s expired blob(s) listed in %d container(s) to %s, %s (%s). Skipped: %s. Errors: %d",
+		humanize.Comma(t.TieredCount), humanize.Comma(t.ExpiredCount), t.ContainerCount, t.Tier,
+		humanize.Bytes(uint64(t.TieredBytes)), strings.Join(tiers, ", "), humanize.Comma(t.SkippedCount), t.ErrorCount)
+}
+
+// BlobTierer moves the blobs of containers older than a number of days to a colder access tier.
+// Blobs are selected like the ones a BlobPurger deletes.
+type BlobTierer struct {
+	purger       *BlobPurger
+	tier         string
+	skippedCount int64
+	mu           sync.Mutex
+	bytesByTier  map[string]int64
+}
+
+// NewBlobTierer creates a BlobTierer moving the blobs selected by options
+func NewBlobTierer(credentials auth.Credentials, options TierOptions) (*BlobTierer, error) {
+	tier, err := ParseAccessTier(options.Tier)
+	if err != nil {
+		return nil, err
+	}
+	if tier == "Hot" {
+		return nil, fmt.Errorf("invalid access tier %s. Blobs are moved to a colder tier", tier)
+	}
+	purger, err := newBlobPurger(credentials, PurgeOptions{
+		Containers:       options.Containers,
+		ContainerPattern: options.ContainerPattern,
+		Prefix:           options.Prefix,
+		PathTemplate:     options.PathTemplate,
+		Metadata:         options.Metadata,
+		TagQuery:         options.TagQuery,
+		NumDaysToKeep:    options.OlderThanDays,
+		NumWorkers:       options.NumWorkers,
+		BatchSize:        1,
+		DryRun:           options.DryRun,
+	}, metrics.NewBlobTierMetrics(metrics.NewRunID()), true)
+	if err != nil {
+		return nil, err
+	}
+	t := &BlobTierer{purger: purger, tier: tier, bytesByTier: make(map[string]int64)}
+	purger.action = "Tiering"
+	purger.listTiers = true
+	purger.accept = t.accept
+	purger.process = t.setTiers
+	return t, nil
+}
+
+// Tier moves the blobs of the selected containers older than the number of days to the tier.
+// Containers are processed one after the other, their blobs are moved concurrently while they are listed.
+func (t *BlobTierer) Tier() (TierResult, error) {
+	p := t.purger
+	defer p.Metrics.Finish()
+	if p.options.DryRun {
+		log.Warn("Dry run is ENABLED")
+	}
+	result := TierResult{Tier: t.tier, DryRun: p.options.DryRun, StartTime: time.Now().UTC()}
+	containers, err := p.selectContainers()
+	if err != nil {
+		return result, err
+	}
+	cutoff := result.StartTime.AddDate(0, 0, -p.options.NumDaysToKeep)
+	if p.template != nil {
+		log.Infof("Moving blobs whose path %s dates before %s to %s in %d container(s)", p.template, cutoff.Format(time.RFC3339), t.tier, len(containers))
+	} else {
+		log.Infof("Moving blobs last modified before %s to %s in %d container(s)", cutoff.Format(time.RFC3339), t.tier, len(containers))
+	}
+	for _, container := range containers {
+		p.purgeContainer(container, result.StartTime)
+	}
+	result.EndTime = time.Now().UTC()
+	result.ContainerCount = p.Metrics.ContainerCount()
+	result.BlobCount = p.Metrics.BlobCount()
+	result.SkippedCount = atomic.LoadInt64(&t.skippedCount)
+	result.ExpiredCount = atomic.LoadInt64(&p.expiredCount) + result.SkippedCount
+	result.TieredCount = p.Metrics.TieredBlobCount()
+	result.TieredBytes = p.Metrics.TieredBlobBytes()
+	result.ErrorCount = p.Metrics.BlobTierErrorCount() + p.Metrics.BlobPageErrorCount()
+	t.mu.Lock()
+	result.TieredBytesByTier = make(map[string]int64, len(t.bytesByTier))
+	for tier, bytes := range t.bytesByTier {
+		result.TieredBytesByTier[tier] = bytes
+	}
+	t.mu.Unlock()
+	log.Info(result)
+	return result, nil
+}
+
+// accept whether blob is a block blob in a hotter tier than the one blobs are moved to
+func (t *BlobTierer) accept(blob listedBlob) bool {
+	if blob.Properties.BlobType != storage.BlobTypeBlock || tierRank(blob.AccessTier) >= tierRank(t.tier) {
+		atomic.AddInt64(&t.skippedCount, 1)
+		return false
+	}
+	return true
+}
+
+// setTiers moves blobs to the tier one by one
+func (t *BlobTierer) setTiers(logger *log.Entry, blobs []listedBlob) {
+	p := t.purger
+	for _, blob := range blobs {
+		if p.options.DryRun {
+			blobLogger(logger, blob).WithField(util.LogFieldTier, blob.AccessTier).Debug("Expired blob")
+			t.countBytes(blob)
+			continue
+		}
+		p.Metrics.RegisterBlobTierAttempt()
+		start := time.Now()
+		if err := p.rest.setTier(blob, t.tier); err != nil {
+			util.WithError(blobLogger(logger, blob), err).Error("Error setting blob tier")
+			p.Metrics.RegisterBlobTierFailed()
+			continue
+		}
+		p.Metrics.RegisterBlobTierDurationSince(start)
+		p.Metrics.RegisterBlobTiered(blob.Properties.ContentLength)
+		t.countBytes(blob)
+	}
+}
+
+// countBytes adds the size of blob to the bytes moved out of its tier
+func (t *BlobTierer) countBytes(blob listedBlob) {
+	tier := blob.AccessTier
+	if tier == "" {
+		tier = "Hot"
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bytesByTier[tier] += blob.Properties.ContentLength
+}
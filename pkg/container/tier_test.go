@@ -0,0 +1,79 @@
+package container
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	"github.com/fabito/azure-storage-purger/pkg/fakestorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTier(t *testing.T) {
+	server, credentials := newBlobServer()
+	defer server.Close()
+	// already moved, or in a colder tier, or not a block blob
+	server.SetTier("logs-db", "020.json", "Cool")
+	server.SetTier("logs-db", "021.json", "Archive")
+	server.PutBlob("logs-db", storage.Blob{Name: "page.vhd", Properties: storage.BlobProperties{
+		BlobType: storage.BlobTypePage, ContentLength: 100, LastModified: storage.TimeRFC1123(time.Now().AddDate(0, 0, -60)),
+	}})
+
+	tierer, err := NewBlobTierer(credentials, TierOptions{ContainerPattern: "logs-d*", OlderThanDays: 10, Tier: "cool", DryRun: true})
+	assert.NoError(t, err)
+	result, err := tierer.Tier()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20+1), result.ExpiredCount)
+	assert.Equal(t, int64(3), result.SkippedCount)
+	assert.Equal(t, int64(0), result.TieredCount)
+	assert.Equal(t, map[string]int64{"Hot": 18 * 100}, result.TieredBytesByTier)
+	assert.Equal(t, "Hot", server.Tier("logs-db", "010.json"))
+
+	tierer, err = NewBlobTierer(credentials, TierOptions{ContainerPattern: "logs-d*", OlderThanDays: 10, Tier: "Cool", NumWorkers: 4})
+	assert.NoError(t, err)
+	result, err = tierer.Tier()
+	assert.NoError(t, err)
+	assert.False(t, result.HasErrors())
+	assert.Equal(t, int64(18), result.TieredCount)
+	assert.Equal(t, int64(18*100), result.TieredBytes)
+	for d := 0; d < 30; d++ {
+		name := fmt.Sprintf("%03d.json", d)
+		switch {
+		case d < 10:
+			assert.Equal(t, "Hot", server.Tier("logs-db", name), name)
+		case d == 21:
+			assert.Equal(t, "Archive", server.Tier("logs-db", name), name)
+		default:
+			assert.Equal(t, "Cool", server.Tier("logs-db", name), name)
+		}
+	}
+
+	// cool blobs move on to archive
+	tierer, err = NewBlobTierer(credentials, TierOptions{Containers: []string{"logs-db"}, OlderThanDays: 20, Tier: "archive"})
+	assert.NoError(t, err)
+	result, err = tierer.Tier()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9), result.TieredCount)
+	assert.Equal(t, map[string]int64{"Cool": 9 * 100}, result.TieredBytesByTier)
+	assert.Len(t, server.Blobs("logs-db"), 31)
+
+	_, err = NewBlobTierer(credentials, TierOptions{Containers: []string{"logs-db"}, Tier: "hot"})
+	assert.Error(t, err)
+	_, err = NewBlobTierer(credentials, TierOptions{Containers: []string{"logs-db"}, Tier: "frozen"})
+	assert.Error(t, err)
+}
+
+func TestTierErrors(t *testing.T) {
+	server := fakestorage.NewBlobServer()
+	defer server.Close()
+	credentials := auth.Credentials{AccountName: "acme", AccountKey: "YWNtZQ==", BlobEndpoint: server.URL}
+
+	tierer, err := NewBlobTierer(credentials, TierOptions{Containers: []string{"missing"}, Tier: "Archive"})
+	assert.NoError(t, err)
+	result, err := tierer.Tier()
+	assert.NoError(t, err)
+	assert.True(t, result.HasErrors())
+	assert.Equal(t, int64(1), result.ErrorCount)
+}
@@ -0,0 +1,245 @@
+// Package distributed allows multiple azp processes to share the work of a purge.
+//
+// A coordinator writes the splits of the purge period into a state table.
+// Workers claim splits using leases, process them and record their completion.
+// Splits whose lease has expired can be reclaimed by any worker.
+package distributed
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultStateTableName table holding the splits of all jobs
+	DefaultStateTableName = "azpstate"
+
+	// StatusPending split waiting to be claimed
+	StatusPending = "pending"
+	// StatusClaimed split being processed by a worker
+	StatusClaimed = "claimed"
+	// StatusCompleted split successfully processed
+	StatusCompleted = "completed"
+	// StatusFailed split which failed more than the allowed number of attempts
+	StatusFailed = "failed"
+
+	timeout = 30
+)
+
+// ErrLeaseLost returned when a split was modified by another worker
+var ErrLeaseLost = errors.New("Split was modified by another worker")
+
+// Split a portion of the purge period tracked in the state table
+type Split struct {
+	Index           int
+	Period          util.Period
+	Status          string
+	Owner           string
+	LeaseExpiry     time.Time
+	Attempts        int
+	RowCount        int64
+	BatchErrorCount int64
+	entity          *storage.Entity
+}
+
+// Claimable whether the split can be claimed by a worker
+func (s *Split) Claimable(now time.Time) bool {
+	return s.Status == StatusPending || (s.Status == StatusClaimed && s.LeaseExpiry.Before(now))
+}
+
+// Done whether the split does not require any further processing
+func (s *Split) Done() bool {
+	return s.Status == StatusCompleted || s.Status == StatusFailed
+}
+
+func (s Split) String() string {
+	return fmt.Sprintf("#%d %s [%s]", s.Index, s.Period, s.Status)
+}
+
+func (s *Split) toProperties() map[string]interface{} {
+	return map[string]interface{}{
+		"Start":           s.Period.Start.Format(time.RFC3339Nano),
+		"End":             s.Period.End.Format(time.RFC3339Nano),
+		"Status":          s.Status,
+		"Owner":           s.Owner,
+		"LeaseExpiry":     s.LeaseExpiry.Format(time.RFC3339Nano),
+		"Attempts":        s.Attempts,
+		"RowCount":        s.RowCount,
+		"BatchErrorCount": s.BatchErrorCount,
+	}
+}
+
+func splitFromEntity(e *storage.Entity) (*Split, error) {
+	index, err := strconv.Atoi(e.RowKey)
+	if err != nil {
+		return nil, err
+	}
+	s := &Split{Index: index, entity: e}
+	if s.Period.Start, err = time.Parse(time.RFC3339Nano, stringProperty(e, "Start")); err != nil {
+		return nil, err
+	}
+	if s.Period.End, err = time.Parse(time.RFC3339Nano, stringProperty(e, "End")); err != nil {
+		return nil, err
+	}
+	if expiry := stringProperty(e, "LeaseExpiry"); expiry != "" {
+		if s.LeaseExpiry, err = time.Parse(time.RFC3339Nano, expiry); err != nil {
+			return nil, err
+		}
+	}
+	s.Status = stringProperty(e, "Status")
+	s.Owner = stringProperty(e, "Owner")
+	if v, ok := e.Properties["Attempts"].(float64); ok {
+		s.Attempts = int(v)
+	}
+	if v, ok := e.Properties["RowCount"].(int64); ok {
+		s.RowCount = v
+	}
+	if v, ok := e.Properties["BatchErrorCount"].(int64); ok {
+		s.BatchErrorCount = v
+	}
+	return s, nil
+}
+
+func stringProperty(e *storage.Entity, name string) string {
+	if v, ok := e.Properties[name].(string); ok {
+		return v
+	}
+	return ""
+}
+
+// SplitStore persists the splits of a job in a storage table.
+// All splits of a job share the same partition key, the job ID.
+type SplitStore struct {
+	table *storage.Table
+	jobID string
+}
+
+// NewSplitStore creates a new SplitStore
+func NewSplitStore(client storage.Client, tableName, jobID string) *SplitStore {
+	if log.IsLevelEnabled(log.TraceLevel) {
+		client.Sender = util.SenderWithLogging(client.Sender)
+	}
+	tableService := client.GetTableService()
+	return &SplitStore{table: tableService.GetTableReference(tableName), jobID: jobID}
+}
+
+// JobID the ID of the job
+func (s *SplitStore) JobID() string {
+	return s.jobID
+}
+
+// CreateTableIfNotExists creates the state table
+func (s *SplitStore) CreateTableIfNotExists() error {
+	if err := s.table.Get(timeout, storage.MinimalMetadata); err == nil {
+		return nil
+	}
+	log.Infof("State table %s doesn't exist. Creating...", s.table.Name)
+	err := s.table.Create(timeout, storage.MinimalMetadata, nil)
+	if serr, ok := err.(storage.AzureStorageServiceError); ok && serr.StatusCode == http.StatusConflict {
+		return nil
+	}
+	return err
+}
+
+// List returns all the splits of the job sorted by index
+func (s *SplitStore) List() ([]*Split, error) {
+	queryOptions := &storage.QueryOptions{Filter: fmt.Sprintf("PartitionKey eq '%s'", s.jobID)}
+	result, err := s.table.QueryEntities(timeout, storage.FullMetadata, queryOptions)
+	if err != nil {
+		return nil, err
+	}
+	entities := result.Entities
+	for result.QueryNextLink.NextLink != nil {
+		result, err = result.NextResults(nil)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, result.Entities...)
+	}
+	splits := make([]*Split, len(entities))
+	for i, e := range entities {
+		if splits[i], err = splitFromEntity(e); err != nil {
+			return nil, err
+		}
+	}
+	return splits, nil
+}
+
+// Write replaces the splits of the job with new pending splits for each period.
+// Fails if the job still has unfinished splits.
+func (s *SplitStore) Write(periods []util.Period) error {
+	existing, err := s.List()
+	if err != nil {
+		return err
+	}
+	unfinished := 0
+	for _, split := range existing {
+		if !split.Done() {
+			unfinished++
+		}
+	}
+	if unfinished > 0 {
+		return fmt.Errorf("Job %s still has %d unfinished split(s)", s.jobID, unfinished)
+	}
+
+	chunkSize := 100
+	for i := 0; i < len(existing); i += chunkSize {
+		batch := s.table.NewBatch()
+		for _, split := range existing[i:min(i+chunkSize, len(existing))] {
+			batch.DeleteEntityByForce(split.entity, true)
+		}
+		if err := batch.ExecuteBatch(); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < len(periods); i += chunkSize {
+		batch := s.table.NewBatch()
+		for j := i; j < min(i+chunkSize, len(periods)); j++ {
+			split := Split{Index: j, Period: periods[j], Status: StatusPending}
+			e := s.table.GetEntityReference(s.jobID, rowKey(j))
+			e.Properties = split.toProperties()
+			batch.InsertOrReplaceEntityByForce(e)
+		}
+		if err := batch.ExecuteBatch(); err != nil {
+			return err
+		}
+	}
+	log.Infof("Wrote %d split(s) for job %s", len(periods), s.jobID)
+	return nil
+}
+
+// Update saves the split if it was not modified since it was read. Returns ErrLeaseLost otherwise.
+func (s *SplitStore) Update(split *Split) error {
+	e := s.table.GetEntityReference(s.jobID, rowKey(split.Index))
+	e.Properties = split.toProperties()
+	e.OdataEtag = split.entity.OdataEtag
+	if err := e.Update(false, nil); err != nil {
+		// the SDK wraps the precondition failure into a plain error
+		if strings.HasPrefix(err.Error(), "Etag didn't match") {
+			return ErrLeaseLost
+		}
+		return err
+	}
+	split.entity = e
+	return nil
+}
+
+func rowKey(index int) string {
+	return fmt.Sprintf("%06d", index)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,49 @@
+package distributed
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimable(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.True(t, (&Split{Status: StatusPending}).Claimable(now))
+	assert.True(t, (&Split{Status: StatusClaimed, LeaseExpiry: now.Add(-time.Second)}).Claimable(now))
+	assert.False(t, (&Split{Status: StatusClaimed, LeaseExpiry: now.Add(time.Second)}).Claimable(now))
+	assert.False(t, (&Split{Status: StatusCompleted}).Claimable(now))
+	assert.False(t, (&Split{Status: StatusFailed}).Claimable(now))
+}
+
+func TestSplitEntityRoundTrip(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2020, 1, 1, 23, 59, 59, 999000000, time.UTC)
+	expected := &Split{
+		Index:           7,
+		Period:          util.Period{Start: start, End: end},
+		Status:          StatusClaimed,
+		Owner:           "worker-1",
+		LeaseExpiry:     end.Add(time.Minute),
+		Attempts:        2,
+		RowCount:        1234,
+		BatchErrorCount: 1,
+	}
+
+	// serialize the same way the SDK does when sending and receiving entities
+	e := &storage.Entity{PartitionKey: "logs", RowKey: rowKey(expected.Index), Properties: expected.toProperties()}
+	body, err := json.Marshal(e)
+	assert.NoError(t, err)
+	received := &storage.Entity{}
+	assert.NoError(t, json.Unmarshal(body, received))
+
+	actual, err := splitFromEntity(received)
+	if assert.NoError(t, err) {
+		actual.entity = nil
+		assert.Equal(t, expected, actual)
+	}
+}
@@ -0,0 +1,191 @@
+package distributed
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/purger"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProcessFunc purges the entities within a split period. It stops when ctx is cancelled, once the lease of the split is lost.
+type ProcessFunc func(ctx context.Context, period *util.Period) (purger.PurgeResult, error)
+
+// Store the splits of a job
+type Store interface {
+	JobID() string
+	List() ([]*Split, error)
+	// Update saves the split if it was not modified since it was read. Returns ErrLeaseLost otherwise.
+	Update(split *Split) error
+}
+
+// Coordinate splits the period into periods of splitDuration and writes them to the store
+func Coordinate(store *SplitStore, period *util.Period, splitDuration time.Duration) error {
+	if period.Duration() <= 0 {
+		return fmt.Errorf("cannot split the empty period %s", period)
+	}
+	if splitDuration < time.Millisecond {
+		return fmt.Errorf("invalid split duration %s", splitDuration)
+	}
+	if err := store.CreateTableIfNotExists(); err != nil {
+		return err
+	}
+	periods := period.Split(splitDuration)
+	util.LogPeriods(periods)
+	return store.Write(periods)
+}
+
+// Worker claims and processes the splits of a job until all of them are done
+type Worker struct {
+	ID            string
+	store         Store
+	process       ProcessFunc
+	leaseDuration time.Duration
+	pollInterval  time.Duration
+	maxAttempts   int
+}
+
+// NewWorker creates a new Worker with a unique ID
+func NewWorker(store Store, process ProcessFunc, leaseDuration, pollInterval time.Duration, maxAttempts int) *Worker {
+	hostname, _ := os.Hostname()
+	return &Worker{
+		ID:            fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		store:         store,
+		process:       process,
+		leaseDuration: leaseDuration,
+		pollInterval:  pollInterval,
+		maxAttempts:   maxAttempts,
+	}
+}
+
+// Run processes claimable splits until every split of the job is done.
+// Returns the accumulated result of the splits processed by this worker.
+func (w *Worker) Run() (purger.PurgeResult, error) {
+	var result purger.PurgeResult
+	log.Infof("Worker %s processing job %s", w.ID, w.store.JobID())
+	for {
+		splits, err := w.store.List()
+		if err != nil {
+			return result, err
+		}
+		if len(splits) == 0 {
+			return result, fmt.Errorf("Job %s has no splits", w.store.JobID())
+		}
+
+		pending := 0
+		claimed := false
+		for _, split := range splits {
+			if split.Done() {
+				continue
+			}
+			pending++
+			if !split.Claimable(time.Now().UTC()) {
+				continue
+			}
+			if err := w.claim(split); err != nil {
+				if err == ErrLeaseLost {
+					log.Debugf("Split %d claimed by another worker", split.Index)
+					continue
+				}
+				return result, err
+			}
+			claimed = true
+			result.Add(w.processSplit(split))
+			break
+		}
+
+		if pending == 0 {
+			log.Infof("All %d split(s) of job %s are done", len(splits), w.store.JobID())
+			return result, nil
+		}
+		if !claimed {
+			log.Debugf("%d split(s) being processed by other workers. Waiting %s", pending, w.pollInterval)
+			time.Sleep(w.pollInterval)
+		}
+	}
+}
+
+func (w *Worker) claim(split *Split) error {
+	if split.Status == StatusClaimed {
+		log.Warnf("Reclaiming split %d from %s whose lease expired at %s", split.Index, split.Owner, split.LeaseExpiry)
+	}
+	split.Status = StatusClaimed
+	split.Owner = w.ID
+	split.LeaseExpiry = time.Now().UTC().Add(w.leaseDuration)
+	split.Attempts++
+	return w.store.Update(split)
+}
+
+func (w *Worker) processSplit(split *Split) purger.PurgeResult {
+	log.Infof("Processing split %s", split)
+	var mu sync.Mutex
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var lost bool
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if w.renew(split, &mu, stop) == ErrLeaseLost {
+			lost = true
+			cancel()
+		}
+	}()
+
+	result, err := w.process(ctx, &split.Period)
+	close(stop)
+	wg.Wait()
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if lost {
+		// another worker may own the split by now, its state is left to that worker
+		log.Warnf("Stopped processing split %d whose lease was lost", split.Index)
+		return result
+	}
+	split.RowCount = result.RowCount
+	split.BatchErrorCount = result.BatchErrorCount
+	split.LeaseExpiry = time.Time{}
+	switch {
+	case err == nil:
+		split.Status = StatusCompleted
+	case split.Attempts >= w.maxAttempts:
+		log.Errorf("Split %d failed after %d attempt(s). %s", split.Index, split.Attempts, err)
+		split.Status = StatusFailed
+	default:
+		log.Errorf("Split %d failed. It will be retried. %s", split.Index, err)
+		split.Status = StatusPending
+	}
+	if err := w.store.Update(split); err != nil {
+		log.Errorf("Error recording completion of split %d. %s", split.Index, err)
+	}
+	return result
+}
+
+// renew renews the lease of split until stop is closed. Returns ErrLeaseLost when the split was modified by another worker.
+func (w *Worker) renew(split *Split, mu *sync.Mutex, stop <-chan struct{}) error {
+	ticker := time.NewTicker(w.leaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			mu.Lock()
+			split.LeaseExpiry = time.Now().UTC().Add(w.leaseDuration)
+			err := w.store.Update(split)
+			mu.Unlock()
+			if err != nil {
+				log.Errorf("Error renewing lease of split %d. %s", split.Index, err)
+				if err == ErrLeaseLost {
+					return err
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package distributed
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/purger"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryStore keeps the splits of a job in memory. Updates fail with ErrLeaseLost once the lease is taken over.
+type memoryStore struct {
+	mu        sync.Mutex
+	splits    []*Split
+	updates   []Split
+	takenOver bool
+}
+
+func (s *memoryStore) JobID() string {
+	return "job"
+}
+
+func (s *memoryStore) List() ([]*Split, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	splits := make([]*Split, len(s.splits))
+	for i, split := range s.splits {
+		copied := *split
+		splits[i] = &copied
+	}
+	return splits, nil
+}
+
+func (s *memoryStore) Update(split *Split) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.takenOver {
+		return ErrLeaseLost
+	}
+	s.updates = append(s.updates, *split)
+	*s.splits[split.Index] = *split
+	return nil
+}
+
+func (s *memoryStore) takeOver() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.takenOver = true
+}
+
+func TestProcessSplitStopsWhenLeaseIsLost(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := &memoryStore{splits: []*Split{{Period: util.Period{Start: start, End: start.Add(time.Hour)}, Status: StatusPending}}}
+	process := func(ctx context.Context, period *util.Period) (purger.PurgeResult, error) {
+		store.takeOver()
+		select {
+		case <-ctx.Done():
+			return purger.PurgeResult{RowCount: 1}, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return purger.PurgeResult{}, nil
+		}
+	}
+	w := NewWorker(store, process, 30*time.Millisecond, time.Millisecond, 3)
+	splits, _ := store.List()
+	assert.NoError(t, w.claim(splits[0]))
+
+	result := w.processSplit(splits[0])
+
+	assert.Equal(t, int64(1), result.RowCount, "the purge stopped on lease loss")
+	assert.Len(t, store.updates, 1, "only the claim was recorded")
+	assert.Equal(t, StatusClaimed, store.splits[0].Status)
+}
+
+func TestRunProcessesAllSplits(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := &memoryStore{}
+	for i, period := range (&util.Period{Start: start, End: start.Add(3 * time.Hour)}).Split(time.Hour) {
+		store.splits = append(store.splits, &Split{Index: i, Period: period, Status: StatusPending})
+	}
+	process := func(ctx context.Context, period *util.Period) (purger.PurgeResult, error) {
+		return purger.PurgeResult{RowCount: 10}, nil
+	}
+
+	result, err := NewWorker(store, process, time.Minute, time.Millisecond, 3).Run()
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(30), result.RowCount)
+	for _, split := range store.splits {
+		assert.Equal(t, StatusCompleted, split.Status)
+	}
+}
+
+func TestCoordinateRejectsEmptyPeriod(t *testing.T) {
+	now := time.Now().UTC()
+	// rejected before the store is used
+	assert.Error(t, Coordinate(nil, &util.Period{Start: now, End: now}, time.Hour))
+	assert.Error(t, Coordinate(nil, &util.Period{Start: now.Add(-time.Hour), End: now}, 0))
+}
@@ -0,0 +1,740 @@
+package fakestorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+)
+
+// BlobServer a fake Blob service listening on a local port.
+// Containers, blobs, snapshots and versions are added and inspected in tests through PutBlob, PutSnapshot,
+// PutVersion, SetTier, SetTags, StealLease, Blobs, Snapshots, Versions and Tier, and listed, found by index tags, tiered
+// and deleted, one by one or in batches, through the REST API like on the blob service. Containers and empty blobs
+// can be created and blobs leased through the REST API too.
+// Requests must be signed or carry a SAS token, signatures aren't verified.
+type BlobServer struct {
+	*httptest.Server
+	mu         sync.Mutex
+	containers map[string]*blobContainer
+	// PageSize caps the number of containers and blobs listed per page, 5000 when 0
+	PageSize int
+	// DisableBatch rejects blob batches like older emulators
+	DisableBatch bool
+}
+
+// blobContainer the blobs of a container along with their snapshots and previous versions
+type blobContainer struct {
+	blobs  map[string]storage.Blob
+	copies map[string][]blobCopy
+	// tiers the access tiers set on blobs, Hot when unset
+	tiers map[string]string
+	// tags the index tags of blobs
+	tags map[string]map[string]string
+	// leases the leases acquired on blobs
+	leases map[string]blobLease
+}
+
+// blobLease a lease acquired on a blob
+type blobLease struct {
+	id       string
+	duration time.Duration
+	expiry   time.Time
+}
+
+// leased whether blob has a lease, either set with its lease state or acquired and not expired. The caller holds the lock.
+func (c *blobContainer) leased(blob storage.Blob) bool {
+	lease, ok := c.leases[blob.Name]
+	return blob.Properties.LeaseState == "leased" || (ok && time.Now().Before(lease.expiry))
+}
+
+// blobCopy a snapshot, whose Snapshot time is set, or a previous version of a blob
+type blobCopy struct {
+	blob      storage.Blob
+	versionID string
+}
+
+// listedBlob a blob as listed by the service versions supporting blob versioning and access tiers
+type listedBlob struct {
+	storage.Blob
+	Properties       blobProperties `xml:"Properties"`
+	VersionID        string         `xml:"VersionId,omitempty"`
+	IsCurrentVersion bool           `xml:"IsCurrentVersion,omitempty"`
+}
+
+type blobProperties struct {
+	storage.BlobProperties
+	AccessTier string `xml:"AccessTier,omitempty"`
+}
+
+// NewBlobServer starts a BlobServer without containers. It must be closed with Close.
+func NewBlobServer() *BlobServer {
+	s := &BlobServer{containers: make(map[string]*blobContainer)}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// CreateContainer creates an empty container, if it doesn't exist
+func (s *BlobServer) CreateContainer(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.containers[name]; !ok {
+		s.containers[name] = &blobContainer{blobs: make(map[string]storage.Blob), copies: make(map[string][]blobCopy), tiers: make(map[string]string), tags: make(map[string]map[string]string),
+			leases: make(map[string]blobLease)}
+	}
+}
+
+// PutBlob adds or replaces a blob, creating its container if needed.
+// Blobs are block blobs unless their type is set. Leased blobs, whose lease state is leased, can't be deleted.
+func (s *BlobServer) PutBlob(container string, blob storage.Blob) {
+	s.CreateContainer(container)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blob.Container = nil
+	if blob.Properties.BlobType == "" {
+		blob.Properties.BlobType = storage.BlobTypeBlock
+	}
+	s.containers[container].blobs[blob.Name] = blob
+	delete(s.containers[container].tiers, blob.Name)
+	delete(s.containers[container].tags, blob.Name)
+}
+
+// SetTags sets the index tags of a blob, which must exist
+func (s *BlobServer) SetTags(container, name string, tags map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.containers[container].tags[name] = tags
+}
+
+// SetTier sets the access tier of a blob, which must exist
+func (s *BlobServer) SetTier(container, name, tier string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.containers[container].tiers[name] = tier
+}
+
+// Tier the access tier of a blob, empty when the blob doesn't exist
+func (s *BlobServer) Tier(container, name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.containers[container]; ok {
+		if blob, ok := c.blobs[name]; ok {
+			return c.tier(blob)
+		}
+	}
+	return ""
+}
+
+// tier the access tier of blob. Only block blobs have one.
+func (c *blobContainer) tier(blob storage.Blob) string {
+	if blob.Properties.BlobType != storage.BlobTypeBlock {
+		return ""
+	}
+	if tier, ok := c.tiers[blob.Name]; ok {
+		return tier
+	}
+	return "Hot"
+}
+
+// PutSnapshot adds a snapshot of a blob taken at snapshot, creating the container if needed.
+// Like on the service, snapshot times are precise to 100ns.
+func (s *BlobServer) PutSnapshot(container, name string, snapshot time.Time, properties storage.BlobProperties) {
+	snapshot = snapshot.UTC().Truncate(100 * time.Nanosecond)
+	s.putCopy(container, blobCopy{blob: storage.Blob{Name: name, Snapshot: snapshot, Properties: properties}})
+}
+
+// PutVersion adds a previous version of a blob, creating the container if needed.
+// Version IDs are the creation time of the version, i.e. 2020-01-01T00:00:00.0000000Z.
+func (s *BlobServer) PutVersion(container, name, versionID string, properties storage.BlobProperties) {
+	s.putCopy(container, blobCopy{blob: storage.Blob{Name: name, Properties: properties}, versionID: versionID})
+}
+
+func (s *BlobServer) putCopy(container string, c blobCopy) {
+	s.CreateContainer(container)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.blob.Properties.BlobType == "" {
+		c.blob.Properties.BlobType = storage.BlobTypeBlock
+	}
+	copies := append(s.containers[container].copies[c.blob.Name], c)
+	// snapshots are listed first, oldest first, followed by the versions
+	sort.SliceStable(copies, func(i, j int) bool {
+		if (copies[i].versionID == "") != (copies[j].versionID == "") {
+			return copies[i].versionID == ""
+		}
+		if copies[i].versionID == "" {
+			return copies[i].blob.Snapshot.Before(copies[j].blob.Snapshot)
+		}
+		return copies[i].versionID < copies[j].versionID
+	})
+	s.containers[container].copies[c.blob.Name] = copies
+}
+
+// Blobs the blobs of a container sorted by name, nil when the container doesn't exist
+func (s *BlobServer) Blobs(container string) []storage.Blob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.containers[container]
+	if !ok {
+		return nil
+	}
+	result := make([]storage.Blob, 0, len(c.blobs))
+	for _, name := range c.names() {
+		if blob, ok := c.blobs[name]; ok {
+			result = append(result, blob)
+		}
+	}
+	return result
+}
+
+// Snapshots the times of the snapshots of a blob, oldest first
+func (s *BlobServer) Snapshots(container, name string) []time.Time {
+	var snapshots []time.Time
+	for _, c := range s.copies(container, name) {
+		if c.versionID == "" {
+			snapshots = append(snapshots, c.blob.Snapshot)
+		}
+	}
+	return snapshots
+}
+
+// Versions the IDs of the previous versions of a blob, oldest first
+func (s *BlobServer) Versions(container, name string) []string {
+	var versions []string
+	for _, c := range s.copies(container, name) {
+		if c.versionID != "" {
+			versions = append(versions, c.versionID)
+		}
+	}
+	return versions
+}
+
+func (s *BlobServer) copies(container, name string) []blobCopy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.containers[container]; ok {
+		return append([]blobCopy{}, c.copies[name]...)
+	}
+	return nil
+}
+
+// names the names of the blobs, including the ones only left with snapshots or versions, sorted
+func (c *blobContainer) names() []string {
+	names := make([]string, 0, len(c.blobs))
+	for name := range c.blobs {
+		names = append(names, name)
+	}
+	for name := range c.copies {
+		if _, ok := c.blobs[name]; !ok && len(c.copies[name]) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ServeHTTP routes the requests of the blob service
+func (s *BlobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") == "" && r.URL.Query().Get("sig") == "" {
+		writeXMLError(w, http.StatusForbidden, "AuthenticationFailed", "Server failed to authenticate the request.")
+		return
+	}
+	params := r.URL.Query()
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	switch {
+	case path[0] == "" && r.Method == http.MethodGet && params.Get("comp") == "blobs":
+		s.findBlobsByTags(w, r)
+	case path[0] == "" && r.Method == http.MethodGet && params.Get("comp") == "list":
+		s.listContainers(w, r)
+	case len(path) == 1 && r.Method == http.MethodGet && params.Get("restype") == "container" && params.Get("comp") == "list":
+		s.listBlobs(w, r, path[0])
+	case path[0] == "" && r.Method == http.MethodPost && params.Get("comp") == "batch" && !s.DisableBatch:
+		s.batch(w, r)
+	case len(path) == 1 && r.Method == http.MethodPut && params.Get("restype") == "container":
+		if s.createContainer(path[0]) {
+			w.WriteHeader(http.StatusCreated)
+		} else {
+			writeXMLError(w, http.StatusConflict, "ContainerAlreadyExists", "The specified container already exists.")
+		}
+	case len(path) == 2 && r.Method == http.MethodPut && params.Get("comp") == "lease":
+		s.lease(w, path[0], path[1], r.Header)
+	case len(path) == 2 && r.Method == http.MethodPut && params.Get("comp") == "":
+		if status, code, message := s.createBlob(path[0], path[1], r.Header); code != "" {
+			writeXMLError(w, status, code, message)
+		} else {
+			w.WriteHeader(status)
+		}
+	case len(path) == 2 && r.Method == http.MethodPut && params.Get("comp") == "tier":
+		if status, code, message := s.setTier(path[0], path[1], r.Header.Get("x-ms-access-tier")); code != "" {
+			writeXMLError(w, status, code, message)
+		} else {
+			w.WriteHeader(status)
+		}
+	case len(path) == 2 && r.Method == http.MethodDelete:
+		if status, code, message := s.deleteBlob(path[0], path[1], params, r.Header); code != "" {
+			writeXMLError(w, status, code, message)
+		} else {
+			w.WriteHeader(status)
+		}
+	default:
+		writeXMLError(w, http.StatusNotImplemented, "NotImplemented", fmt.Sprintf("%s %s isn't supported.", r.Method, r.URL.Path))
+	}
+}
+
+// pageSize the number of items of a list page, up to maxresults
+func (s *BlobServer) pageSize(r *http.Request) int {
+	size := s.PageSize
+	if size == 0 {
+		size = 5000
+	}
+	if n, err := strconv.Atoi(r.URL.Query().Get("maxresults")); err == nil && n > 0 && n < size {
+		size = n
+	}
+	return size
+}
+
+// containerNames the names of the containers, sorted. The caller holds the lock.
+func (s *BlobServer) containerNames() []string {
+	names := make([]string, 0, len(s.containers))
+	for name := range s.containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *BlobServer) listContainers(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	type container struct {
+		Name string `xml:"Name"`
+	}
+	response := struct {
+		XMLName    xml.Name    `xml:"EnumerationResults"`
+		Prefix     string      `xml:"Prefix"`
+		Marker     string      `xml:"Marker"`
+		NextMarker string      `xml:"NextMarker"`
+		Containers []container `xml:"Containers>Container"`
+	}{Prefix: params.Get("prefix"), Marker: params.Get("marker")}
+
+	s.mu.Lock()
+	var names []string
+	for _, name := range s.containerNames() {
+		if strings.HasPrefix(name, response.Prefix) && name >= response.Marker {
+			names = append(names, name)
+		}
+	}
+	s.mu.Unlock()
+	if size := s.pageSize(r); len(names) > size {
+		response.NextMarker = names[size]
+		names = names[:size]
+	}
+	for _, name := range names {
+		response.Containers = append(response.Containers, container{Name: name})
+	}
+	writeXML(w, http.StatusOK, response)
+}
+
+// listBlobs lists the blobs of a container in name order, preceded by their snapshots and previous versions
+// when included. With a delimiter, the blobs sharing the prefix up to the delimiter are listed once as a BlobPrefix.
+// A blob and its snapshots and versions are always listed on the same page.
+func (s *BlobServer) listBlobs(w http.ResponseWriter, r *http.Request, container string) {
+	params := r.URL.Query()
+	response := struct {
+		XMLName      xml.Name     `xml:"EnumerationResults"`
+		Prefix       string       `xml:"Prefix"`
+		Marker       string       `xml:"Marker"`
+		MaxResults   int64        `xml:"MaxResults"`
+		Delimiter    string       `xml:"Delimiter"`
+		Blobs        []listedBlob `xml:"Blobs>Blob"`
+		BlobPrefixes []string     `xml:"Blobs>BlobPrefix>Name"`
+		NextMarker   string       `xml:"NextMarker"`
+	}{
+		Prefix:    params.Get("prefix"),
+		Marker:    params.Get("marker"),
+		Delimiter: params.Get("delimiter"),
+	}
+	include := make(map[string]bool)
+	for _, dataset := range strings.Split(params.Get("include"), ",") {
+		include[dataset] = true
+	}
+	s.mu.Lock()
+	c, ok := s.containers[container]
+	if !ok {
+		s.mu.Unlock()
+		writeXMLError(w, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+	size := s.pageSize(r)
+	response.MaxResults = int64(size)
+	count := 0
+	for _, name := range c.names() {
+		if !strings.HasPrefix(name, response.Prefix) || name < response.Marker {
+			continue
+		}
+		prefix := ""
+		if response.Delimiter != "" {
+			if i := strings.Index(name[len(response.Prefix):], response.Delimiter); i >= 0 {
+				prefix = name[:len(response.Prefix)+i+len(response.Delimiter)]
+			}
+		}
+		if prefix != "" && len(response.BlobPrefixes) > 0 && response.BlobPrefixes[len(response.BlobPrefixes)-1] == prefix {
+			continue
+		}
+		if count == size {
+			response.NextMarker = name
+			break
+		}
+		count++
+		if prefix != "" {
+			response.BlobPrefixes = append(response.BlobPrefixes, prefix)
+			continue
+		}
+		for _, copy := range c.copies[name] {
+			if (copy.versionID == "" && include["snapshots"]) || (copy.versionID != "" && include["versions"]) {
+				response.Blobs = append(response.Blobs, listedBlob{Blob: copy.blob, Properties: blobProperties{BlobProperties: copy.blob.Properties}, VersionID: copy.versionID})
+			}
+		}
+		if blob, ok := c.blobs[name]; ok {
+			properties := blobProperties{BlobProperties: blob.Properties, AccessTier: c.tier(blob)}
+			response.Blobs = append(response.Blobs, listedBlob{Blob: blob, Properties: properties, IsCurrentVersion: include["versions"]})
+		}
+	}
+	s.mu.Unlock()
+	if !include["metadata"] {
+		for i := range response.Blobs {
+			response.Blobs[i].Metadata = nil
+		}
+	}
+	writeXML(w, http.StatusOK, &response)
+}
+
+// tagCondition matches a condition of a Find Blobs by Tags expression, i.e. "tenant" = 'x' or @container = 'logs'
+var tagCondition = regexp.MustCompile(`^\s*(@container|"[^"]+"|\w+)\s*(=|>=|<=|>|<)\s*'([^']*)'\s*$`)
+
+// tagConditionSeparator separates the conditions of a Find Blobs by Tags expression, which only supports AND
+var tagConditionSeparator = regexp.MustCompile(`(?i)\s+AND\s+`)
+
+// findBlobsByTags lists the blobs of all the containers whose index tags match the where expression,
+// ordered by container and name. Markers are the container and name of the next blob.
+func (s *BlobServer) findBlobsByTags(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	type condition struct {
+		key, op, value string
+	}
+	var conditions []condition
+	for _, expression := range tagConditionSeparator.Split(params.Get("where"), -1) {
+		match := tagCondition.FindStringSubmatch(expression)
+		if match == nil {
+			writeXMLError(w, http.StatusBadRequest, "InvalidQueryParameterValue", "Error parsing query at or near character position 1: "+expression)
+			return
+		}
+		conditions = append(conditions, condition{key: strings.Trim(match[1], `"`), op: match[2], value: match[3]})
+	}
+	matches := func(value string, c condition) bool {
+		switch c.op {
+		case "=":
+			return value == c.value
+		case ">":
+			return value > c.value
+		case ">=":
+			return value >= c.value
+		case "<":
+			return value < c.value
+		}
+		return value <= c.value
+	}
+	type taggedBlob struct {
+		Name          string `xml:"Name"`
+		ContainerName string `xml:"ContainerName"`
+	}
+	response := struct {
+		XMLName    xml.Name     `xml:"EnumerationResults"`
+		Where      string       `xml:"Where"`
+		Blobs      []taggedBlob `xml:"Blobs>Blob"`
+		NextMarker string       `xml:"NextMarker"`
+	}{Where: params.Get("where")}
+	size := s.pageSize(r)
+	marker := params.Get("marker")
+	s.mu.Lock()
+	for _, containerName := range s.containerNames() {
+		c := s.containers[containerName]
+	blobs:
+		for _, name := range c.names() {
+			if _, ok := c.blobs[name]; !ok || containerName+"/"+name < marker {
+				continue
+			}
+			for _, condition := range conditions {
+				value, ok := c.tags[name][condition.key]
+				if condition.key == "@container" {
+					value, ok = containerName, true
+				}
+				if !ok || !matches(value, condition) {
+					continue blobs
+				}
+			}
+			if len(response.Blobs) == size {
+				response.NextMarker = containerName + "/" + name
+				break
+			}
+			response.Blobs = append(response.Blobs, taggedBlob{Name: name, ContainerName: containerName})
+		}
+		if response.NextMarker != "" {
+			break
+		}
+	}
+	s.mu.Unlock()
+	writeXML(w, http.StatusOK, &response)
+}
+
+// deleteBlob deletes a blob, one of its snapshots or one of its versions, returning the status of the response
+// along with the code and message of errors. Blobs having snapshots are deleted along with them,
+// or only their snapshots are, as requested by x-ms-delete-snapshots.
+func (s *BlobServer) deleteBlob(container, name string, params url.Values, header http.Header) (int, string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.containers[container]
+	if !ok {
+		return http.StatusNotFound, "ContainerNotFound", "The specified container does not exist."
+	}
+	notFound := func() (int, string, string) {
+		return http.StatusNotFound, "BlobNotFound", "The specified blob does not exist."
+	}
+	if params.Get("snapshot") != "" || params.Get("versionid") != "" {
+		snapshot, err := time.Parse(time.RFC3339Nano, params.Get("snapshot"))
+		if params.Get("snapshot") != "" && err != nil {
+			return http.StatusBadRequest, "InvalidQueryParameterValue", "Value for one of the query parameters specified in the request URI is invalid."
+		}
+		for i, copy := range c.copies[name] {
+			if (copy.versionID == "" && copy.blob.Snapshot.Equal(snapshot)) || (copy.versionID != "" && copy.versionID == params.Get("versionid")) {
+				c.copies[name] = append(c.copies[name][:i:i], c.copies[name][i+1:]...)
+				return http.StatusAccepted, "", ""
+			}
+		}
+		return notFound()
+	}
+
+	blob, ok := c.blobs[name]
+	if !ok {
+		return notFound()
+	}
+	if c.leased(blob) {
+		return http.StatusPreconditionFailed, "LeaseIdMissing", "There is currently a lease on the blob and no lease ID was specified in the request."
+	}
+	var versions []blobCopy
+	for _, copy := range c.copies[name] {
+		if copy.versionID != "" {
+			versions = append(versions, copy)
+		}
+	}
+	deleteSnapshots := header.Get("x-ms-delete-snapshots")
+	if len(versions) < len(c.copies[name]) && deleteSnapshots == "" {
+		return http.StatusConflict, "SnapshotsPresent", "This operation is not permitted because the blob has snapshots."
+	}
+	c.copies[name] = versions
+	if deleteSnapshots != "only" {
+		delete(c.blobs, name)
+		delete(c.tiers, name)
+	}
+	return http.StatusAccepted, "", ""
+}
+
+// createContainer creates a container, returning false when it already exists
+func (s *BlobServer) createContainer(name string) bool {
+	s.mu.Lock()
+	_, exists := s.containers[name]
+	s.mu.Unlock()
+	s.CreateContainer(name)
+	return !exists
+}
+
+// createBlob creates an empty blob, returning the status of the response along with the code and message of errors.
+// Leased blobs can't be overwritten, nor can existing blobs with If-None-Match: *.
+func (s *BlobServer) createBlob(container, name string, header http.Header) (int, string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.containers[container]
+	if !ok {
+		return http.StatusNotFound, "ContainerNotFound", "The specified container does not exist."
+	}
+	if blob, ok := c.blobs[name]; ok {
+		if c.leased(blob) && header.Get("x-ms-lease-id") != c.leases[name].id {
+			return http.StatusPreconditionFailed, "LeaseIdMissing", "There is currently a lease on the blob and no lease ID was specified in the request."
+		}
+		if header.Get("If-None-Match") == "*" {
+			return http.StatusConflict, "BlobAlreadyExists", "The specified blob already exists."
+		}
+	}
+	blobType := storage.BlobType(header.Get("x-ms-blob-type"))
+	if blobType == "" {
+		blobType = storage.BlobTypeBlock
+	}
+	c.blobs[name] = storage.Blob{Name: name, Properties: storage.BlobProperties{BlobType: blobType, LastModified: storage.TimeRFC1123(time.Now().UTC())}}
+	return http.StatusCreated, "", ""
+}
+
+// lease acquires, renews or releases the lease of a blob as requested by x-ms-lease-action
+func (s *BlobServer) lease(w http.ResponseWriter, container, name string, header http.Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.containers[container]
+	if !ok {
+		writeXMLError(w, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+	blob, ok := c.blobs[name]
+	if !ok {
+		writeXMLError(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+		return
+	}
+	duration, _ := strconv.Atoi(header.Get("x-ms-lease-duration"))
+	id := header.Get("x-ms-lease-id")
+	switch header.Get("x-ms-lease-action") {
+	case "acquire":
+		if c.leased(blob) {
+			writeXMLError(w, http.StatusConflict, "LeaseAlreadyPresent", "There is already a lease present.")
+			return
+		}
+		if id = header.Get("x-ms-proposed-lease-id"); id == "" {
+			id = strconv.FormatInt(time.Now().UnixNano(), 16)
+		}
+		lease := blobLease{id: id, duration: time.Duration(duration) * time.Second}
+		lease.expiry = time.Now().Add(lease.duration)
+		c.leases[name] = lease
+		w.Header().Set("x-ms-lease-id", id)
+		w.WriteHeader(http.StatusCreated)
+	case "renew", "release":
+		lease, ok := c.leases[name]
+		if !ok || lease.id != id {
+			writeXMLError(w, http.StatusConflict, "LeaseIdMismatchWithLeaseOperation", "The lease ID specified did not match the lease ID for the blob.")
+			return
+		}
+		if header.Get("x-ms-lease-action") == "release" {
+			delete(c.leases, name)
+		} else {
+			lease.expiry = time.Now().Add(lease.duration)
+			c.leases[name] = lease
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeXMLError(w, http.StatusBadRequest, "InvalidHeaderValue", "The value for one of the HTTP headers is not in the correct format.")
+	}
+}
+
+// StealLease replaces the lease of a blob by a new one, as another client whose lease expired in between would
+func (s *BlobServer) StealLease(container, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.containers[container].leases[name] = blobLease{id: "stolen", duration: time.Minute, expiry: time.Now().Add(time.Minute)}
+}
+
+// setTier sets the access tier of a block blob, returning the status of the response along with the code and message of errors
+func (s *BlobServer) setTier(container, name, tier string) (int, string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.containers[container]
+	if !ok {
+		return http.StatusNotFound, "ContainerNotFound", "The specified container does not exist."
+	}
+	blob, ok := c.blobs[name]
+	if !ok {
+		return http.StatusNotFound, "BlobNotFound", "The specified blob does not exist."
+	}
+	if tier != "Hot" && tier != "Cool" && tier != "Archive" {
+		return http.StatusBadRequest, "InvalidHeaderValue", "The value for one of the HTTP headers is not in the correct format."
+	}
+	if blob.Properties.BlobType != storage.BlobTypeBlock {
+		return http.StatusBadRequest, "InvalidBlobType", "The blob type is invalid for this operation."
+	}
+	c.tiers[name] = tier
+	return http.StatusOK, "", ""
+}
+
+// batch executes the sub-requests of a blob batch, which must all be deletes
+func (s *BlobServer) batch(w http.ResponseWriter, r *http.Request) {
+	reader, err := multipartReader(r.Header.Get("Content-Type"), r.Body)
+	if err != nil {
+		writeXMLError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+		return
+	}
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for n := 0; ; n++ {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeXMLError(w, http.StatusBadRequest, "InvalidInput", fmt.Sprintf("reading sub-request %d: %v", n, err))
+			return
+		}
+		if n == util.MaxBlobBatchSize {
+			writeXMLError(w, http.StatusBadRequest, "ExceedsMaxBatchRequestCount", fmt.Sprintf("The batch operation exceeds the maximum number of %d sub-requests.", util.MaxBlobBatchSize))
+			return
+		}
+		request, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			writeXMLError(w, http.StatusBadRequest, "InvalidInput", fmt.Sprintf("reading sub-request %d: %v", n, err))
+			return
+		}
+		status, code, message := http.StatusForbidden, "AuthenticationFailed", "Server failed to authenticate the request."
+		path := strings.SplitN(strings.TrimPrefix(request.URL.Path, "/"), "/", 2)
+		switch {
+		case request.Header.Get("Authorization") == "" && request.URL.Query().Get("sig") == "":
+		case request.Method != http.MethodDelete || len(path) != 2:
+			status, code, message = http.StatusBadRequest, "InvalidInput", "Only blob deletes are supported in batches."
+		default:
+			status, code, message = s.deleteBlob(path[0], path[1], request.URL.Query(), request.Header)
+		}
+
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Type", "application/http")
+		h.Set("Content-ID", part.Header.Get("Content-ID"))
+		response, _ := writer.CreatePart(h)
+		fmt.Fprintf(response, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+		if code == "" {
+			fmt.Fprint(response, "x-ms-delete-type-permanent: true\r\n\r\n")
+			continue
+		}
+		errorBody := fmt.Sprintf(`%s<Error><Code>%s</Code><Message>%s</Message></Error>`, xml.Header, code, message)
+		fmt.Fprintf(response, "x-ms-error-code: %s\r\nContent-Type: application/xml\r\nContent-Length: %d\r\n\r\n%s", code, len(errorBody), errorBody)
+	}
+	writer.Close()
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(body.Bytes())
+}
+
+func writeXML(w http.ResponseWriter, status int, value interface{}) {
+	body, err := xml.Marshal(value)
+	if err != nil {
+		writeXMLError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+// writeXMLError writes an error of the blob service
+func writeXMLError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `%s<Error><Code>%s</Code><Message>%s</Message></Error>`, xml.Header, code, message)
+}
@@ -0,0 +1,407 @@
+// Package fakestorage serves the subsets of the Azure Table and Blob service REST APIs used by azp from memory,
+// so the storage client wire path can be tested end to end without an account or an emulator.
+package fakestorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/tablestore"
+)
+
+const (
+	headerNextPartitionKey = "x-ms-continuation-NextPartitionKey"
+	headerNextRowKey       = "x-ms-continuation-NextRowKey"
+	jsonContentType        = "application/json;odata=nometadata;streaming=true;charset=utf-8"
+)
+
+// entityPath matches the path of an entity: table(PartitionKey='pk',RowKey='rk'), quotes are escaped by doubling them
+var entityPath = regexp.MustCompile(`^([^(]+)\(PartitionKey='((?:[^']|'')*)',\s*RowKey='((?:[^']|'')*)'\)$`)
+
+// tablePath matches the path of a table: Tables('table')
+var tablePath = regexp.MustCompile(`^Tables\('([^']+)'\)$`)
+
+// Server a fake Table service listening on a local port.
+// Tables are created, queried and changed through entity group transactions like on the table service,
+// and inspected in tests through Table. Requests must be signed or carry a SAS token, signatures aren't verified.
+type Server struct {
+	*httptest.Server
+	mu     sync.Mutex
+	tables map[string]*tablestore.MemoryStore
+	// PageSize caps the size of the pages of the tables created afterwards, 1000 when 0
+	PageSize int
+}
+
+// NewServer starts a Server without tables. It must be closed with Close.
+func NewServer() *Server {
+	s := &Server{tables: make(map[string]*tablestore.MemoryStore)}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Table the table with the given name, nil when it doesn't exist
+func (s *Server) Table(name string) *tablestore.MemoryStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tables[name]
+}
+
+// ServeHTTP routes the requests of the table service.
+// Paths may start with the account name, like on the storage emulator.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") == "" && r.URL.Query().Get("sig") == "" {
+		writeError(w, http.StatusForbidden, "AuthenticationFailed", "Server failed to authenticate the request.")
+		return
+	}
+	resource := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	switch {
+	case resource == "Tables" && r.Method == http.MethodPost:
+		s.createTable(w, r)
+	case resource == "$batch" && r.Method == http.MethodPost:
+		s.batch(w, r)
+	case tablePath.MatchString(resource) && r.Method == http.MethodGet:
+		s.getTable(w, tablePath.FindStringSubmatch(resource)[1])
+	case r.Method == http.MethodGet && !strings.Contains(strings.TrimSuffix(resource, "()"), "("):
+		// the entities of a table are queried either on table() or on table
+		s.queryEntities(w, r, strings.TrimSuffix(resource, "()"))
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", fmt.Sprintf("%s %s isn't supported.", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) createTable(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		TableName string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.TableName == "" {
+		writeError(w, http.StatusBadRequest, "InvalidInput", "One of the request inputs is not valid.")
+		return
+	}
+	s.mu.Lock()
+	_, exists := s.tables[request.TableName]
+	if !exists {
+		table := tablestore.NewMemoryStore(request.TableName)
+		table.PageSize = s.PageSize
+		s.tables[request.TableName] = table
+	}
+	s.mu.Unlock()
+	if exists {
+		writeError(w, http.StatusConflict, "TableAlreadyExists", "The table specified already exists.")
+		return
+	}
+	if r.Header.Get("Prefer") == "return-no-content" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"TableName": request.TableName})
+}
+
+func (s *Server) getTable(w http.ResponseWriter, name string) {
+	if s.Table(name) == nil {
+		writeError(w, http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"TableName": name})
+}
+
+func (s *Server) queryEntities(w http.ResponseWriter, r *http.Request, name string) {
+	table := s.Table(name)
+	if table == nil {
+		writeError(w, http.StatusNotFound, "TableNotFound", "The table specified does not exist.")
+		return
+	}
+	params := r.URL.Query()
+	query := tablestore.Query{Filter: params.Get("$filter")}
+	if selected := params.Get("$select"); selected != "" {
+		query.Select = strings.Split(selected, ",")
+	}
+	if top := params.Get("$top"); top != "" {
+		n, err := strconv.ParseUint(top, 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidInput", fmt.Sprintf("Invalid $top %q.", top))
+			return
+		}
+		query.Top = uint(n)
+	}
+
+	var page *tablestore.Page
+	var err error
+	if params.Get("NextPartitionKey") != "" || params.Get("NextRowKey") != "" {
+		continuation := tablestore.MemoryContinuation{Query: query, PartitionKey: params.Get("NextPartitionKey"), RowKey: params.Get("NextRowKey")}
+		page, err = table.NextPage(r.Context(), &tablestore.Page{Continuation: continuation})
+	} else {
+		page, err = table.Query(r.Context(), query)
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	if page.HasNext() {
+		continuation := page.Continuation.(tablestore.MemoryContinuation)
+		w.Header().Set(headerNextPartitionKey, continuation.PartitionKey)
+		w.Header().Set(headerNextRowKey, continuation.RowKey)
+	}
+	values := make([]map[string]interface{}, len(page.Entities))
+	for i, e := range page.Entities {
+		values[i] = entityJSON(e, query.Select)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": values})
+}
+
+// entityJSON the properties of e, with the type annotations stored along them, keeping only the selected ones
+func entityJSON(e *storage.Entity, selected []string) map[string]interface{} {
+	result := map[string]interface{}{"PartitionKey": e.PartitionKey, "RowKey": e.RowKey}
+	for k, v := range e.Properties {
+		result[k] = v
+	}
+	if len(selected) == 0 {
+		return result
+	}
+	projection := make(map[string]interface{}, len(selected))
+	for _, k := range selected {
+		for _, key := range []string{k, k + storage.OdataTypeSuffix} {
+			if v, ok := result[key]; ok {
+				projection[key] = v
+			}
+		}
+	}
+	return projection
+}
+
+// operation a request of a changeset
+type operation struct {
+	method string
+	table  string
+	entity *storage.Entity
+}
+
+// batch executes the changeset of an entity group transaction. Changesets hold either deletes or
+// inserts, merges and replaces, which are all applied as insert or merge.
+func (s *Server) batch(w http.ResponseWriter, r *http.Request) {
+	operations, err := readChangeset(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+		return
+	}
+	if len(operations) == 0 {
+		writeBatchResponse(w, changesetError(http.StatusBadRequest, "InvalidInput", "0:The batch request operation is not supported."))
+		return
+	}
+
+	batch := &tablestore.Batch{PartitionKey: operations[0].entity.PartitionKey}
+	deletes := 0
+	for i, op := range operations {
+		if op.table != operations[0].table {
+			writeBatchResponse(w, changesetError(http.StatusBadRequest, "InvalidInput", fmt.Sprintf("%d:All commands in a batch must operate on the same table.", i)))
+			return
+		}
+		if op.method == http.MethodDelete {
+			deletes++
+		}
+		batch.Entities = append(batch.Entities, op.entity)
+	}
+	if deletes > 0 && deletes < len(operations) {
+		writeBatchResponse(w, changesetError(http.StatusNotImplemented, "NotImplemented", "0:Changesets mixing deletes and upserts aren't supported."))
+		return
+	}
+	table := s.Table(operations[0].table)
+	if table == nil {
+		writeBatchResponse(w, changesetError(http.StatusNotFound, "TableNotFound", "0:The table specified does not exist."))
+		return
+	}
+
+	if deletes > 0 {
+		err = table.DeleteBatch(r.Context(), batch)
+	} else {
+		err = table.UpsertBatch(r.Context(), batch)
+	}
+	if err != nil {
+		status, code, message := storageError(err)
+		writeBatchResponse(w, changesetError(status, code, message))
+		return
+	}
+	responses := make([]changesetResponse, len(operations))
+	for i := range responses {
+		responses[i] = changesetResponse{status: http.StatusNoContent}
+	}
+	writeBatchResponse(w, responses)
+}
+
+// readChangeset reads the operations of the single changeset of a batch request
+func readChangeset(r *http.Request) ([]operation, error) {
+	batchReader, err := multipartReader(r.Header.Get("Content-Type"), r.Body)
+	if err != nil {
+		return nil, err
+	}
+	changeset, err := batchReader.NextPart()
+	if err != nil {
+		return nil, fmt.Errorf("reading the changeset: %v", err)
+	}
+	changesetReader, err := multipartReader(changeset.Header.Get("Content-Type"), changeset)
+	if err != nil {
+		return nil, err
+	}
+	var operations []operation
+	for {
+		part, err := changesetReader.NextPart()
+		if err == io.EOF {
+			return operations, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading the changeset: %v", err)
+		}
+		op, err := readOperation(part)
+		if err != nil {
+			return nil, fmt.Errorf("reading operation %d: %v", len(operations), err)
+		}
+		operations = append(operations, op)
+	}
+}
+
+func multipartReader(contentType string, body io.Reader) (*multipart.Reader, error) {
+	mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(contentType))
+	if err != nil || mediaType != "multipart/mixed" || params["boundary"] == "" {
+		return nil, fmt.Errorf("expected a multipart/mixed content, got %q", contentType)
+	}
+	return multipart.NewReader(body, params["boundary"]), nil
+}
+
+// readOperation parses an application/http part holding a request on an entity
+func readOperation(part io.Reader) (operation, error) {
+	reader := bufio.NewReader(part)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return operation{}, err
+	}
+	// the body of the operations is sent without a Content-Length
+	body, err := ioutil.ReadAll(io.MultiReader(request.Body, reader))
+	if err != nil {
+		return operation{}, err
+	}
+	op := operation{method: request.Method, entity: &storage.Entity{Properties: make(map[string]interface{})}}
+	if body = bytes.TrimSpace(body); len(body) > 0 {
+		if err := json.Unmarshal(body, &op.entity.Properties); err != nil {
+			return operation{}, err
+		}
+	}
+
+	resource := request.URL.Path[strings.LastIndex(request.URL.Path, "/")+1:]
+	if keys := entityPath.FindStringSubmatch(resource); keys != nil {
+		op.table = keys[1]
+		op.entity.PartitionKey = strings.ReplaceAll(keys[2], "''", "'")
+		op.entity.RowKey = strings.ReplaceAll(keys[3], "''", "'")
+	} else if request.Method == http.MethodPost {
+		// inserts carry the keys in the body
+		op.table = resource
+		op.entity.PartitionKey, _ = op.entity.Properties["PartitionKey"].(string)
+		op.entity.RowKey, _ = op.entity.Properties["RowKey"].(string)
+	} else {
+		return operation{}, fmt.Errorf("%s %s isn't an entity", request.Method, request.URL.Path)
+	}
+	for k := range op.entity.Properties {
+		if k == "PartitionKey" || k == "RowKey" || strings.HasPrefix(k, "odata.") {
+			delete(op.entity.Properties, k)
+		}
+	}
+	return op, nil
+}
+
+// changesetResponse the response to an operation of a changeset
+type changesetResponse struct {
+	status int
+	body   []byte
+}
+
+// changesetError the response of a failed changeset: a single response for the failed operation,
+// whose message starts with the operation index
+func changesetError(status int, code, message string) []changesetResponse {
+	return []changesetResponse{{status: status, body: errorBody(code, message)}}
+}
+
+// writeBatchResponse writes the responses of a changeset. Batches are accepted even when their changeset fails.
+func writeBatchResponse(w http.ResponseWriter, responses []changesetResponse) {
+	changeset := new(bytes.Buffer)
+	changesetWriter := multipart.NewWriter(changeset)
+	for _, response := range responses {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Type", "application/http")
+		h.Set("Content-Transfer-Encoding", "binary")
+		part, _ := changesetWriter.CreatePart(h)
+		fmt.Fprintf(part, "HTTP/1.1 %d %s\r\n", response.status, http.StatusText(response.status))
+		if len(response.body) > 0 {
+			fmt.Fprintf(part, "Content-Type: %s\r\nContent-Length: %d\r\n\r\n", jsonContentType, len(response.body))
+			part.Write(response.body)
+		} else {
+			fmt.Fprint(part, "\r\n")
+		}
+	}
+	changesetWriter.Close()
+
+	body := new(bytes.Buffer)
+	batchWriter := multipart.NewWriter(body)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", "multipart/mixed; boundary="+changesetWriter.Boundary())
+	part, _ := batchWriter.CreatePart(h)
+	part.Write(changeset.Bytes())
+	batchWriter.Close()
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+batchWriter.Boundary())
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(body.Bytes())
+}
+
+// storageError the status, code and message of the service error err
+func storageError(err error) (int, string, string) {
+	if serviceErr, ok := err.(storage.AzureStorageServiceError); ok {
+		return serviceErr.StatusCode, serviceErr.Code, serviceErr.Message
+	}
+	return http.StatusInternalServerError, "InternalError", err.Error()
+}
+
+func writeStorageError(w http.ResponseWriter, err error) {
+	status, code, message := storageError(err)
+	writeError(w, status, code, message)
+}
+
+// errorBody an OData JSON error
+func errorBody(code, message string) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"odata.error": map[string]interface{}{
+			"code":    code,
+			"message": map[string]string{"lang": "en-US", "value": message},
+		},
+	})
+	return body
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+	w.Write(errorBody(code, message))
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,114 @@
+package fakestorage
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	"github.com/fabito/azure-storage-purger/pkg/populator"
+	"github.com/fabito/azure-storage-purger/pkg/progress"
+	"github.com/fabito/azure-storage-purger/pkg/purger"
+	"github.com/fabito/azure-storage-purger/pkg/tablestore"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func credentials(server *Server) auth.Credentials {
+	return auth.Credentials{AccountName: "acme", AccountKey: "YWNtZQ==", TableEndpoint: server.URL}
+}
+
+func TestPopulateAndPurge(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		credentials func(*Server) auth.Credentials
+		usePool     bool
+		backend     purger.Backend
+	}{
+		{"shared key", credentials, false, purger.StorageBackend},
+		{"worker pool", credentials, true, purger.StorageBackend},
+		{"emulator", func(server *Server) auth.Credentials {
+			return auth.Credentials{UseEmulator: true, TableEndpoint: server.URL}
+		}, false, purger.StorageBackend},
+		{"cosmos", credentials, false, purger.CosmosBackend},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server := NewServer()
+			defer server.Close()
+			// small pages exercise the continuation headers
+			server.PageSize = 120
+			credentials := test.credentials(server)
+
+			today := time.Now().UTC().Truncate(24 * time.Hour)
+			err := populator.PopulateTable(credentials, "logs", today.AddDate(0, 0, -20), today, 150, 4)
+			assert.NoError(t, err)
+			table := server.Table("logs")
+			if !assert.NotNil(t, table) {
+				return
+			}
+			assert.Equal(t, 21*150, table.Len())
+			e := table.Get(util.TicksAscendingWithLeadingZero(util.TicksFromTime(today)), "1")
+			if assert.NotNil(t, e) {
+				assert.Equal(t, "Edm.DateTime", e.Properties["CreatedOn@odata.type"])
+			}
+
+			tablePurger, err := purger.NewTablePurger(credentials, "logs", 10, 25, 3, test.usePool, false, progress.None, nil, test.backend)
+			assert.NoError(t, err)
+			result, err := tablePurger.PurgeEntities()
+			assert.NoError(t, err)
+			assert.False(t, result.HasErrors())
+			// the partitions of 20 to 11 days ago are deleted
+			assert.Equal(t, int64(10*150), result.RowCount)
+			assert.Equal(t, 11*150, table.Len())
+			assert.Nil(t, table.Get(util.TicksAscendingWithLeadingZero(util.TicksFromTime(today.AddDate(0, 0, -11))), "1"))
+			assert.NotNil(t, table.Get(util.TicksAscendingWithLeadingZero(util.TicksFromTime(today.AddDate(0, 0, -10))), "1"))
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	client, err := credentials(server).NewClient()
+	assert.NoError(t, err)
+	store := tablestore.NewAzureStore(client, "logs")
+	ctx := context.Background()
+
+	_, err = store.Query(ctx, tablestore.Query{})
+	if assert.IsType(t, storage.AzureStorageServiceError{}, err) {
+		assert.Equal(t, http.StatusNotFound, err.(storage.AzureStorageServiceError).StatusCode)
+		assert.Equal(t, "TableNotFound", err.(storage.AzureStorageServiceError).Code)
+	}
+
+	assert.NoError(t, store.CreateIfNotExists(ctx))
+	assert.NoError(t, store.CreateIfNotExists(ctx))
+	batch := &tablestore.Batch{PartitionKey: "0001", Entities: []*storage.Entity{
+		{PartitionKey: "0001", RowKey: "1", Properties: map[string]interface{}{"Level": "it's"}},
+		{PartitionKey: "0001", RowKey: "2"},
+	}}
+	assert.NoError(t, store.UpsertBatch(ctx, batch))
+
+	// the failed operation is reported and the changeset isn't applied
+	batch.Entities = append(batch.Entities, &storage.Entity{PartitionKey: "0001", RowKey: "3"})
+	err = store.DeleteBatch(ctx, batch)
+	if assert.IsType(t, storage.AzureStorageServiceError{}, err) {
+		assert.Equal(t, http.StatusNotFound, err.(storage.AzureStorageServiceError).StatusCode)
+		assert.Equal(t, "ResourceNotFound", err.(storage.AzureStorageServiceError).Code)
+		assert.Contains(t, err.(storage.AzureStorageServiceError).Message, "Element 2 in the batch")
+	}
+	assert.Equal(t, 2, server.Table("logs").Len())
+
+	page, err := store.Query(ctx, tablestore.Query{Filter: "Level eq 'it''s'", Select: []string{"RowKey"}})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Entities, 1) {
+		assert.Equal(t, "1", page.Entities[0].RowKey)
+		assert.Empty(t, page.Entities[0].Properties)
+	}
+
+	response, err := http.Get(server.URL + "/Tables('logs')")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+}
@@ -0,0 +1,352 @@
+// Package faults injects latency, error responses, timeouts, dropped connections and truncated bodies
+// into the requests of storage clients, to watch how purges behave when the service misbehaves.
+package faults
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	log "github.com/sirupsen/logrus"
+)
+
+// Operation a type of storage request
+type Operation string
+
+// Operations faults are injected into
+const (
+	// AllOperations any request
+	AllOperations Operation = "all"
+	// QueryOperation table queries
+	QueryOperation Operation = "query"
+	// BatchOperation entity group transactions
+	BatchOperation Operation = "batch"
+	// TableOperation the other table requests: tables and single entities
+	TableOperation Operation = "table"
+	// BlobOperation blob service requests
+	BlobOperation Operation = "blob"
+)
+
+// Kind a kind of fault
+type Kind string
+
+// Kinds of faults
+const (
+	// Latency delays the request
+	Latency Kind = "latency"
+	// Status answers with an error status without sending the request
+	Status Kind = "status"
+	// Timeout fails with a timeout, after the latency of the rule, without sending the request
+	Timeout Kind = "timeout"
+	// Drop sends the request and fails with a connection reset instead of returning the response
+	Drop Kind = "drop"
+	// Truncate cuts the response body in half
+	Truncate Kind = "truncate"
+)
+
+// Rule injects a kind of fault into a share of the requests of an operation
+type Rule struct {
+	Operation Operation `mapstructure:"operation"`
+	Kind      Kind      `mapstructure:"fault"`
+	// Rate the probability of injecting the fault into a request, from 0 to 1
+	Rate float64 `mapstructure:"rate"`
+	// Latency the delay of Latency faults and the wait before Timeout faults
+	Latency time.Duration `mapstructure:"latency"`
+	// Status the status code of Status faults, 503 when 0
+	Status int `mapstructure:"status"`
+}
+
+// Config the fault injection rules
+type Config struct {
+	// Seed seeds the random decisions, the current time when 0
+	Seed  int64  `mapstructure:"seed"`
+	Rules []Rule `mapstructure:"faults"`
+}
+
+// ParseRule parses a rule given as operation:fault[=value]:rate where value is the status code of status faults
+// and the duration of latency and timeout faults, i.e. batch:status=503:0.1 or query:latency=2s:0.05
+func ParseRule(spec string) (Rule, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 {
+		return Rule{}, fmt.Errorf("invalid fault %q. Expected operation:fault[=value]:rate", spec)
+	}
+	rule := Rule{Operation: Operation(parts[0])}
+	kind := strings.SplitN(parts[1], "=", 2)
+	rule.Kind = Kind(kind[0])
+	if len(kind) == 2 {
+		var err error
+		switch rule.Kind {
+		case Status:
+			rule.Status, err = strconv.Atoi(kind[1])
+		case Latency, Timeout:
+			rule.Latency, err = time.ParseDuration(kind[1])
+		default:
+			err = fmt.Errorf("%s faults take no value", rule.Kind)
+		}
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid fault %q. %s", spec, err)
+		}
+	}
+	rate, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid fault rate %q", parts[2])
+	}
+	rule.Rate = rate
+	return rule, rule.Validate()
+}
+
+// String the rule in the format of ParseRule
+func (r Rule) String() string {
+	kind := string(r.Kind)
+	switch {
+	case r.Kind == Status && r.Status != 0:
+		kind = fmt.Sprintf("%s=%d", r.Kind, r.Status)
+	case (r.Kind == Latency || r.Kind == Timeout) && r.Latency != 0:
+		kind = fmt.Sprintf("%s=%s", r.Kind, r.Latency)
+	}
+	return fmt.Sprintf("%s:%s:%v", r.Operation, kind, r.Rate)
+}
+
+// Validate checks the operation, kind, rate and value of the rule
+func (r Rule) Validate() error {
+	switch r.Operation {
+	case AllOperations, QueryOperation, BatchOperation, TableOperation, BlobOperation:
+	default:
+		return fmt.Errorf("invalid operation %q. Expected all, query, batch, table or blob", r.Operation)
+	}
+	switch r.Kind {
+	case Latency:
+		if r.Latency <= 0 {
+			return errors.New("latency faults require a positive latency")
+		}
+	case Status:
+		if r.Status != 0 && (r.Status < 400 || r.Status > 599) {
+			return fmt.Errorf("invalid status %d. Expected an error status from 400 to 599", r.Status)
+		}
+	case Timeout, Drop, Truncate:
+	default:
+		return fmt.Errorf("invalid fault %q. Expected latency, status, timeout, drop or truncate", r.Kind)
+	}
+	if r.Rate <= 0 || r.Rate > 1 {
+		return fmt.Errorf("invalid rate %v. Expected a probability greater than 0 and up to 1", r.Rate)
+	}
+	return nil
+}
+
+// Injector decides which requests get which faults and counts the faults injected
+type Injector struct {
+	mu     sync.Mutex
+	random *rand.Rand
+	rules  []Rule
+	counts map[Kind]int64
+}
+
+// NewInjector validates the rules of config and creates an Injector applying them
+func NewInjector(config Config) (*Injector, error) {
+	for _, rule := range config.Rules {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Injector{random: rand.New(rand.NewSource(seed)), rules: config.Rules, counts: make(map[Kind]int64)}, nil
+}
+
+// Counts the number of faults injected by kind
+func (i *Injector) Counts() map[Kind]int64 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	counts := make(map[Kind]int64, len(i.counts))
+	for k, v := range i.counts {
+		counts[k] = v
+	}
+	return counts
+}
+
+// String summarizes the faults injected
+func (i *Injector) String() string {
+	counts := i.Counts()
+	var parts []string
+	for _, kind := range []Kind{Latency, Status, Timeout, Drop, Truncate} {
+		if counts[kind] > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", kind, counts[kind]))
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
+// faults the total latency and the fault, if any, to inject into a request of op.
+// Latencies add up, the first other fault drawn wins.
+func (i *Injector) faults(op Operation) (time.Duration, *Rule) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var latency time.Duration
+	for n := range i.rules {
+		rule := &i.rules[n]
+		if rule.Operation != AllOperations && rule.Operation != op {
+			continue
+		}
+		if i.random.Float64() >= rule.Rate {
+			continue
+		}
+		i.counts[rule.Kind]++
+		if rule.Kind == Latency {
+			latency += rule.Latency
+			continue
+		}
+		return latency, rule
+	}
+	return latency, nil
+}
+
+// operation the type of r
+func operation(r *http.Request) Operation {
+	if auth.Service(r) == auth.BlobService {
+		return BlobOperation
+	}
+	resource := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	switch {
+	case resource == "$batch":
+		return BatchOperation
+	case strings.HasPrefix(resource, "Tables"):
+		return TableOperation
+	case r.Method == http.MethodGet && !strings.Contains(strings.TrimSuffix(resource, "()"), "("):
+		return QueryOperation
+	}
+	return TableOperation
+}
+
+// transport injects faults into the requests sent by next
+type transport struct {
+	next     http.RoundTripper
+	injector *Injector
+}
+
+// Transport returns an HTTP transport injecting the faults drawn by injector into the requests sent by next.
+// It sits below the retries of the storage clients, which see the injected faults like the ones of the service.
+func Transport(next http.RoundTripper, injector *Injector) http.RoundTripper {
+	return &transport{next: next, injector: injector}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	op := operation(r)
+	latency, rule := t.injector.faults(op)
+	logger := log.WithFields(log.Fields{"operation": op, "method": r.Method})
+	if latency > 0 {
+		logger.Debugf("Injecting %s of latency", latency)
+		if err := sleep(r, latency); err != nil {
+			return nil, err
+		}
+	}
+	if rule == nil {
+		return t.next.RoundTrip(r)
+	}
+	logger.Debugf("Injecting %s fault", rule.Kind)
+	switch rule.Kind {
+	case Status:
+		return errorResponse(r, op, rule.Status), nil
+	case Timeout:
+		if err := sleep(r, rule.Latency); err != nil {
+			return nil, err
+		}
+		return nil, timeoutError{}
+	}
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		return resp, err
+	}
+	if rule.Kind == Drop {
+		resp.Body.Close()
+		return nil, syscall.ECONNRESET
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body[:len(body)/2]), errorReader{io.ErrUnexpectedEOF}))
+	return resp, nil
+}
+
+// sleep waits for d unless the request is canceled first
+func sleep(r *http.Request, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
+
+// errorCodes the storage error codes of the statuses usually injected
+var errorCodes = map[int]string{
+	http.StatusRequestTimeout:      "OperationTimedOut",
+	http.StatusTooManyRequests:     "TooManyRequests",
+	http.StatusInternalServerError: "InternalError",
+	http.StatusServiceUnavailable:  "ServerBusy",
+	http.StatusGatewayTimeout:      "OperationTimedOut",
+}
+
+// errorResponse a storage error response, in XML for blobs and in OData JSON for tables
+func errorResponse(r *http.Request, op Operation, status int) *http.Response {
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	code, ok := errorCodes[status]
+	if !ok {
+		code = "InjectedFault"
+	}
+	message := fmt.Sprintf("Fault injected into %s request.", op)
+	header := make(http.Header)
+	var body string
+	if op == BlobOperation {
+		header.Set("Content-Type", "application/xml")
+		body = fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, message)
+	} else {
+		header.Set("Content-Type", "application/json;odata=nometadata;streaming=true;charset=utf-8")
+		body = fmt.Sprintf(`{"odata.error":{"code":%q,"message":{"lang":"en-US","value":%q}}}`, code, message)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		Request:       r,
+	}
+}
+
+// timeoutError a net.Error timing out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout (injected)" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
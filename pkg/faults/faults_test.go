@@ -0,0 +1,163 @@
+package faults
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	"github.com/fabito/azure-storage-purger/pkg/fakestorage"
+	"github.com/fabito/azure-storage-purger/pkg/populator"
+	"github.com/fabito/azure-storage-purger/pkg/progress"
+	"github.com/fabito/azure-storage-purger/pkg/purger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRule(t *testing.T) {
+	for spec, expected := range map[string]Rule{
+		"batch:status=503:0.1":  {Operation: BatchOperation, Kind: Status, Status: 503, Rate: 0.1},
+		"query:latency=2s:0.05": {Operation: QueryOperation, Kind: Latency, Latency: 2 * time.Second, Rate: 0.05},
+		"all:drop:1":            {Operation: AllOperations, Kind: Drop, Rate: 1},
+		"blob:timeout=1m0s:0.5": {Operation: BlobOperation, Kind: Timeout, Latency: time.Minute, Rate: 0.5},
+		"table:truncate:0.2":    {Operation: TableOperation, Kind: Truncate, Rate: 0.2},
+	} {
+		rule, err := ParseRule(spec)
+		assert.NoError(t, err, spec)
+		assert.Equal(t, expected, rule, spec)
+		assert.Equal(t, spec, rule.String())
+	}
+	for _, spec := range []string{"batch:status=503", "entity:drop:0.1", "batch:reset:0.1", "batch:status=200:0.1", "query:latency:0.1", "all:drop=1s:0.1", "all:drop:0", "all:drop:2"} {
+		_, err := ParseRule(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestOperation(t *testing.T) {
+	for u, expected := range map[string]Operation{
+		"https://acme.table.core.windows.net/logs()?$top=10":                                      QueryOperation,
+		"https://acme.table.core.windows.net/$batch":                                              BatchOperation,
+		"https://acme.table.core.windows.net/Tables('logs')":                                      TableOperation,
+		"https://acme.table.core.windows.net/logs(PartitionKey='1',RowKey='2')":                   TableOperation,
+		"https://acme.blob.core.windows.net/logs?restype=container&comp=list":                     BlobOperation,
+		"http://127.0.0.1:10002/devstoreaccount1/logs()":                                          QueryOperation,
+		"http://127.0.0.1:10000/devstoreaccount1/logs/2020/01/01/blob.json?comp=metadata&sv=2019": BlobOperation,
+	} {
+		r, _ := http.NewRequest(http.MethodGet, u, nil)
+		assert.Equal(t, expected, operation(r), u)
+	}
+}
+
+// roundTripperFunc an http.RoundTripper calling the function
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// send sends a query through a transport injecting the fault of rule, returning whether the query reached the service
+func send(t *testing.T, rule Rule) (*http.Response, bool, error) {
+	injector, err := NewInjector(Config{Seed: 1, Rules: []Rule{rule}})
+	assert.NoError(t, err)
+	sent := false
+	transport := Transport(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		sent = true
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(`{"value":[]}`))}, nil
+	}), injector)
+	r, _ := http.NewRequest(http.MethodGet, "https://acme.table.core.windows.net/logs()", nil)
+	resp, err := transport.RoundTrip(r)
+	assert.Equal(t, int64(1), injector.Counts()[rule.Kind])
+	return resp, sent, err
+}
+
+func TestTransport(t *testing.T) {
+	resp, sent, err := send(t, Rule{Operation: QueryOperation, Kind: Status, Rate: 1})
+	assert.NoError(t, err)
+	assert.False(t, sent)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	_, sent, err = send(t, Rule{Operation: AllOperations, Kind: Drop, Rate: 1})
+	assert.True(t, sent)
+	assert.True(t, errors.Is(err, syscall.ECONNRESET))
+
+	_, sent, err = send(t, Rule{Operation: QueryOperation, Kind: Timeout, Latency: 10 * time.Millisecond, Rate: 1})
+	assert.False(t, sent)
+	if netErr, ok := err.(net.Error); assert.True(t, ok) {
+		assert.True(t, netErr.Timeout())
+	}
+
+	resp, _, err = send(t, Rule{Operation: QueryOperation, Kind: Truncate, Rate: 1})
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, `{"valu`, string(body))
+	assert.Error(t, err)
+
+	start := time.Now()
+	resp, sent, err = send(t, Rule{Operation: QueryOperation, Kind: Latency, Latency: 20 * time.Millisecond, Rate: 1})
+	assert.NoError(t, err)
+	assert.True(t, sent)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+}
+
+func TestPurgeWithFaults(t *testing.T) {
+	server := fakestorage.NewServer()
+	defer server.Close()
+	credentials := auth.Credentials{AccountName: "acme", AccountKey: "YWNtZQ==", TableEndpoint: server.URL}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	assert.NoError(t, populator.PopulateTable(credentials, "logs", today.AddDate(0, 0, -9), today, 150, 2))
+
+	// 400s aren't retried by the storage client
+	injector, err := NewInjector(Config{Seed: 7, Rules: []Rule{{Operation: BatchOperation, Kind: Status, Status: http.StatusBadRequest, Rate: 0.5}}})
+	assert.NoError(t, err)
+	credentials.Transport = func(next http.RoundTripper) http.RoundTripper {
+		return Transport(next, injector)
+	}
+	tablePurger, err := purger.NewTablePurger(credentials, "logs", 5, 24, 3, false, false, progress.None, nil, purger.StorageBackend)
+	assert.NoError(t, err)
+	result, err := tablePurger.PurgeEntities()
+	assert.NoError(t, err)
+
+	// the failed batches are counted and their entities are left
+	assert.Equal(t, injector.Counts()[Status], result.BatchErrorCount)
+	assert.True(t, result.BatchErrorCount > 0)
+	assert.Equal(t, 10*150-int(result.RowCount), server.Table("logs").Len())
+}
+
+func TestInjectedStatusIsRetried(t *testing.T) {
+	server := fakestorage.NewServer()
+	defer server.Close()
+	injector, err := NewInjector(Config{Seed: 1, Rules: []Rule{{Operation: TableOperation, Kind: Status, Rate: 0.5}}})
+	assert.NoError(t, err)
+	credentials := auth.Credentials{AccountName: "acme", AccountKey: "YWNtZQ==", TableEndpoint: server.URL}
+	credentials.Transport = func(next http.RoundTripper) http.RoundTripper {
+		return Transport(next, injector)
+	}
+	client, err := credentials.NewClient()
+	assert.NoError(t, err)
+	// the retries of the default sender, without its backoff
+	client.Sender = auth.SenderWithEndpoints(&storage.DefaultSender{
+		RetryAttempts:    10,
+		RetryDuration:    time.Millisecond,
+		ValidStatusCodes: []int{http.StatusServiceUnavailable},
+	}, map[string]*url.URL{auth.TableService: mustParse(t, server.URL)})
+	tableService := client.GetTableService()
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, tableService.GetTableReference(fmt.Sprintf("logs%d", i)).Create(30, storage.MinimalMetadata, nil))
+	}
+	assert.True(t, injector.Counts()[Status] > 0, "503s were injected and retried")
+}
+
+func mustParse(t *testing.T, raw string) *url.URL {
+	u, err := url.Parse(raw)
+	assert.NoError(t, err)
+	return u
+}
@@ -0,0 +1,171 @@
+// Package lock provides mutual exclusion between azp instances using blob leases.
+package lock
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultContainerName container holding the lock blobs
+	DefaultContainerName = "azp-locks"
+	// DefaultLeaseDuration lease duration in seconds. Must be between 15 and 60
+	DefaultLeaseDuration = 60
+)
+
+// ErrAlreadyLocked returned when the lock is held by another instance
+var ErrAlreadyLocked = errors.New("Lock is already held by another instance")
+
+// ErrLost returned when the work protected by the lock was stopped because its lease could not be renewed
+var ErrLost = errors.New("Lock was lost")
+
+// TableLockName name of the lock blob for a table
+func TableLockName(accountName, tableName string) string {
+	return accountName + "/" + tableName
+}
+
+// BlobLock a lock backed by a lease on a blob.
+// Once acquired the lease is renewed in background until released.
+type BlobLock struct {
+	blob          *storage.Blob
+	leaseDuration int
+	leaseID       string
+	stop          chan struct{}
+	lost          chan struct{}
+	wg            sync.WaitGroup
+	mu            sync.Mutex
+}
+
+// NewBlobLock creates a new lock on the blob named name within containerName
+func NewBlobLock(client storage.Client, containerName, name string, leaseDuration int) *BlobLock {
+	blobService := client.GetBlobService()
+	container := blobService.GetContainerReference(containerName)
+	return &BlobLock{
+		blob:          container.GetBlobReference(name),
+		leaseDuration: leaseDuration,
+		lost:          make(chan struct{}),
+	}
+}
+
+// Acquire creates the lock blob if needed and acquires a lease on it.
+// Returns ErrAlreadyLocked if the lease is held by someone else.
+func (l *BlobLock) Acquire() error {
+	if err := l.ensureBlob(); err != nil {
+		return err
+	}
+	leaseID, err := l.blob.AcquireLease(l.leaseDuration, "", nil)
+	if err != nil {
+		if isConflict(err) {
+			return ErrAlreadyLocked
+		}
+		return err
+	}
+	log.Infof("Acquired lock %s/%s", l.blob.Container.Name, l.blob.Name)
+	l.leaseID = leaseID
+	l.stop = make(chan struct{})
+	l.wg.Add(1)
+	go l.renew()
+	return nil
+}
+
+// Lost is closed when the lease could not be renewed
+func (l *BlobLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// IsLost whether the lease could not be renewed
+func (l *BlobLock) IsLost() bool {
+	select {
+	case <-l.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// Context returns a copy of parent which is cancelled when the lock is lost
+func (l *BlobLock) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-l.lost:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Release stops renewing and releases the lease
+func (l *BlobLock) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.leaseID == "" {
+		return nil
+	}
+	close(l.stop)
+	l.wg.Wait()
+	err := l.blob.ReleaseLease(l.leaseID, nil)
+	l.leaseID = ""
+	if err != nil {
+		return err
+	}
+	log.Infof("Released lock %s/%s", l.blob.Container.Name, l.blob.Name)
+	return nil
+}
+
+func (l *BlobLock) ensureBlob() error {
+	container := l.blob.Container
+	if _, err := container.CreateIfNotExists(nil); err != nil {
+		return err
+	}
+	err := l.blob.CreateBlockBlob(&storage.PutBlobOptions{IfNoneMatch: "*"})
+	// the blob exists, 412 when another instance holds its lease
+	if err != nil && !isConflict(err) && !hasStatus(err, http.StatusPreconditionFailed) {
+		return err
+	}
+	return nil
+}
+
+func (l *BlobLock) renew() {
+	defer l.wg.Done()
+	leaseDuration := time.Duration(l.leaseDuration) * time.Second
+	ticker := time.NewTicker(leaseDuration / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if err := l.blob.RenewLease(l.leaseID, nil); err != nil {
+				log.Errorf("Error renewing lock %s/%s. %s", l.blob.Container.Name, l.blob.Name, err)
+				// keep trying while the lease has not expired yet
+				if time.Since(renewed) < leaseDuration && !isConflict(err) {
+					continue
+				}
+				close(l.lost)
+				return
+			}
+			renewed = time.Now()
+			log.Debugf("Renewed lock %s/%s", l.blob.Container.Name, l.blob.Name)
+		}
+	}
+}
+
+func isConflict(err error) bool {
+	return hasStatus(err, http.StatusConflict)
+}
+
+func hasStatus(err error, status int) bool {
+	if serr, ok := err.(storage.AzureStorageServiceError); ok {
+		return serr.StatusCode == status
+	}
+	return false
+}
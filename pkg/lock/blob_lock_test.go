@@ -0,0 +1,58 @@
+package lock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	"github.com/fabito/azure-storage-purger/pkg/fakestorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func newLock(t *testing.T, server *fakestorage.BlobServer, leaseDuration int) *BlobLock {
+	client, err := auth.Credentials{AccountName: "acme", AccountKey: "YWNtZQ==", BlobEndpoint: server.URL}.NewClient()
+	assert.NoError(t, err)
+	return NewBlobLock(client, DefaultContainerName, TableLockName("acme", "logs"), leaseDuration)
+}
+
+func TestAcquireAndRelease(t *testing.T) {
+	server := fakestorage.NewBlobServer()
+	defer server.Close()
+	first, second := newLock(t, server, DefaultLeaseDuration), newLock(t, server, DefaultLeaseDuration)
+
+	assert.NoError(t, first.Acquire())
+	// the leased blob answers 412 to the second lock creating it
+	assert.Equal(t, ErrAlreadyLocked, second.Acquire())
+
+	assert.NoError(t, first.Release())
+	assert.NoError(t, first.Release(), "releasing twice is a no-op")
+	assert.NoError(t, second.Acquire())
+	assert.NoError(t, second.Release())
+	assert.Len(t, server.Blobs(DefaultContainerName), 1)
+}
+
+func TestLost(t *testing.T) {
+	server := fakestorage.NewBlobServer()
+	defer server.Close()
+	// renewed every 333ms
+	l := newLock(t, server, 1)
+	assert.NoError(t, l.Acquire())
+	ctx, cancel := l.Context(context.Background())
+	defer cancel()
+	assert.False(t, l.IsLost())
+
+	server.StealLease(DefaultContainerName, TableLockName("acme", "logs"))
+	select {
+	case <-l.Lost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not lost")
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled")
+	}
+	assert.True(t, l.IsLost())
+	assert.Error(t, l.Release())
+}
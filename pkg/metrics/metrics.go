@@ -3,6 +3,7 @@ package metrics
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -11,8 +12,13 @@ import (
 )
 
 // Metrics contains metrics for azp.
+// Each run has its own registry scoped by table and run ID.
 type Metrics struct {
 	metricsRegistry metrics.Registry
+	Table           string
+	RunID           string
+	finished        chan struct{}
+	chargeMu        sync.Mutex
 }
 
 const (
@@ -25,27 +31,125 @@ const (
 	pageTotal              = "query_page_total"
 	pageSucesssTotal       = "query_page_success_total"
 	pageFailureTotal       = "query_page_failure_total"
-	pageDuration           = "pageDuration"
+	pageDuration           = "query_page_duration"
+	blobPageTotal          = "blob_list_page_total"
+	blobPageFailureTotal   = "blob_list_page_failure_total"
+	blobPageDuration       = "blob_list_page_duration"
+	blobsTotal             = "blobs_total"
+	blobBytesTotal         = "blob_bytes_total"
+	containerTotal         = "container_total"
+	blobDeleteTotal        = "blob_delete_total"
+	blobDeleteFailureTotal = "blob_delete_failure_total"
+	blobDeleteDuration     = "blob_delete_duration"
+	blobsDeletedTotal      = "blobs_deleted_total"
+	blobDeletedBytesTotal  = "blob_deleted_bytes_total"
+	blobBatchTotal         = "blob_batch_total"
+	blobBatchFailureTotal  = "blob_batch_failure_total"
+	blobBatchDuration      = "blob_batch_duration"
+	blobTierTotal          = "blob_tier_total"
+	blobTierFailureTotal   = "blob_tier_failure_total"
+	blobTierDuration       = "blob_tier_duration"
+	blobsTieredTotal       = "blobs_tiered_total"
+	blobTieredBytesTotal   = "blob_tiered_bytes_total"
+	requestChargeTotal     = "request_charge_total"
+	throttledRequestTotal  = "throttled_request_total"
 )
 
-// NewMetrics dafg
-func NewMetrics() *Metrics {
-	metrics.Register(tableBatchTotal, metrics.NewCounter())
-	metrics.Register(tableBatchSuccessTotal, metrics.NewCounter())
-	metrics.Register(tableBatchFailureTotal, metrics.NewCounter())
-	metrics.Register(tableBatchDuration, metrics.NewTimer())
+func newMetrics(table, runID string) *Metrics {
+	m := &Metrics{
+		metricsRegistry: metrics.NewRegistry(),
+		Table:           table,
+		RunID:           runID,
+		finished:        make(chan struct{}),
+	}
+	runs.add(m)
+	return m
+}
 
-	metrics.Register(pageTotal, metrics.NewCounter())
-	metrics.Register(pageSucesssTotal, metrics.NewCounter())
-	metrics.Register(pageFailureTotal, metrics.NewCounter())
-	metrics.Register(pageDuration, metrics.NewTimer())
+// NewMetrics creates the table metrics of a run
+func NewMetrics(table, runID string) *Metrics {
+	m := newMetrics(table, runID)
+	r := m.metricsRegistry
+	r.Register(tableBatchTotal, metrics.NewCounter())
+	r.Register(tableBatchSuccessTotal, metrics.NewCounter())
+	r.Register(tableBatchFailureTotal, metrics.NewCounter())
+	r.Register(tableBatchDuration, metrics.NewTimer())
 
-	metrics.Register(entitiesTotal, metrics.NewMeter())
-	metrics.Register(partitionTotal, metrics.NewMeter())
+	r.Register(pageTotal, metrics.NewCounter())
+	r.Register(pageSucesssTotal, metrics.NewCounter())
+	r.Register(pageFailureTotal, metrics.NewCounter())
+	r.Register(pageDuration, metrics.NewTimer())
 
-	return &Metrics{
-		metricsRegistry: metrics.DefaultRegistry,
-	}
+	r.Register(entitiesTotal, metrics.NewMeter())
+	r.Register(partitionTotal, metrics.NewMeter())
+
+	return m
+}
+
+// NewCosmosMetrics creates the table metrics of a run against the Cosmos DB Table API,
+// which also track the request units charged and the throttled requests
+func NewCosmosMetrics(table, runID string) *Metrics {
+	m := NewMetrics(table, runID)
+	m.metricsRegistry.Register(requestChargeTotal, metrics.NewGaugeFloat64())
+	m.metricsRegistry.Register(throttledRequestTotal, metrics.NewCounter())
+	return m
+}
+
+// NewContainerMetrics creates the metrics of a run processing blob containers
+func NewContainerMetrics(runID string) *Metrics {
+	m := newMetrics("", runID)
+	r := m.metricsRegistry
+	r.Register(blobPageTotal, metrics.NewCounter())
+	r.Register(blobPageFailureTotal, metrics.NewCounter())
+	r.Register(blobPageDuration, metrics.NewTimer())
+	r.Register(blobBytesTotal, metrics.NewCounter())
+	r.Register(containerTotal, metrics.NewCounter())
+
+	r.Register(blobsTotal, metrics.NewMeter())
+
+	return m
+}
+
+// NewBlobPurgeMetrics creates the metrics of a run deleting blobs from containers
+func NewBlobPurgeMetrics(runID string) *Metrics {
+	m := NewContainerMetrics(runID)
+	r := m.metricsRegistry
+	r.Register(blobDeleteTotal, metrics.NewCounter())
+	r.Register(blobDeleteFailureTotal, metrics.NewCounter())
+	r.Register(blobDeleteDuration, metrics.NewTimer())
+	r.Register(blobDeletedBytesTotal, metrics.NewCounter())
+	r.Register(blobBatchTotal, metrics.NewCounter())
+	r.Register(blobBatchFailureTotal, metrics.NewCounter())
+	r.Register(blobBatchDuration, metrics.NewTimer())
+
+	r.Register(blobsDeletedTotal, metrics.NewMeter())
+
+	return m
+}
+
+// NewBlobTierMetrics creates the metrics of a run moving blobs to another access tier
+func NewBlobTierMetrics(runID string) *Metrics {
+	m := NewContainerMetrics(runID)
+	r := m.metricsRegistry
+	r.Register(blobTierTotal, metrics.NewCounter())
+	r.Register(blobTierFailureTotal, metrics.NewCounter())
+	r.Register(blobTierDuration, metrics.NewTimer())
+	r.Register(blobTieredBytesTotal, metrics.NewCounter())
+
+	r.Register(blobsTieredTotal, metrics.NewMeter())
+
+	return m
+}
+
+// Labels the labels identifying the run
+func (m *Metrics) Labels() map[string]string {
+	return map[string]string{"table": m.Table, "run_id": m.RunID}
+}
+
+// Finish marks the run as finished, which stops Log.
+// Finished runs are kept around for a while so their final values can still be exported.
+func (m *Metrics) Finish() {
+	runs.finish(m)
 }
 
 // RegisterTableBatchAttempt
@@ -90,7 +194,7 @@ func (m *Metrics) RegisterPartitionsProcessed(numPartitions int64) {
 	}
 }
 
-func (m Metrics) String() string {
+func (m *Metrics) String() string {
 	scale := time.Millisecond
 	du := float64(scale)
 	duSuffix := scale.String()[1:]
@@ -203,6 +307,244 @@ func (m *Metrics) EntityCount() int64 {
 	return -1
 }
 
+// RegisterRequestCharge adds the request units charged for a request
+func (m *Metrics) RegisterRequestCharge(charge float64) {
+	if g, ok := m.metricsRegistry.Get(requestChargeTotal).(metrics.GaugeFloat64); ok {
+		m.chargeMu.Lock()
+		g.Update(g.Value() + charge)
+		m.chargeMu.Unlock()
+	}
+}
+
+// RegisterThrottledRequest
+func (m *Metrics) RegisterThrottledRequest() {
+	if c, ok := m.metricsRegistry.Get(throttledRequestTotal).(metrics.Counter); ok {
+		c.Inc(1)
+	}
+}
+
+// RequestCharge the request units charged so far, 0 when not tracked
+func (m *Metrics) RequestCharge() float64 {
+	if g, ok := m.metricsRegistry.Get(requestChargeTotal).(metrics.GaugeFloat64); ok {
+		return g.Value()
+	}
+	return 0
+}
+
+// Log logs the metrics every 10 seconds until the run is finished
 func (m *Metrics) Log() {
-	metrics.LogScaled(m.metricsRegistry, 10*time.Second, time.Millisecond, log.StandardLogger())
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	logger := log.WithFields(log.Fields{"table": m.Table, "run_id": m.RunID})
+	for {
+		select {
+		case <-m.finished:
+			return
+		case <-ticker.C:
+			for _, line := range strings.Split(strings.TrimSpace(m.String()), "\n") {
+				logger.Info(line)
+			}
+		}
+	}
+}
+
+// RegisterBlobPageAttempt
+func (m *Metrics) RegisterBlobPageAttempt() {
+	if c, ok := m.metricsRegistry.Get(blobPageTotal).(metrics.Counter); ok {
+		c.Inc(1)
+	}
+}
+
+// RegisterBlobPageFailed
+func (m *Metrics) RegisterBlobPageFailed() {
+	if c, ok := m.metricsRegistry.Get(blobPageFailureTotal).(metrics.Counter); ok {
+		c.Inc(1)
+	}
+}
+
+// RegisterBlobPageDurationSince updates duration since start time
+func (m *Metrics) RegisterBlobPageDurationSince(start time.Time) {
+	if c, ok := m.metricsRegistry.Get(blobPageDuration).(metrics.Timer); ok {
+		c.UpdateSince(start)
+	}
+}
+
+// RegisterBlobProcessed counts a blob and its size
+func (m *Metrics) RegisterBlobProcessed(size int64) {
+	if c, ok := m.metricsRegistry.Get(blobsTotal).(metrics.Meter); ok {
+		c.Mark(1)
+	}
+	if c, ok := m.metricsRegistry.Get(blobBytesTotal).(metrics.Counter); ok {
+		c.Inc(size)
+	}
+}
+
+// RegisterContainerProcessed
+func (m *Metrics) RegisterContainerProcessed() {
+	if c, ok := m.metricsRegistry.Get(containerTotal).(metrics.Counter); ok {
+		c.Inc(1)
+	}
+}
+
+// RegisterBlobDeleteAttempt
+func (m *Metrics) RegisterBlobDeleteAttempt() {
+	if c, ok := m.metricsRegistry.Get(blobDeleteTotal).(metrics.Counter); ok {
+		c.Inc(1)
+	}
+}
+
+// RegisterBlobDeleteFailed
+func (m *Metrics) RegisterBlobDeleteFailed() {
+	if c, ok := m.metricsRegistry.Get(blobDeleteFailureTotal).(metrics.Counter); ok {
+		c.Inc(1)
+	}
+}
+
+// RegisterBlobDeleteDurationSince updates duration since start time
+func (m *Metrics) RegisterBlobDeleteDurationSince(start time.Time) {
+	if c, ok := m.metricsRegistry.Get(blobDeleteDuration).(metrics.Timer); ok {
+		c.UpdateSince(start)
+	}
+}
+
+// RegisterBlobDeleted counts a deleted blob and its size
+func (m *Metrics) RegisterBlobDeleted(size int64) {
+	if c, ok := m.metricsRegistry.Get(blobsDeletedTotal).(metrics.Meter); ok {
+		c.Mark(1)
+	}
+	if c, ok := m.metricsRegistry.Get(blobDeletedBytesTotal).(metrics.Counter); ok {
+		c.Inc(size)
+	}
+}
+
+// RegisterBlobBatchAttempt
+func (m *Metrics) RegisterBlobBatchAttempt() {
+	if c, ok := m.metricsRegistry.Get(blobBatchTotal).(metrics.Counter); ok {
+		c.Inc(1)
+	}
+}
+
+// RegisterBlobBatchFailed counts a blob batch which failed as a whole
+func (m *Metrics) RegisterBlobBatchFailed() {
+	if c, ok := m.metricsRegistry.Get(blobBatchFailureTotal).(metrics.Counter); ok {
+		c.Inc(1)
+	}
+}
+
+// RegisterBlobBatchDurationSince updates duration since start time
+func (m *Metrics) RegisterBlobBatchDurationSince(start time.Time) {
+	if c, ok := m.metricsRegistry.Get(blobBatchDuration).(metrics.Timer); ok {
+		c.UpdateSince(start)
+	}
+}
+
+// RegisterBlobTierAttempt
+func (m *Metrics) RegisterBlobTierAttempt() {
+	if c, ok := m.metricsRegistry.Get(blobTierTotal).(metrics.Counter); ok {
+		c.Inc(1)
+	}
+}
+
+// RegisterBlobTierFailed
+func (m *Metrics) RegisterBlobTierFailed() {
+	if c, ok := m.metricsRegistry.Get(blobTierFailureTotal).(metrics.Counter); ok {
+		c.Inc(1)
+	}
+}
+
+// RegisterBlobTierDurationSince updates duration since start time
+func (m *Metrics) RegisterBlobTierDurationSince(start time.Time) {
+	if c, ok := m.metricsRegistry.Get(blobTierDuration).(metrics.Timer); ok {
+		c.UpdateSince(start)
+	}
+}
+
+// RegisterBlobTiered counts a blob moved to another access tier and its size
+func (m *Metrics) RegisterBlobTiered(size int64) {
+	if c, ok := m.metricsRegistry.Get(blobsTieredTotal).(metrics.Meter); ok {
+		c.Mark(1)
+	}
+	if c, ok := m.metricsRegistry.Get(blobTieredBytesTotal).(metrics.Counter); ok {
+		c.Inc(size)
+	}
+}
+
+// BlobBatchCount the number of blob batches sent so far
+func (m *Metrics) BlobBatchCount() int64 {
+	if c, ok := m.metricsRegistry.Get(blobBatchTotal).(metrics.Counter); ok {
+		return c.Count()
+	}
+	return -1
+}
+
+// BlobCount the number of blobs listed so far
+func (m *Metrics) BlobCount() int64 {
+	if c, ok := m.metricsRegistry.Get(blobsTotal).(metrics.Meter); ok {
+		return c.Count()
+	}
+	return -1
+}
+
+// ContainerCount the number of containers processed so far
+func (m *Metrics) ContainerCount() int64 {
+	if c, ok := m.metricsRegistry.Get(containerTotal).(metrics.Counter); ok {
+		return c.Count()
+	}
+	return -1
+}
+
+// BlobPageErrorCount the number of blob list pages which failed so far
+func (m *Metrics) BlobPageErrorCount() int64 {
+	if c, ok := m.metricsRegistry.Get(blobPageFailureTotal).(metrics.Counter); ok {
+		return c.Count()
+	}
+	return -1
+}
+
+// DeletedBlobCount the number of blobs deleted so far
+func (m *Metrics) DeletedBlobCount() int64 {
+	if c, ok := m.metricsRegistry.Get(blobsDeletedTotal).(metrics.Meter); ok {
+		return c.Count()
+	}
+	return -1
+}
+
+// DeletedBlobBytes the size of the blobs deleted so far
+func (m *Metrics) DeletedBlobBytes() int64 {
+	if c, ok := m.metricsRegistry.Get(blobDeletedBytesTotal).(metrics.Counter); ok {
+		return c.Count()
+	}
+	return -1
+}
+
+// BlobDeleteErrorCount the number of blob deletes which failed so far
+func (m *Metrics) BlobDeleteErrorCount() int64 {
+	if c, ok := m.metricsRegistry.Get(blobDeleteFailureTotal).(metrics.Counter); ok {
+		return c.Count()
+	}
+	return -1
+}
+
+// TieredBlobCount the number of blobs moved to another access tier so far
+func (m *Metrics) TieredBlobCount() int64 {
+	if c, ok := m.metricsRegistry.Get(blobsTieredTotal).(metrics.Meter); ok {
+		return c.Count()
+	}
+	return -1
+}
+
+// TieredBlobBytes the size of the blobs moved to another access tier so far
+func (m *Metrics) TieredBlobBytes() int64 {
+	if c, ok := m.metricsRegistry.Get(blobTieredBytesTotal).(metrics.Counter); ok {
+		return c.Count()
+	}
+	return -1
+}
+
+// BlobTierErrorCount the number of Set Blob Tier requests which failed so far
+func (m *Metrics) BlobTierErrorCount() int64 {
+	if c, ok := m.metricsRegistry.Get(blobTierFailureTotal).(metrics.Counter); ok {
+		return c.Count()
+	}
+	return -1
 }
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rcrowley/go-metrics"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "azp"
+
+// percentiles used to approximate the distribution of timers into histogram buckets
+var percentiles = func() []float64 {
+	ps := make([]float64, 1000)
+	for i := range ps {
+		ps[i] = float64(i+1) / float64(len(ps))
+	}
+	return ps
+}()
+
+// PrometheusCollector translates the metrics of every run in the process into Prometheus metrics.
+// Counters and meters become counters, timers become histograms in seconds.
+// Each run is identified by its table and run_id labels.
+type PrometheusCollector struct {
+	labelNames  []string
+	labelValues []string
+	buckets     []float64
+}
+
+// NewPrometheusCollector creates a collector adding constant labels to every metric
+func NewPrometheusCollector(labels map[string]string) *PrometheusCollector {
+	c := &PrometheusCollector{
+		labelNames: []string{"table", "run_id"},
+		buckets:    prometheus.DefBuckets,
+	}
+	for k, v := range labels {
+		c.labelNames = append(c.labelNames, k)
+		c.labelValues = append(c.labelValues, v)
+	}
+	return c
+}
+
+// Describe implements prometheus.Collector. Sends no descriptors, which makes it an unchecked collector
+// since the available metrics are only known at collection time.
+func (c *PrometheusCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+// Collect implements prometheus.Collector
+func (c *PrometheusCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, run := range runs.all() {
+		c.collectRun(run, ch)
+	}
+}
+
+func (c *PrometheusCollector) collectRun(run *Metrics, ch chan<- prometheus.Metric) {
+	labelValues := append([]string{run.Table, run.RunID}, c.labelValues...)
+	run.metricsRegistry.Each(func(name string, i interface{}) {
+		var m prometheus.Metric
+		var err error
+		switch metric := i.(type) {
+		case metrics.Counter:
+			m, err = prometheus.NewConstMetric(c.desc(name), prometheus.CounterValue, float64(metric.Count()), labelValues...)
+		case metrics.Meter:
+			m, err = prometheus.NewConstMetric(c.desc(name), prometheus.CounterValue, float64(metric.Count()), labelValues...)
+		case metrics.Gauge:
+			m, err = prometheus.NewConstMetric(c.desc(name), prometheus.GaugeValue, float64(metric.Value()), labelValues...)
+		case metrics.GaugeFloat64:
+			// float gauges accumulate totals, like the request units charged
+			m, err = prometheus.NewConstMetric(c.desc(name), prometheus.CounterValue, metric.Value(), labelValues...)
+		case metrics.Timer:
+			t := metric.Snapshot()
+			m, err = prometheus.NewConstHistogram(c.desc(name+"_seconds"), uint64(t.Count()), float64(t.Sum())/float64(time.Second), c.bucketCounts(t), labelValues...)
+		default:
+			return
+		}
+		if err != nil {
+			log.Errorf("Error collecting %s. %s", name, err)
+			return
+		}
+		ch <- m
+	})
+}
+
+func (c *PrometheusCollector) desc(name string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), strings.Replace(name, "_", " ", -1), c.labelNames, nil)
+}
+
+// bucketCounts approximates the cumulative bucket counts from the timer's sampled percentiles
+func (c *PrometheusCollector) bucketCounts(t metrics.Timer) map[float64]uint64 {
+	counts := make(map[float64]uint64, len(c.buckets))
+	ps := t.Percentiles(percentiles)
+	for _, bucket := range c.buckets {
+		bound := bucket * float64(time.Second)
+		n := 0
+		for n < len(ps) && ps[n] <= bound {
+			n++
+		}
+		counts[bucket] = uint64(float64(t.Count()) * float64(n) / float64(len(ps)))
+	}
+	return counts
+}
+
+// ServePrometheus serves the metrics at http://addr/metrics in background
+func ServePrometheus(addr string, labels map[string]string) *http.Server {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewPrometheusCollector(labels))
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		log.Infof("Serving metrics at %s/metrics", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error(err)
+		}
+	}()
+	return server
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func gather(t *testing.T, labels map[string]string) map[string]*dto.MetricFamily {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewPrometheusCollector(labels))
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	byName := make(map[string]*dto.MetricFamily)
+	for _, f := range families {
+		byName[f.GetName()] = f
+	}
+	return byName
+}
+
+// runMetric finds the metric of the run among the metrics of all runs in the process
+func runMetric(family *dto.MetricFamily, runID string) *dto.Metric {
+	if family == nil {
+		return nil
+	}
+	for _, m := range family.GetMetric() {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "run_id" && l.GetValue() == runID {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+func TestPrometheusCollector(t *testing.T) {
+	m := NewMetrics("logs", "prometheus")
+	m.RegisterTableBatchAttempt()
+	m.RegisterTableBatchAttempt()
+	m.RegisterEntitiesProcessed(100)
+	m.RegisterTableBatchDurationSince(time.Now().Add(-200 * time.Millisecond))
+
+	families := gather(t, map[string]string{"account": "acme", "operation": "purge"})
+
+	batches := runMetric(families["azp_table_batch_total"], "prometheus")
+	if assert.NotNil(t, batches) {
+		assert.Equal(t, 2.0, batches.GetCounter().GetValue())
+		assert.Len(t, batches.GetLabel(), 4)
+	}
+
+	entities := runMetric(families["azp_entities_total"], "prometheus")
+	if assert.NotNil(t, entities) {
+		assert.Equal(t, 100.0, entities.GetCounter().GetValue())
+	}
+
+	duration := runMetric(families["azp_table_batch_duration_seconds"], "prometheus")
+	if assert.NotNil(t, duration) {
+		h := duration.GetHistogram()
+		assert.Equal(t, uint64(1), h.GetSampleCount())
+		assert.InDelta(t, 0.2, h.GetSampleSum(), 0.05)
+		for _, b := range h.GetBucket() {
+			if b.GetUpperBound() < 0.2 {
+				assert.Equal(t, uint64(0), b.GetCumulativeCount())
+			} else if b.GetUpperBound() >= 0.5 {
+				assert.Equal(t, uint64(1), b.GetCumulativeCount())
+			}
+		}
+	}
+}
+
+func TestPrometheusRequestCharge(t *testing.T) {
+	m := NewCosmosMetrics("logs", "cosmos")
+	m.RegisterRequestCharge(5.5)
+	m.RegisterRequestCharge(1.25)
+	m.RegisterThrottledRequest()
+	assert.Equal(t, 6.75, m.RequestCharge())
+
+	families := gather(t, map[string]string{"account": "acme", "operation": "purge"})
+	charge := runMetric(families["azp_request_charge_total"], "cosmos")
+	if assert.NotNil(t, charge) {
+		assert.Equal(t, 6.75, charge.GetCounter().GetValue())
+	}
+	throttled := runMetric(families["azp_throttled_request_total"], "cosmos")
+	if assert.NotNil(t, throttled) {
+		assert.Equal(t, 1.0, throttled.GetCounter().GetValue())
+	}
+}
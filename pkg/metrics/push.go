@@ -0,0 +1,259 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/rcrowley/go-metrics"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// statsdMaxPacketSize keeps UDP packets below the usual MTU
+const statsdMaxPacketSize = 1400
+
+var invalidPathChars = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+// Pusher pushes the metrics of all runs in the process to a sink
+type Pusher interface {
+	Push() error
+	Name() string
+}
+
+// Exporter pushes metrics at a fixed interval and once more when stopped
+type Exporter struct {
+	pushers  []Pusher
+	interval time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	once     sync.Once
+}
+
+// NewExporter creates a new Exporter
+func NewExporter(interval time.Duration, pushers ...Pusher) *Exporter {
+	return &Exporter{pushers: pushers, interval: interval, stop: make(chan struct{})}
+}
+
+// Start starts pushing in background
+func (e *Exporter) Start() {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-ticker.C:
+				e.push()
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic push and pushes the final values
+func (e *Exporter) Stop() {
+	e.once.Do(func() {
+		close(e.stop)
+		e.wg.Wait()
+		e.push()
+	})
+}
+
+func (e *Exporter) push() {
+	for _, p := range e.pushers {
+		if err := p.Push(); err != nil {
+			log.Errorf("Error pushing metrics to %s. %s", p.Name(), err)
+		}
+	}
+}
+
+// sample a single value ready to be sent to path based sinks
+type sample struct {
+	path    string
+	value   float64
+	counter bool
+}
+
+// samples flattens the metrics of all runs into paths like prefix.operation.account.table.name.
+// Runs sharing the same path have their counters summed.
+func samples(prefix string, labels map[string]string) []sample {
+	byPath := make(map[string]*sample)
+	add := func(path string, value float64, counter bool) {
+		if s, ok := byPath[path]; ok && counter {
+			s.value += value
+			return
+		}
+		byPath[path] = &sample{path: path, value: value, counter: counter}
+	}
+	for _, run := range runs.all() {
+		base := metricPath(prefix, labels["operation"], labels["account"], run.Table)
+		run.metricsRegistry.Each(func(name string, i interface{}) {
+			path := base + "." + name
+			switch metric := i.(type) {
+			case metrics.Counter:
+				add(path, float64(metric.Count()), true)
+			case metrics.Meter:
+				add(path, float64(metric.Count()), true)
+			case metrics.Gauge:
+				add(path, float64(metric.Value()), false)
+			case metrics.GaugeFloat64:
+				add(path, metric.Value(), true)
+			case metrics.Timer:
+				t := metric.Snapshot()
+				ps := t.Percentiles([]float64{0.5, 0.95, 0.99})
+				ms := float64(time.Millisecond)
+				add(path+".count", float64(t.Count()), true)
+				add(path+".mean_ms", t.Mean()/ms, false)
+				add(path+".median_ms", ps[0]/ms, false)
+				add(path+".p95_ms", ps[1]/ms, false)
+				add(path+".p99_ms", ps[2]/ms, false)
+				add(path+".max_ms", float64(t.Max())/ms, false)
+			}
+		})
+	}
+	result := make([]sample, 0, len(byPath))
+	for _, s := range byPath {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].path < result[j].path })
+	return result
+}
+
+func metricPath(segments ...string) string {
+	parts := make([]string, 0, len(segments))
+	for _, s := range segments {
+		if s != "" {
+			parts = append(parts, invalidPathChars.ReplaceAllString(s, "_"))
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// PushgatewayPusher pushes to a Prometheus Pushgateway
+type PushgatewayPusher struct {
+	url    string
+	pusher *push.Pusher
+}
+
+// NewPushgatewayPusher creates a Pusher replacing the metrics of job on the Pushgateway at url
+func NewPushgatewayPusher(url, job string, labels map[string]string) *PushgatewayPusher {
+	hostname, _ := os.Hostname()
+	p := push.New(url, job).
+		Collector(NewPrometheusCollector(labels)).
+		Grouping("instance", hostname)
+	return &PushgatewayPusher{url: url, pusher: p}
+}
+
+// Name implements Pusher
+func (p *PushgatewayPusher) Name() string {
+	return "pushgateway " + p.url
+}
+
+// Push implements Pusher
+func (p *PushgatewayPusher) Push() error {
+	return p.pusher.Push()
+}
+
+// StatsdPusher sends metrics to a StatsD server over UDP.
+// Counters are sent as deltas since the previous push, everything else as gauges.
+type StatsdPusher struct {
+	addr   string
+	prefix string
+	labels map[string]string
+	last   map[string]float64
+}
+
+// NewStatsdPusher creates a new StatsdPusher
+func NewStatsdPusher(addr, prefix string, labels map[string]string) *StatsdPusher {
+	return &StatsdPusher{addr: addr, prefix: prefix, labels: labels, last: make(map[string]float64)}
+}
+
+// Name implements Pusher
+func (p *StatsdPusher) Name() string {
+	return "statsd " + p.addr
+}
+
+// Push implements Pusher
+func (p *StatsdPusher) Push() error {
+	conn, err := net.Dial("udp", p.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, s := range samples(p.prefix, p.labels) {
+		var line string
+		if s.counter {
+			delta := s.value - p.last[s.path]
+			p.last[s.path] = s.value
+			if delta <= 0 {
+				continue
+			}
+			line = fmt.Sprintf("%s:%g|c", s.path, delta)
+		} else {
+			line = fmt.Sprintf("%s:%g|g", s.path, s.value)
+		}
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > statsdMaxPacketSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	return flush()
+}
+
+// GraphitePusher sends metrics to Graphite using the plaintext protocol
+type GraphitePusher struct {
+	addr   string
+	prefix string
+	labels map[string]string
+}
+
+// NewGraphitePusher creates a new GraphitePusher
+func NewGraphitePusher(addr, prefix string, labels map[string]string) *GraphitePusher {
+	return &GraphitePusher{addr: addr, prefix: prefix, labels: labels}
+}
+
+// Name implements Pusher
+func (p *GraphitePusher) Name() string {
+	return "graphite " + p.addr
+}
+
+// Push implements Pusher
+func (p *GraphitePusher) Push() error {
+	conn, err := net.DialTimeout("tcp", p.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	now := time.Now().Unix()
+	var b bytes.Buffer
+	for _, s := range samples(p.prefix, p.labels) {
+		fmt.Fprintf(&b, "%s %g %d\n", s.path, s.value, now)
+	}
+	_, err = conn.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var pushLabels = map[string]string{"account": "acme", "operation": "purge"}
+
+func TestStatsdPusher(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	m := NewMetrics("statsd", NewRunID())
+	m.RegisterTableBatchSuccess()
+	m.RegisterTableBatchDurationSince(time.Now().Add(-10 * time.Millisecond))
+
+	p := NewStatsdPusher(conn.LocalAddr().String(), "azp", pushLabels)
+	assert.NoError(t, p.Push())
+	lines := readPackets(t, conn)
+	assert.Contains(t, lines, "azp.purge.acme.statsd.table_batch_success_total:1|c")
+	assert.Contains(t, lines, "azp.purge.acme.statsd.table_batch_duration.count:1|c")
+
+	// only the increments since the previous push are sent
+	m.RegisterTableBatchSuccess()
+	assert.NoError(t, p.Push())
+	lines = readPackets(t, conn)
+	assert.Contains(t, lines, "azp.purge.acme.statsd.table_batch_success_total:1|c")
+	assert.NotContains(t, strings.Join(lines, "\n"), "azp.purge.acme.statsd.table_batch_duration.count")
+}
+
+func readPackets(t *testing.T, conn net.PacketConn) []string {
+	var lines []string
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return lines
+		}
+		assert.True(t, n <= statsdMaxPacketSize)
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+func TestGraphitePusher(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		body, _ := ioutil.ReadAll(conn)
+		received <- string(body)
+	}()
+
+	m := NewMetrics("graphite", NewRunID())
+	m.RegisterEntitiesProcessed(42)
+
+	assert.NoError(t, NewGraphitePusher(l.Addr().String(), "azp", pushLabels).Push())
+	body := <-received
+	assert.Contains(t, body, "azp.purge.acme.graphite.entities_total 42 ")
+}
+
+func TestPushgatewayPusher(t *testing.T) {
+	var path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	m := NewMetrics("pushgateway", NewRunID())
+	m.RegisterTableBatchFailed()
+
+	assert.NoError(t, NewPushgatewayPusher(server.URL, "azp", pushLabels).Push())
+	assert.True(t, strings.HasPrefix(path, "/metrics/job/azp/instance/"))
+	assert.Contains(t, body, "azp_table_batch_failure_total")
+}
+
+func TestExporterPushesOnStop(t *testing.T) {
+	p := &countingPusher{}
+	e := NewExporter(time.Hour, p)
+	e.Start()
+	e.Stop()
+	e.Stop()
+	assert.Equal(t, 1, p.count)
+}
+
+type countingPusher struct {
+	count int
+}
+
+func (p *countingPusher) Name() string { return "counting" }
+
+func (p *countingPusher) Push() error {
+	p.count++
+	return nil
+}
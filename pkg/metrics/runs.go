@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// maxFinishedRuns number of finished runs kept in the process-wide registry, so exported as series of their own.
+// The counts of older runs only remain in the totals of Aggregate.
+const maxFinishedRuns = 20
+
+// runs keeps track of the Metrics of all runs in the process
+var runs = &runRegistry{}
+
+type runRegistry struct {
+	sync.Mutex
+	active   []*Metrics
+	finished []*Metrics
+	// evicted the total counts of the finished runs dropped from finished
+	evicted Summary
+}
+
+func (r *runRegistry) add(m *Metrics) {
+	r.Lock()
+	defer r.Unlock()
+	r.active = append(r.active, m)
+}
+
+func (r *runRegistry) finish(m *Metrics) {
+	r.Lock()
+	defer r.Unlock()
+	for i, a := range r.active {
+		if a == m {
+			r.active = append(r.active[:i], r.active[i+1:]...)
+			close(m.finished)
+			r.finished = append(r.finished, m)
+			if len(r.finished) > maxFinishedRuns {
+				for _, evicted := range r.finished[:len(r.finished)-maxFinishedRuns] {
+					r.evicted.add(evicted)
+				}
+				r.finished = r.finished[len(r.finished)-maxFinishedRuns:]
+			}
+			return
+		}
+	}
+}
+
+func (r *runRegistry) all() []*Metrics {
+	r.Lock()
+	defer r.Unlock()
+	all := make([]*Metrics, 0, len(r.active)+len(r.finished))
+	all = append(all, r.finished...)
+	return append(all, r.active...)
+}
+
+// total the counts of the evicted runs plus the runs still registered
+func (r *runRegistry) total() Summary {
+	r.Lock()
+	defer r.Unlock()
+	summary := Summary{Runs: r.evicted.Runs, Counts: make(map[string]int64)}
+	for name, count := range r.evicted.Counts {
+		summary.Counts[name] = count
+	}
+	for _, m := range r.finished {
+		summary.add(m)
+	}
+	for _, m := range r.active {
+		summary.add(m)
+	}
+	return summary
+}
+
+// NewRunID generates a random run ID
+func NewRunID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Summary process-wide view of the counts across all runs
+type Summary struct {
+	Runs   int              `json:"runs"`
+	Counts map[string]int64 `json:"counts"`
+}
+
+// Aggregate sums the counters, meters and timer counts of all runs in the process
+func Aggregate() Summary {
+	return runs.total()
+}
+
+// add adds the counters, meters and timer counts of the run m
+func (s *Summary) add(m *Metrics) {
+	if s.Counts == nil {
+		s.Counts = make(map[string]int64)
+	}
+	s.Runs++
+	m.metricsRegistry.Each(func(name string, i interface{}) {
+		switch metric := i.(type) {
+		case metrics.Counter:
+			s.Counts[name] += metric.Count()
+		case metrics.Meter:
+			s.Counts[name] += metric.Count()
+		case metrics.Timer:
+			s.Counts[name] += metric.Count()
+		}
+	})
+}
+
+func (s Summary) String() string {
+	names := make([]string, 0, len(s.Counts))
+	for name := range s.Counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("%d run(s)\n", s.Runs))
+	for _, name := range names {
+		b.WriteString(fmt.Sprintf("  %-30s %12d\n", name, s.Counts[name]))
+	}
+	return b.String()
+}
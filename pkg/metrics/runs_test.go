@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunsAreIsolated(t *testing.T) {
+	before := Aggregate()
+
+	logs := NewMetrics("logs", NewRunID())
+	audit := NewMetrics("audit", NewRunID())
+	logs.RegisterTableBatchSuccess()
+	logs.RegisterEntitiesProcessed(100)
+	audit.RegisterTableBatchFailed()
+
+	assert.Equal(t, int64(1), logs.BatchCount())
+	assert.Equal(t, int64(0), logs.BatchErrorCount())
+	assert.Equal(t, int64(100), logs.EntityCount())
+	assert.Equal(t, int64(0), audit.BatchCount())
+	assert.Equal(t, int64(1), audit.BatchErrorCount())
+
+	after := Aggregate()
+	assert.Equal(t, before.Runs+2, after.Runs)
+	assert.Equal(t, before.Counts[tableBatchSuccessTotal]+1, after.Counts[tableBatchSuccessTotal])
+	assert.Equal(t, before.Counts[tableBatchFailureTotal]+1, after.Counts[tableBatchFailureTotal])
+	assert.Equal(t, before.Counts[entitiesTotal]+100, after.Counts[entitiesTotal])
+}
+
+func TestFinishedRunsAreCapped(t *testing.T) {
+	for i := 0; i < maxFinishedRuns+5; i++ {
+		m := NewMetrics("logs", NewRunID())
+		m.Finish()
+		m.Log() // returns immediately once finished
+	}
+	assert.Len(t, runs.finished, maxFinishedRuns)
+}
+
+func TestAggregateKeepsEvictedRuns(t *testing.T) {
+	before := Aggregate()
+	for i := 0; i < maxFinishedRuns+5; i++ {
+		m := NewMetrics("logs", NewRunID())
+		m.RegisterTableBatchSuccess()
+		m.RegisterEntitiesProcessed(10)
+		m.Finish()
+	}
+	after := Aggregate()
+	assert.Equal(t, before.Runs+maxFinishedRuns+5, after.Runs)
+	assert.Equal(t, before.Counts[tableBatchSuccessTotal]+maxFinishedRuns+5, after.Counts[tableBatchSuccessTotal])
+	assert.Equal(t, before.Counts[entitiesTotal]+10*(maxFinishedRuns+5), after.Counts[entitiesTotal])
+}
@@ -1,12 +1,15 @@
 package populator
 
 import (
+	"context"
 	"math/rand"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/fabito/azure-storage-purger/pkg/auth"
 	"github.com/fabito/azure-storage-purger/pkg/metrics"
+	"github.com/fabito/azure-storage-purger/pkg/tablestore"
 	"github.com/fabito/azure-storage-purger/pkg/util"
 	"github.com/fabito/azure-storage-purger/pkg/work"
 	log "github.com/sirupsen/logrus"
@@ -31,7 +34,7 @@ type partition struct {
 	entities []*storage.Entity
 }
 
-func randomPartitions(table *storage.Table, maxNumberOfEntitiesPerPartition int, dates chan time.Time) chan *partition {
+func randomPartitions(tableName string, maxNumberOfEntitiesPerPartition int, dates chan time.Time) chan *partition {
 	yield := make(chan *partition)
 	rand.Seed(time.Now().UnixNano())
 	min := 1
@@ -45,14 +48,9 @@ func randomPartitions(table *storage.Table, maxNumberOfEntitiesPerPartition int,
 				key:      partitionKey,
 				entities: make([]*storage.Entity, entitiesPerPartitionCount),
 			}
-			log.Debugf("Adding %d to %s ()", entitiesPerPartitionCount, partitionKey)
+			log.WithFields(log.Fields{util.LogFieldTable: tableName, util.LogFieldPartitionKey: partitionKey}).Debugf("Adding %d entities", entitiesPerPartitionCount)
 			for i := 0; i < entitiesPerPartitionCount; i++ {
-				e := table.GetEntityReference(partitionKey, strconv.Itoa(i+1))
-				props := map[string]interface{}{
-					"CreatedOn": m,
-				}
-				e.Properties = props
-				p.entities[i] = e
+				p.entities[i] = entity(partitionKey, i+1, m)
 			}
 			yield <- p
 		}
@@ -60,7 +58,7 @@ func randomPartitions(table *storage.Table, maxNumberOfEntitiesPerPartition int,
 	return yield
 }
 
-func partitions(table *storage.Table, metrics *metrics.Metrics, maxNumberOfEntitiesPerPartition int, dates chan time.Time) chan *partition {
+func partitions(tableName string, metrics *metrics.Metrics, maxNumberOfEntitiesPerPartition int, dates chan time.Time) chan *partition {
 	yield := make(chan *partition)
 	go func() {
 		defer close(yield)
@@ -70,14 +68,9 @@ func partitions(table *storage.Table, metrics *metrics.Metrics, maxNumberOfEntit
 				key:      partitionKey,
 				entities: make([]*storage.Entity, maxNumberOfEntitiesPerPartition),
 			}
-			log.Debugf("Adding %d entities to %s (%s)", maxNumberOfEntitiesPerPartition, partitionKey, m)
+			log.WithFields(log.Fields{util.LogFieldTable: tableName, util.LogFieldPartitionKey: partitionKey}).Debugf("Adding %d entities (%s)", maxNumberOfEntitiesPerPartition, m)
 			for i := 0; i < maxNumberOfEntitiesPerPartition; i++ {
-				e := table.GetEntityReference(partitionKey, strconv.Itoa(i+1))
-				props := map[string]interface{}{
-					"CreatedOn": m,
-				}
-				e.Properties = props
-				p.entities[i] = e
+				p.entities[i] = entity(partitionKey, i+1, m)
 			}
 			yield <- p
 			metrics.RegisterPartitionsProcessed(1)
@@ -86,44 +79,25 @@ func partitions(table *storage.Table, metrics *metrics.Metrics, maxNumberOfEntit
 	return yield
 }
 
-func batchesFromPartition(table *storage.Table, p *partition) []*storage.TableBatch {
-	chunkSize := 100
-	entities := p.entities
-	count := len(entities)
-	batches := make([]*storage.TableBatch, 0)
-	for i := 0; i < count; i += chunkSize {
-		end := i + chunkSize
-		if end > count {
-			end = count
-		}
-		tableBatch := table.NewBatch()
-		for _, entity := range entities[i:end] {
-			tableBatch.InsertOrMergeEntityByForce(entity)
-		}
-		batches = append(batches, tableBatch)
+// entity a dummy entity created on the given date
+func entity(partitionKey string, rowKey int, createdOn time.Time) *storage.Entity {
+	return &storage.Entity{
+		PartitionKey: partitionKey,
+		RowKey:       strconv.Itoa(rowKey),
+		Properties: map[string]interface{}{
+			"CreatedOn": createdOn,
+		},
 	}
-	return batches
 }
 
-func batches(table *storage.Table, partitions chan *partition) chan *storage.TableBatch {
-	yield := make(chan *storage.TableBatch)
-	chunkSize := 100
+func batches(partitions chan *partition) chan *tablestore.Batch {
+	yield := make(chan *tablestore.Batch)
 
 	go func() {
 		defer close(yield)
 		for p := range partitions {
-			entities := p.entities
-			count := len(entities)
-			for i := 0; i < count; i += chunkSize {
-				end := i + chunkSize
-				if end > count {
-					end = count
-				}
-				tableBatch := table.NewBatch()
-				for _, entity := range entities[i:end] {
-					tableBatch.InsertOrMergeEntityByForce(entity)
-				}
-				yield <- tableBatch
+			for _, batch := range tablestore.Batches(p.key, p.entities) {
+				yield <- batch
 			}
 		}
 	}()
@@ -131,8 +105,8 @@ func batches(table *storage.Table, partitions chan *partition) chan *storage.Tab
 	return yield
 }
 
-func createTable(storageAccountName, storageAccountKey, tableName string) (*storage.Table, error) {
-	client, err := storage.NewBasicClient(storageAccountName, storageAccountKey)
+func createTable(credentials auth.Credentials, tableName string) (tablestore.Store, error) {
+	client, err := credentials.NewClient()
 	if err != nil {
 		return nil, err
 	}
@@ -141,24 +115,17 @@ func createTable(storageAccountName, storageAccountKey, tableName string) (*stor
 		client.Sender = util.SenderWithLogging(client.Sender)
 	}
 
-	tableService := client.GetTableService()
-	table := tableService.GetTableReference(tableName)
-
-	if err := table.Get(5, storage.MinimalMetadata); err != nil {
-		log.Infof("Table %s doesn't exist. Creating...", tableName)
-		options := &storage.TableOptions{}
-		err := table.Create(5, storage.MinimalMetadata, options)
-		if err != nil {
-			log.Errorf("Error creating table %s", tableName)
-			return nil, err
-		}
+	store := tablestore.NewAzureStore(client, tableName)
+	if err := store.CreateIfNotExists(context.Background()); err != nil {
+		util.WithError(log.WithField(util.LogFieldTable, tableName), err).Error("Error creating table")
+		return nil, err
 	}
-
-	return table, nil
+	return store, nil
 }
 
 type tableBatchRunner struct {
-	batch   *storage.TableBatch
+	store   tablestore.Store
+	batch   *tablestore.Batch
 	metrics *metrics.Metrics
 }
 
@@ -166,12 +133,12 @@ type tableBatchRunner struct {
 func (t *tableBatchRunner) Task() {
 	t.metrics.RegisterTableBatchAttempt()
 	start := time.Now()
-	err := t.batch.ExecuteBatch()
+	err := t.store.UpsertBatch(context.Background(), t.batch)
 	if err != nil {
 		t.metrics.RegisterTableBatchFailed()
-		log.Error(err)
+		util.WithError(log.WithField(util.LogFieldTable, t.store.Name()).WithFields(util.BatchLogFields(t.batch.PartitionKey, t.batch.Size())), err).Error("Error executing table batch")
 	} else {
-		t.metrics.RegisterEntitiesProcessed(int64(len(t.batch.BatchEntitySlice)))
+		t.metrics.RegisterEntitiesProcessed(int64(t.batch.Size()))
 		t.metrics.RegisterTableBatchDurationSince(start)
 		t.metrics.RegisterTableBatchSuccess()
 	}
@@ -180,19 +147,19 @@ func (t *tableBatchRunner) Task() {
 type tablePartitionRunner struct {
 	partition *partition
 	metrics   *metrics.Metrics
-	table     *storage.Table
+	store     tablestore.Store
 }
 
 func (t *tablePartitionRunner) Task() {
-	for _, batch := range batchesFromPartition(t.table, t.partition) {
+	for _, batch := range tablestore.Batches(t.partition.key, t.partition.entities) {
 		t.metrics.RegisterTableBatchAttempt()
 		start := time.Now()
-		err := batch.ExecuteBatch()
+		err := t.store.UpsertBatch(context.Background(), batch)
 		if err != nil {
-			log.Error(err)
+			util.WithError(log.WithField(util.LogFieldTable, t.store.Name()).WithFields(util.BatchLogFields(batch.PartitionKey, batch.Size())), err).Error("Error executing table batch")
 			t.metrics.RegisterTableBatchFailed()
 		} else {
-			t.metrics.RegisterEntitiesProcessed(int64(len(batch.BatchEntitySlice)))
+			t.metrics.RegisterEntitiesProcessed(int64(batch.Size()))
 			t.metrics.RegisterTableBatchDurationSince(start)
 			t.metrics.RegisterTableBatchSuccess()
 		}
@@ -200,20 +167,26 @@ func (t *tablePartitionRunner) Task() {
 }
 
 // PopulateTable populates table with dummy test data
-func PopulateTable(storageAccountName, storageAccountKey, tableName string, startDate, endDate time.Time, maxNumberOfEntitiesPerPartition, numWorkers int) error {
-	table, err := createTable(storageAccountName, storageAccountKey, tableName)
+func PopulateTable(credentials auth.Credentials, tableName string, startDate, endDate time.Time, maxNumberOfEntitiesPerPartition, numWorkers int) error {
+	store, err := createTable(credentials, tableName)
 	if err != nil {
 		return err
 	}
+	return PopulateStore(store, startDate, endDate, maxNumberOfEntitiesPerPartition, numWorkers)
+}
 
-	metrics := metrics.NewMetrics()
-	log.Infof("Start %s population.", tableName)
+// PopulateStore populates the table of store with a partition of dummy test data per day
+func PopulateStore(store tablestore.Store, startDate, endDate time.Time, maxNumberOfEntitiesPerPartition, numWorkers int) error {
+	tableName := store.Name()
+	metrics := metrics.NewMetrics(tableName, metrics.NewRunID())
+	logger := log.WithFields(log.Fields{util.LogFieldTable: tableName, "run_id": metrics.RunID})
+	logger.Info("Start population.")
 	p := work.New(numWorkers)
 	var wg sync.WaitGroup
 	go metrics.Log()
-	for partition := range partitions(table, metrics, maxNumberOfEntitiesPerPartition, dates(startDate, endDate)) {
+	for partition := range partitions(tableName, metrics, maxNumberOfEntitiesPerPartition, dates(startDate, endDate)) {
 		wg.Add(1)
-		job := tablePartitionRunner{metrics: metrics, partition: partition, table: table}
+		job := tablePartitionRunner{metrics: metrics, partition: partition, store: store}
 		go func() {
 			p.Run(&job)
 			wg.Done()
@@ -224,7 +197,8 @@ func PopulateTable(storageAccountName, storageAccountKey, tableName string, star
 	// Shutdown the work pool and wait for all existing work
 	// to be completed.
 	p.Shutdown()
-	log.Info("Summary")
-	log.Info(metrics)
+	metrics.Finish()
+	logger.Info("Summary")
+	logger.Info(metrics)
 	return nil
 }
@@ -0,0 +1,23 @@
+package populator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/tablestore"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPopulateStore(t *testing.T) {
+	store := tablestore.NewMemoryStore("logs")
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := PopulateStore(store, start, start.AddDate(0, 0, 2), 150, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3*150, store.Len())
+
+	e := store.Get(util.TicksAscendingWithLeadingZero(util.TicksFromTime(start.AddDate(0, 0, 1))), "150")
+	if assert.NotNil(t, e) {
+		assert.Equal(t, start.AddDate(0, 0, 1), e.Properties["CreatedOn"])
+	}
+}
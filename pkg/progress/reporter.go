@@ -0,0 +1,179 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Mode how progress is reported
+type Mode string
+
+const (
+	// Auto draws bars when stderr is a terminal and logs otherwise
+	Auto Mode = "auto"
+	// Bar redraws a progress bar per split on stderr
+	Bar Mode = "bar"
+	// Log logs a single line periodically
+	Log Mode = "log"
+	// None disables progress reporting
+	None Mode = "none"
+)
+
+const (
+	barWidth      = 30
+	maxSplitLines = 20
+	barInterval   = time.Second
+	logInterval   = 10 * time.Second
+	timeLayout    = "2006-01-02 15:04"
+)
+
+// ParseMode parses a progress Mode
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case Auto, Bar, Log, None:
+		return m, nil
+	}
+	return None, fmt.Errorf("invalid progress mode %q. Expected one of auto, bar, log or none", s)
+}
+
+// Reporter periodically reports the progress of a Tracker
+type Reporter struct {
+	tracker *Tracker
+	mode    Mode
+	out     io.Writer
+	logger  *log.Entry
+	lines   int
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+// NewReporter creates a new Reporter. Auto is resolved by checking whether stderr is a terminal.
+func NewReporter(tracker *Tracker, mode Mode, logger *log.Entry) *Reporter {
+	if mode == Auto {
+		mode = Log
+		if isTerminal(os.Stderr) {
+			mode = Bar
+		}
+	}
+	return &Reporter{tracker: tracker, mode: mode, out: os.Stderr, logger: logger, stop: make(chan struct{})}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Start starts reporting in background
+func (r *Reporter) Start() {
+	if r.mode == None {
+		return
+	}
+	interval := logInterval
+	if r.mode == Bar {
+		interval = barInterval
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.report()
+			}
+		}
+	}()
+}
+
+// Stop stops reporting and reports the final progress
+func (r *Reporter) Stop() {
+	if r.mode == None {
+		return
+	}
+	r.once.Do(func() {
+		close(r.stop)
+		r.wg.Wait()
+		r.report()
+	})
+}
+
+func (r *Reporter) report() {
+	if r.mode == Bar {
+		r.draw()
+		return
+	}
+	overall := r.tracker.Overall()
+	r.logger.Info(line("progress", overall))
+	if log.IsLevelEnabled(log.DebugLevel) {
+		for i, s := range r.tracker.Splits() {
+			if s.Started && !s.Completed {
+				r.logger.Debug(line(fmt.Sprintf("#%02d", i), s))
+			}
+		}
+	}
+}
+
+// draw redraws the bars over the previously drawn ones
+func (r *Reporter) draw() {
+	var b strings.Builder
+	if r.lines > 0 {
+		fmt.Fprintf(&b, "\033[%dA", r.lines)
+	}
+	lines := []string{line("overall", r.tracker.Overall())}
+	hidden := 0
+	for i, s := range r.tracker.Splits() {
+		if !s.Started || s.Completed {
+			continue
+		}
+		if len(lines) > maxSplitLines {
+			hidden++
+			continue
+		}
+		lines = append(lines, line(fmt.Sprintf("#%02d %s", i, s.Period.Start.Format(timeLayout)), s))
+	}
+	if hidden > 0 {
+		lines = append(lines, fmt.Sprintf("... %d more splits running", hidden))
+	}
+	// clear the lines left over from a previous, taller, frame
+	for len(lines) < r.lines {
+		lines = append(lines, "")
+	}
+	for _, l := range lines {
+		b.WriteString("\r\033[K")
+		b.WriteString(l)
+		b.WriteString("\n")
+	}
+	r.lines = len(lines)
+	io.WriteString(r.out, b.String())
+}
+
+func line(name string, s Status) string {
+	eta := "ETA unknown"
+	if s.Completed {
+		eta = "done"
+	} else if s.ETA >= 0 {
+		eta = "ETA " + s.ETA.Round(time.Second).String()
+	}
+	return fmt.Sprintf("%-22s %s %5.1f%% %10.1f entities/s  %s", name, bar(s.Fraction), s.Fraction*100, s.Rate, eta)
+}
+
+func bar(fraction float64) string {
+	filled := int(fraction * barWidth)
+	if filled > barWidth {
+		filled = barWidth
+	}
+	if filled < 0 {
+		filled = 0
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", barWidth-filled) + "]"
+}
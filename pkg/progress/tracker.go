@@ -0,0 +1,140 @@
+// Package progress tracks and reports how far a purge is, based on the partition keys processed by each split.
+package progress
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/util"
+)
+
+// Tracker keeps the position of each split within its Period.
+// Partition keys map to time so the position is the time of the last partition key processed.
+type Tracker struct {
+	sync.Mutex
+	start  time.Time
+	splits []*split
+}
+
+type split struct {
+	period    util.Period
+	position  time.Time
+	initial   float64
+	started   time.Time
+	entities  int64
+	completed bool
+}
+
+// Status progress of a split or of the whole run
+type Status struct {
+	Period    util.Period
+	Fraction  float64
+	Entities  int64
+	Rate      float64
+	ETA       time.Duration
+	Started   bool
+	Completed bool
+}
+
+// NewTracker creates a Tracker for the splits of a run
+func NewTracker(periods []util.Period) *Tracker {
+	t := &Tracker{start: time.Now()}
+	for _, p := range periods {
+		t.splits = append(t.splits, &split{period: p, position: p.Start})
+	}
+	return t
+}
+
+// Advance records that entities up to partitionKey were processed by the split at index i
+func (t *Tracker) Advance(i int, partitionKey string, entities int64) {
+	t.Lock()
+	defer t.Unlock()
+	s := t.splits[i]
+	position := util.TimeFromTicksAscendingWithLeadingZero(partitionKey)
+	if position.After(s.period.End) {
+		position = s.period.End
+	}
+	if s.started.IsZero() {
+		s.started = time.Now()
+		s.initial = s.fraction()
+	}
+	if position.After(s.position) {
+		s.position = position
+	}
+	s.entities += entities
+}
+
+// Complete marks the split at index i as completed
+func (t *Tracker) Complete(i int) {
+	t.Lock()
+	defer t.Unlock()
+	s := t.splits[i]
+	if s.started.IsZero() {
+		s.started = time.Now()
+	}
+	s.position = s.period.End
+	s.completed = true
+}
+
+func (s *split) fraction() float64 {
+	total := s.period.Duration()
+	if total <= 0 || s.completed {
+		return 1
+	}
+	return float64(s.position.Sub(s.period.Start)) / float64(total)
+}
+
+// Splits returns the status of each split
+func (t *Tracker) Splits() []Status {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	statuses := make([]Status, len(t.splits))
+	for i, s := range t.splits {
+		statuses[i] = Status{Period: s.period, Entities: s.entities, Fraction: s.fraction(), Completed: s.completed, Started: !s.started.IsZero()}
+		if statuses[i].Started {
+			statuses[i].Rate, statuses[i].ETA = estimate(now.Sub(s.started), s.entities, s.initial, statuses[i].Fraction)
+		}
+	}
+	return statuses
+}
+
+// Overall returns the status of the whole run, weighting each split by the length of its Period
+func (t *Tracker) Overall() Status {
+	t.Lock()
+	defer t.Unlock()
+	status := Status{Started: true, Completed: true}
+	var total, done float64
+	for _, s := range t.splits {
+		d := float64(s.period.Duration())
+		total += d
+		done += d * s.fraction()
+		status.Entities += s.entities
+		status.Completed = status.Completed && s.completed
+	}
+	if len(t.splits) > 0 {
+		status.Period = util.Period{Start: t.splits[0].period.Start, End: t.splits[len(t.splits)-1].period.End}
+	}
+	status.Fraction = 1
+	if total > 0 {
+		status.Fraction = done / total
+	}
+	status.Rate, status.ETA = estimate(time.Since(t.start), status.Entities, 0, status.Fraction)
+	return status
+}
+
+// estimate the entities per second and the remaining time assuming the progress made since initial continues at the same pace.
+// The ETA is negative when unknown.
+func estimate(elapsed time.Duration, entities int64, initial, fraction float64) (float64, time.Duration) {
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(entities) / elapsed.Seconds()
+	}
+	if fraction >= 1 {
+		return rate, 0
+	}
+	if fraction <= initial {
+		return rate, -1
+	}
+	return rate, time.Duration(float64(elapsed) * (1 - fraction) / (fraction - initial))
+}
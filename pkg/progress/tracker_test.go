@@ -0,0 +1,82 @@
+package progress
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func partitionKey(t time.Time) string {
+	return util.TicksAscendingWithLeadingZero(util.TicksFromTime(t))
+}
+
+func TestTrackerProgress(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	period, _ := util.NewPeriod(start, start.Add(40*time.Hour))
+	splits := period.Split(10 * time.Hour)
+	tracker := NewTracker(splits)
+
+	assert.Equal(t, 0.0, tracker.Overall().Fraction)
+
+	tracker.Advance(0, partitionKey(start.Add(5*time.Hour)), 100)
+	tracker.Advance(0, partitionKey(start.Add(time.Hour)), 100) // never goes backwards
+	tracker.Complete(3)
+
+	statuses := tracker.Splits()
+	assert.InDelta(t, 0.5, statuses[0].Fraction, 0.001)
+	assert.Equal(t, int64(200), statuses[0].Entities)
+	assert.True(t, statuses[0].Started)
+	assert.False(t, statuses[1].Started)
+	assert.True(t, statuses[3].Completed)
+
+	overall := tracker.Overall()
+	assert.InDelta(t, 0.375, overall.Fraction, 0.001)
+	assert.False(t, overall.Completed)
+	assert.True(t, overall.ETA > 0)
+
+	for i := range splits {
+		tracker.Complete(i)
+	}
+	overall = tracker.Overall()
+	assert.True(t, overall.Completed)
+	assert.Equal(t, time.Duration(0), overall.ETA)
+}
+
+func TestEstimate(t *testing.T) {
+	rate, eta := estimate(10*time.Second, 500, 0.2, 0.6)
+	assert.Equal(t, 50.0, rate)
+	assert.Equal(t, 10*time.Second, eta)
+
+	_, eta = estimate(10*time.Second, 0, 0.2, 0.2)
+	assert.True(t, eta < 0)
+}
+
+func TestReporterDrawsOverPreviousFrame(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tracker := NewTracker([]util.Period{{Start: start, End: start.Add(time.Hour)}})
+	tracker.Advance(0, partitionKey(start.Add(30*time.Minute)), 10)
+
+	var out bytes.Buffer
+	r := &Reporter{tracker: tracker, mode: Bar, out: &out}
+	r.draw()
+	assert.Equal(t, 2, r.lines)
+	assert.Contains(t, out.String(), " 50.0%")
+
+	out.Reset()
+	tracker.Complete(0)
+	r.draw()
+	assert.True(t, strings.HasPrefix(out.String(), "\033[2A"))
+	assert.Contains(t, out.String(), "100.0%")
+}
+
+func TestParseMode(t *testing.T) {
+	m, err := ParseMode("log")
+	assert.NoError(t, err)
+	assert.Equal(t, Log, m)
+	_, err = ParseMode("fancy")
+	assert.Error(t, err)
+}
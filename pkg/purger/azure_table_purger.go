@@ -1,17 +1,27 @@
 package purger
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/fabito/azure-storage-purger/pkg/audit"
+	"github.com/fabito/azure-storage-purger/pkg/auth"
 	"github.com/fabito/azure-storage-purger/pkg/metrics"
+	"github.com/fabito/azure-storage-purger/pkg/progress"
+	"github.com/fabito/azure-storage-purger/pkg/tablestore"
+	"github.com/fabito/azure-storage-purger/pkg/tracing"
 	"github.com/fabito/azure-storage-purger/pkg/util"
 	"github.com/fabito/azure-storage-purger/pkg/work"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/Azure/azure-sdk-for-go/storage"
 )
@@ -22,12 +32,15 @@ const (
 
 // PurgeResult details and metrics about the purge operation
 type PurgeResult struct {
-	PageCount       int64     `json:"page_count"`
-	PartitionCount  int64     `json:"partition_count"`
-	RowCount        int64     `json:"row_count"`
-	BatchCount      int64     `json:"batch_count"`
-	BatchErrorCount int64     `json:"batch_error_count"`
-	RowErrorCount   int64     `json:"row_error_count"`
+	PageCount       int64 `json:"page_count"`
+	PartitionCount  int64 `json:"partition_count"`
+	RowCount        int64 `json:"row_count"`
+	BatchCount      int64 `json:"batch_count"`
+	BatchErrorCount int64 `json:"batch_error_count"`
+	RowErrorCount   int64 `json:"row_error_count"`
+	// AuditErrorCount the batches deleted but missing from the audit log
+	AuditErrorCount int64     `json:"audit_error_count,omitempty"`
+	RequestCharge   float64   `json:"request_charge,omitempty"`
 	StartTime       time.Time `json:"start_time"`
 	EndTime         time.Time `json:"end_time"`
 }
@@ -41,6 +54,7 @@ func (p *PurgeResult) end(metrics *metrics.Metrics) {
 	p.BatchCount = metrics.BatchCount()
 	p.BatchErrorCount = metrics.BatchErrorCount()
 	p.RowCount = metrics.EntityCount()
+	p.RequestCharge = metrics.RequestCharge()
 }
 
 func (p *PurgeResult) computeTableBatchResult(result *TableBatchResult) {
@@ -52,15 +66,40 @@ func (p *PurgeResult) computeTableBatchResult(result *TableBatchResult) {
 	// }
 }
 
+// Add accumulates the counts of another result. Keeps the earliest start and latest end times.
+func (p *PurgeResult) Add(other PurgeResult) {
+	p.PageCount += other.PageCount
+	p.PartitionCount += other.PartitionCount
+	p.RowCount += other.RowCount
+	p.BatchCount += other.BatchCount
+	p.BatchErrorCount += other.BatchErrorCount
+	p.RowErrorCount += other.RowErrorCount
+	p.AuditErrorCount += other.AuditErrorCount
+	p.RequestCharge += other.RequestCharge
+	if p.StartTime.IsZero() || (!other.StartTime.IsZero() && other.StartTime.Before(p.StartTime)) {
+		p.StartTime = other.StartTime
+	}
+	if other.EndTime.After(p.EndTime) {
+		p.EndTime = other.EndTime
+	}
+}
+
 // HasErrors whether or not any error occurred during the purge job
 func (p *PurgeResult) HasErrors() bool {
-	return p.BatchErrorCount > 0
+	return p.BatchErrorCount > 0 || p.AuditErrorCount > 0
 }
 
 // AzureTablePurger purges entities from Storage Tables
 type AzureTablePurger interface {
 	PurgeEntities() (PurgeResult, error)
+	// PurgeEntitiesContext purges like PurgeEntities, stopping when ctx is cancelled
+	PurgeEntitiesContext(ctx context.Context) (PurgeResult, error)
 	PurgeEntitiesWithin(period *util.Period) (PurgeResult, error)
+	// PurgeEntitiesWithinContext purges like PurgeEntitiesWithin, stopping when ctx is cancelled
+	PurgeEntitiesWithinContext(ctx context.Context, period *util.Period) (PurgeResult, error)
+	PurgePeriod() (*util.Period, error)
+	// Finish ends the run of the purger, which no longer counts as active in the metrics. Safe to call more than once.
+	Finish()
 }
 
 // DefaultTablePurger default table purger
@@ -69,15 +108,20 @@ type DefaultTablePurger struct {
 	purgeEntitiesOlderThanDays int
 	periodLengthInHours        int
 	numWorkers                 int
-	table                      *storage.Table
+	store                      tablestore.Store
 	usePool                    bool
 	dryRun                     bool
+	progressMode               progress.Mode
+	progress                   *progress.Tracker
+	auditLog                   *audit.Log
+	backend                    Backend
 	result                     PurgeResult
+	auditErrorCount            int64
+	logger                     *log.Entry
 	Metrics                    *metrics.Metrics
 }
 
-// NewTablePurgerWithClient creates a new Basic Purger
-func NewTablePurgerWithClient(client storage.Client, accountName, accountKey, tableName string, purgeEntitiesOlderThanDays, periodLengthInHours, numWorkers int, usePool, dryRun bool) (AzureTablePurger, error) {
+func newTablePurger(tableName string, purgeEntitiesOlderThanDays, periodLengthInHours, numWorkers int, usePool, dryRun bool, progressMode progress.Mode, auditLog *audit.Log, backend Backend) *DefaultTablePurger {
 	purger := &DefaultTablePurger{
 		tableName:                  tableName,
 		purgeEntitiesOlderThanDays: purgeEntitiesOlderThanDays,
@@ -85,43 +129,63 @@ func NewTablePurgerWithClient(client storage.Client, accountName, accountKey, ta
 		numWorkers:                 numWorkers,
 		dryRun:                     dryRun,
 		usePool:                    usePool,
-		Metrics:                    metrics.NewMetrics(),
+		progressMode:               progressMode,
+		auditLog:                   auditLog,
+		backend:                    backend,
+		logger:                     log.WithField(util.LogFieldTable, tableName),
+	}
+	if backend == CosmosBackend {
+		purger.Metrics = metrics.NewCosmosMetrics(tableName, metrics.NewRunID())
+	} else {
+		purger.Metrics = metrics.NewMetrics(tableName, metrics.NewRunID())
+	}
+	return purger
+}
+
+// NewTablePurgerWithStore creates a new Basic Purger of the table of store
+func NewTablePurgerWithStore(store tablestore.Store, purgeEntitiesOlderThanDays, periodLengthInHours, numWorkers int, usePool, dryRun bool, progressMode progress.Mode, auditLog *audit.Log, backend Backend) (AzureTablePurger, error) {
+	purger := newTablePurger(store.Name(), purgeEntitiesOlderThanDays, periodLengthInHours, numWorkers, usePool, dryRun, progressMode, auditLog, backend)
+	purger.store = store
+	return purger, nil
+}
+
+// NewTablePurgerWithClient creates a new Basic Purger
+func NewTablePurgerWithClient(client storage.Client, accountName, accountKey, tableName string, purgeEntitiesOlderThanDays, periodLengthInHours, numWorkers int, usePool, dryRun bool, progressMode progress.Mode, auditLog *audit.Log, backend Backend) (AzureTablePurger, error) {
+	purger := newTablePurger(tableName, purgeEntitiesOlderThanDays, periodLengthInHours, numWorkers, usePool, dryRun, progressMode, auditLog, backend)
+	if backend == CosmosBackend {
+		client.HTTPClient = newCosmosHTTPClient(client.HTTPClient, purger.Metrics)
 	}
 	if log.IsLevelEnabled(log.TraceLevel) {
 		client.Sender = util.SenderWithLogging(client.Sender)
 	}
-	tableService := client.GetTableService()
-	table := tableService.GetTableReference(purger.tableName)
-	purger.table = table
-
+	purger.store = tablestore.NewAzureStore(client, tableName)
 	return purger, nil
 }
 
 // NewTablePurger creates a new Basic Purger
-func NewTablePurger(accountName, accountKey, tableName string, purgeEntitiesOlderThanDays, periodLengthInHours, numWorkers int, usePool, dryRun bool) (AzureTablePurger, error) {
+func NewTablePurger(credentials auth.Credentials, tableName string, purgeEntitiesOlderThanDays, periodLengthInHours, numWorkers int, usePool, dryRun bool, progressMode progress.Mode, auditLog *audit.Log, backend Backend) (AzureTablePurger, error) {
 
-	// NewClientFromConnectionString
-	client, err := storage.NewBasicClient(accountName, accountKey)
+	client, err := credentials.NewClient()
 	if err != nil {
 		return nil, err
 	}
-	return NewTablePurgerWithClient(client, accountName, accountKey, tableName, purgeEntitiesOlderThanDays, periodLengthInHours, numWorkers, usePool, dryRun)
+	return NewTablePurgerWithClient(client, credentials.Account(), credentials.AccountKey, tableName, purgeEntitiesOlderThanDays, periodLengthInHours, numWorkers, usePool, dryRun, progressMode, auditLog, backend)
 }
 
 // QueryResult groups 2 query possible outcomes
 type QueryResult struct {
-	Error             error
-	EntityQueryResult *storage.EntityQueryResult
+	Error error
+	Page  *tablestore.Page
 }
 
 // TableBatchResult holds the result of a batch operation
 type TableBatchResult struct {
 	Error error
-	Batch *storage.TableBatch
+	Batch *tablestore.Batch
 }
 
 func (t *TableBatchResult) batchSize() int64 {
-	return int64(len(t.Batch.BatchEntitySlice))
+	return int64(t.Batch.Size())
 }
 
 // Partition contains the entities grouped by partition
@@ -131,70 +195,100 @@ type Partition struct {
 }
 
 type batchProcessor struct {
-	input   <-chan *storage.TableBatch
-	metrics *metrics.Metrics
-	dryRun  bool
+	input     <-chan *tablestore.Batch
+	execute   func(*tablestore.Batch) error
+	processed func(batch *tablestore.Batch, deleted int64)
+	finished  func()
+	metrics   *metrics.Metrics
+	logger    *log.Entry
+	dryRun    bool
 }
 
 func (t *batchProcessor) Task() {
 	for batch := range t.input {
 		t.metrics.RegisterTableBatchAttempt()
 		start := time.Now()
+		deleted := int64(batch.Size())
 		if !t.dryRun {
-			err := batch.ExecuteBatch()
+			err := t.execute(batch)
 			if err != nil {
-				log.Error(err)
+				util.WithError(t.logger.WithFields(util.BatchLogFields(batch.PartitionKey, batch.Size())), err).Error("Error executing table batch")
 				t.metrics.RegisterTableBatchFailed()
+				deleted = 0
 			} else {
-				t.metrics.RegisterEntitiesProcessed(int64(len(batch.BatchEntitySlice)))
+				t.metrics.RegisterEntitiesProcessed(deleted)
 				t.metrics.RegisterTableBatchDurationSince(start)
 				t.metrics.RegisterTableBatchSuccess()
 			}
 		}
+		t.processed(batch, deleted)
 	}
+	t.finished()
 }
 
-func (d *DefaultTablePurger) purgeEntitiesUsingWorkerPool(done chan interface{}, period *util.Period) (PurgeResult, error) {
+func (d *DefaultTablePurger) purgeEntitiesUsingWorkerPool(ctx context.Context, done chan interface{}, periods []util.Period) (PurgeResult, error) {
 
 	p := work.New(d.numWorkers)
 	var wg sync.WaitGroup
-	periods := period.Split(time.Duration(d.periodLengthInHours) * time.Hour)
-	for _, split := range periods {
-		batchChannel := d.batches(done, d.partitions(done, d.queryResultsGenerator(done, d.periodQueryOptionsGenerator(done, split.Start, split.End), timeout)))
+	for i, split := range periods {
+		i := i
+		logger := d.logger.WithField(util.LogFieldSplit, i)
+		splitCtx, span := d.startSplitSpan(ctx, split)
+		batchChannel := d.batches(logger, done, d.partitions(logger, done, d.queryResultsGenerator(splitCtx, logger, done, d.periodQueryOptionsGenerator(logger, done, split.Start, split.End), timeout)))
 		wg.Add(1)
 		// FIXME use done channel
-		job := batchProcessor{metrics: d.Metrics, input: batchChannel, dryRun: d.dryRun}
+		job := batchProcessor{
+			metrics: d.Metrics,
+			logger:  logger,
+			input:   batchChannel,
+			execute: func(batch *tablestore.Batch) error { return d.executeBatch(splitCtx, batch) },
+			processed: func(batch *tablestore.Batch, deleted int64) {
+				d.advance(i, batch, deleted)
+			},
+			finished: func() {
+				d.progress.Complete(i)
+				span.End()
+			},
+			dryRun: d.dryRun,
+		}
 		go func() {
 			p.Run(&job)
 			wg.Done()
 		}()
 	}
+	// Run returns once a worker picks the job up, Shutdown waits for the jobs to complete
 	wg.Wait()
+	p.Shutdown()
 	return d.result, nil
 }
 
-func (d *DefaultTablePurger) purgeEntitiesUsingFanIn(done chan interface{}, period *util.Period) (PurgeResult, error) {
-	process := func(batches <-chan *storage.TableBatch) <-chan *TableBatchResult {
+func (d *DefaultTablePurger) purgeEntitiesUsingFanIn(ctx context.Context, done chan interface{}, splits []util.Period) (PurgeResult, error) {
+	process := func(ctx context.Context, span trace.Span, i int, logger *log.Entry, batches <-chan *tablestore.Batch) <-chan *TableBatchResult {
 		processedBatchStream := make(chan *TableBatchResult)
 		go func() {
 			defer close(processedBatchStream)
+			defer span.End()
+			defer d.progress.Complete(i)
 			for batch := range batches {
 				d.Metrics.RegisterTableBatchAttempt()
-				log.Debugf("Executing table batch with size %d", len(batch.BatchEntitySlice))
+				logger.WithFields(util.BatchLogFields(batch.PartitionKey, batch.Size())).Debug("Executing table batch")
 				result := &TableBatchResult{Batch: batch}
+				deleted := int64(batch.Size())
 				if !d.dryRun {
 					start := time.Now()
-					err := batch.ExecuteBatch()
+					err := d.executeBatch(ctx, batch)
 					result.Error = err
 					if err != nil {
 						d.Metrics.RegisterTableBatchFailed()
-						log.Error(err)
+						util.WithError(logger.WithFields(util.BatchLogFields(batch.PartitionKey, batch.Size())), err).Error("Error executing table batch")
+						deleted = 0
 					} else {
 						d.Metrics.RegisterTableBatchDurationSince(start)
-						d.Metrics.RegisterEntitiesProcessed(int64(len(batch.BatchEntitySlice)))
+						d.Metrics.RegisterEntitiesProcessed(deleted)
 						d.Metrics.RegisterTableBatchSuccess()
 					}
 				}
+				d.advance(i, batch, deleted)
 				select {
 				case <-done:
 					return
@@ -205,14 +299,14 @@ func (d *DefaultTablePurger) purgeEntitiesUsingFanIn(done chan interface{}, peri
 		return processedBatchStream
 	}
 
-	numProcessors := d.numWorkers
-	log.Infof("Spinning up %d batch processors.\n", numProcessors)
-	splits := period.SplitsFrom(numProcessors)
+	d.logger.Infof("Spinning up %d batch processors.", len(splits))
 	util.LogPeriods(splits)
 	processors := make([]<-chan *TableBatchResult, len(splits))
 	for i := 0; i < len(splits); i++ {
 		split := splits[i]
-		processor := process(d.batches(done, d.partitions(done, d.queryResultsGenerator(done, d.periodQueryOptionsGenerator(done, split.Start, split.End), timeout))))
+		logger := d.logger.WithField(util.LogFieldSplit, i)
+		splitCtx, span := d.startSplitSpan(ctx, split)
+		processor := process(splitCtx, span, i, logger, d.batches(logger, done, d.partitions(logger, done, d.queryResultsGenerator(splitCtx, logger, done, d.periodQueryOptionsGenerator(logger, done, split.Start, split.End), timeout))))
 		processors[i] = processor
 	}
 
@@ -224,130 +318,214 @@ func (d *DefaultTablePurger) purgeEntitiesUsingFanIn(done chan interface{}, peri
 
 // PurgeEntities sdf
 func (d *DefaultTablePurger) PurgeEntities() (PurgeResult, error) {
-	startPartitionKey, err := d.getOldestPartition(timeout)
-	if err != nil {
+	return d.PurgeEntitiesContext(context.Background())
+}
+
+// PurgeEntitiesContext all entities of the PurgePeriod until ctx is cancelled. Returns the error of ctx when cancelled.
+func (d *DefaultTablePurger) PurgeEntitiesContext(ctx context.Context) (PurgeResult, error) {
+	period, err := d.PurgePeriod()
+	if err != nil || period == nil {
 		d.result.end(d.Metrics)
+		d.Metrics.Finish()
 		return d.result, err
 	}
+	return d.PurgeEntitiesWithinContext(ctx, period)
+}
+
+// Finish ends the run of the purger
+func (d *DefaultTablePurger) Finish() {
+	d.Metrics.Finish()
+}
+
+// PurgePeriod the period from the oldest partition up to purgeEntitiesOlderThanDays ago.
+// Returns a nil Period when there is nothing to purge.
+func (d *DefaultTablePurger) PurgePeriod() (*util.Period, error) {
+	startPartitionKey, err := d.getOldestPartition(timeout)
+	if err != nil {
+		return nil, err
+	}
 	endPartitionKey := util.GetMaximumPartitionKeyToDelete(d.purgeEntitiesOlderThanDays)
 	start := util.TimeFromTicksAscendingWithLeadingZero(startPartitionKey)
 	end := util.TimeFromTicksAscendingWithLeadingZero(endPartitionKey)
 
 	if start == end || start.After(end) {
-		log.Warnf("Start date (%s) should be greater than end date (%s)", start, end)
-		d.result.end(d.Metrics)
-		return d.result, err
+		d.logger.Warnf("Start date (%s) should be greater than end date (%s)", start, end)
+		return nil, nil
 	}
-	period, _ := util.NewPeriod(start, end)
-	return d.PurgeEntitiesWithin(period)
+	return util.NewPeriod(start, end)
 }
 
 // PurgeEntitiesWithin all entities within Period
 func (d *DefaultTablePurger) PurgeEntitiesWithin(period *util.Period) (PurgeResult, error) {
+	return d.PurgeEntitiesWithinContext(context.Background(), period)
+}
+
+// PurgeEntitiesWithinContext all entities within Period until ctx is cancelled. Returns the error of ctx when cancelled.
+func (d *DefaultTablePurger) PurgeEntitiesWithinContext(ctx context.Context, period *util.Period) (PurgeResult, error) {
 	if d.dryRun {
-		log.Warn("Dry run is ENABLED")
+		d.logger.Warn("Dry run is ENABLED")
 	}
 	d.result = PurgeResult{StartTime: time.Now().UTC()}
+	atomic.StoreInt64(&d.auditErrorCount, 0)
+	// done stops the pipelines once the purge returns or ctx is cancelled
 	done := make(chan interface{})
-	defer close(done)
+	returned := make(chan struct{})
+	defer close(returned)
+	cancelled := ctx.Done()
+	go func() {
+		select {
+		case <-cancelled:
+		case <-returned:
+		}
+		close(done)
+	}()
 
-	log.Infof("Starting purging all entities created between %s and %s", period.Start, period.End)
+	d.logger.Infof("Starting purging all entities created between %s and %s", period.Start, period.End)
 
-	go d.Metrics.Log()
+	ctx, span := tracing.Tracer().Start(ctx, "purge", trace.WithAttributes(
+		attribute.String("azp.table", d.tableName),
+		attribute.String("azp.run_id", d.Metrics.RunID),
+		attribute.String("azp.period.start", period.Start.Format(time.RFC3339)),
+		attribute.String("azp.period.end", period.End.Format(time.RFC3339)),
+		attribute.Bool("azp.dry_run", d.dryRun),
+	))
+	defer span.End()
 
+	var splits []util.Period
 	if d.usePool {
-		log.Info("Using worker pool implementation")
-		d.purgeEntitiesUsingWorkerPool(done, period)
+		splits = period.Split(time.Duration(d.periodLengthInHours) * time.Hour)
 	} else {
-		d.purgeEntitiesUsingFanIn(done, period)
+		splits = period.SplitsFrom(d.numWorkers)
 	}
+	d.progress = progress.NewTracker(splits)
+	reporter := progress.NewReporter(d.progress, d.progressMode, d.logger.WithField("run_id", d.Metrics.RunID))
+	if d.progressMode == progress.None {
+		go d.Metrics.Log()
+	}
+	reporter.Start()
 
-	log.Info("Summary")
+	if d.usePool {
+		d.logger.Info("Using worker pool implementation")
+		d.purgeEntitiesUsingWorkerPool(ctx, done, splits)
+	} else {
+		d.purgeEntitiesUsingFanIn(ctx, done, splits)
+	}
+	reporter.Stop()
+
+	d.logger.Info("Summary")
 	summaryLines := strings.Split(d.Metrics.String(), "\n")
 	for _, line := range summaryLines {
-		log.Info(line)
+		d.logger.Info(line)
 	}
 	d.result.end(d.Metrics)
+	d.result.AuditErrorCount = atomic.LoadInt64(&d.auditErrorCount)
+	d.Metrics.Finish()
+	span.SetAttributes(
+		attribute.Int64("azp.entity_count", d.result.RowCount),
+		attribute.Int64("azp.batch_count", d.result.BatchCount),
+		attribute.Int64("azp.batch_error_count", d.result.BatchErrorCount),
+	)
+
+	d.logger.Infof("It took %s", d.result.EndTime.Sub(d.result.StartTime))
+	d.logger.Infof("To delete %d entities in %d batches", d.result.RowCount, d.result.BatchCount)
+	d.logger.Infof("Errors in %d batches", d.result.BatchErrorCount)
+	if d.result.AuditErrorCount > 0 {
+		d.logger.Errorf("%d deleted batches are missing from the audit log", d.result.AuditErrorCount)
+	}
+	if d.backend == CosmosBackend {
+		d.logger.Infof("Consumed %.2f request units", d.result.RequestCharge)
+	}
 
-	log.Infof("It took %s", d.result.EndTime.Sub(d.result.StartTime))
-	log.Infof("To delete %d entities in %d batches", d.result.RowCount, d.result.BatchCount)
-	log.Infof("Errors in %d batches", d.result.BatchErrorCount)
-
+	if err := ctx.Err(); err != nil {
+		d.logger.Warnf("Purge stopped before completion. %s", err)
+		return d.result, err
+	}
 	return d.result, nil
 }
 
-func (d *DefaultTablePurger) queryResultsGenerator(done <-chan interface{}, queryOptionsStream <-chan *storage.QueryOptions, timeout uint) <-chan QueryResult {
+func (d *DefaultTablePurger) queryResultsGenerator(ctx context.Context, logger *log.Entry, done <-chan interface{}, queryStream <-chan tablestore.Query, timeout uint) <-chan QueryResult {
 	queryResultStream := make(chan QueryResult)
 	go func() {
 		defer close(queryResultStream)
-		for queryOptions := range queryOptionsStream {
-			log.Debug("Querying entities using: ", queryOptions)
+		for query := range queryStream {
+			query.Timeout = timeout
+			logger.Debug("Querying entities using: ", query)
 			pageCount := 1
-			log.Debugf("Fetching page %d", pageCount)
+			logger.Debugf("Fetching page %d", pageCount)
 			start := time.Now()
 			d.Metrics.RegisterPageAttempt()
-			result, err := d.table.QueryEntities(timeout, storage.NoMetadata, queryOptions)
+			span := startPageSpan(ctx, pageCount, query)
+			result, err := d.store.Query(ctx, query)
+			endPageSpan(span, result, err)
 			if err == nil {
 				d.Metrics.RegisterPageDurationSince(start)
 			} else {
 				d.Metrics.RegisterPageFailed()
+				util.WithError(logger, err).Errorf("Error fetching page %d", pageCount)
 			}
-			queryResult := QueryResult{Error: err, EntityQueryResult: result}
+			queryResult := QueryResult{Error: err, Page: result}
 			select {
 			case <-done:
 				return
 			case queryResultStream <- queryResult:
 			}
-			tableOptions := &storage.TableOptions{}
-			for result != nil && result.QueryNextLink.NextLink != nil {
+			for result.HasNext() {
 				pageCount++
-				log.Debugf("Fetching next page %d", pageCount)
+				logger.Debugf("Fetching next page %d", pageCount)
 				d.Metrics.RegisterPageAttempt()
 				start = time.Now()
-				result, err = result.NextResults(tableOptions)
+				span := startPageSpan(ctx, pageCount, query)
+				result, err = d.store.NextPage(ctx, result)
+				endPageSpan(span, result, err)
 				if err != nil {
 					d.Metrics.RegisterPageFailed()
-					log.Error(err)
+					util.WithError(logger, err).Errorf("Error fetching page %d", pageCount)
 				} else {
 					d.Metrics.RegisterPageDurationSince(start)
 				}
 				if pageCount%100 == 0 {
-					log.Infof("Processed %d pages.", pageCount)
+					logger.Infof("Processed %d pages.", pageCount)
 				}
-				queryResult := QueryResult{Error: err, EntityQueryResult: result}
+				queryResult := QueryResult{Error: err, Page: result}
 				select {
 				case <-done:
 					return
 				case queryResultStream <- queryResult:
 				}
 			}
-			log.Debugf("Processed %d pages. QueryOptions %#v", pageCount, queryOptions)
+			logger.Debugf("Processed %d pages. Query %#v", pageCount, query)
 		}
 
 	}()
 	return queryResultStream
 }
 
-func (d *DefaultTablePurger) partitions(done <-chan interface{}, queryResults <-chan QueryResult) <-chan Partition {
+// partitions groups the entities of each page by partition key. The partitions of a page are yielded in
+// ascending order of key, so the progress of the split moves forward steadily.
+func (d *DefaultTablePurger) partitions(logger *log.Entry, done <-chan interface{}, queryResults <-chan QueryResult) <-chan Partition {
 	yield := make(chan Partition)
 	go func() {
 		defer close(yield)
 		for result := range queryResults {
 
 			if result.Error != nil {
-				log.Error(result.Error)
 				continue
 			}
 
 			m := make(map[string][]*storage.Entity)
+			keys := make([]string, 0)
 
-			for _, entity := range result.EntityQueryResult.Entities {
+			for _, entity := range result.Page.Entities {
+				if _, ok := m[entity.PartitionKey]; !ok {
+					keys = append(keys, entity.PartitionKey)
+				}
 				m[entity.PartitionKey] = append(m[entity.PartitionKey], entity)
 			}
-			log.Debugf("Partioning query result: %d", len(m))
+			sort.Strings(keys)
+			logger.Debugf("Partioning query result: %d", len(m))
 			d.Metrics.RegisterPartitionsProcessed(int64(len(m)))
-			for k, v := range m {
-				partition := Partition{key: k, entities: v}
+			for _, k := range keys {
+				partition := Partition{key: k, entities: m[k]}
 				select {
 				case <-done:
 					return
@@ -359,28 +537,17 @@ func (d *DefaultTablePurger) partitions(done <-chan interface{}, queryResults <-
 	return yield
 }
 
-func (d *DefaultTablePurger) batches(done <-chan interface{}, partitions <-chan Partition) <-chan *storage.TableBatch {
-	yield := make(chan *storage.TableBatch)
-	chunkSize := 100
+func (d *DefaultTablePurger) batches(logger *log.Entry, done <-chan interface{}, partitions <-chan Partition) <-chan *tablestore.Batch {
+	yield := make(chan *tablestore.Batch)
 	go func() {
 		defer close(yield)
 		for p := range partitions {
-			entities := p.entities
-			count := len(entities)
-			log.Tracef("Chunkfying partition (%s) with %d entities", p.key, count)
-			for i := 0; i < count; i += chunkSize {
-				end := i + chunkSize
-				if end > count {
-					end = count
-				}
-				tableBatch := d.table.NewBatch()
-				for _, entity := range entities[i:end] {
-					tableBatch.DeleteEntityByForce(entity, true)
-				}
+			logger.WithField(util.LogFieldPartitionKey, p.key).Tracef("Chunkfying partition with %d entities", len(p.entities))
+			for _, batch := range tablestore.Batches(p.key, p.entities) {
 				select {
 				case <-done:
 					return
-				case yield <- tableBatch:
+				case yield <- batch:
 				}
 			}
 		}
@@ -390,23 +557,28 @@ func (d *DefaultTablePurger) batches(done <-chan interface{}, partitions <-chan
 
 // works for tables where the PartitionKey has fized-length zero padded strings
 func (d *DefaultTablePurger) getOldestPartition(timeout uint) (string, error) {
-	queryOptions := &storage.QueryOptions{}
-	queryOptions.Filter = fmt.Sprintf("PartitionKey ne '%s'", "")
-	queryOptions.Select = []string{"PartitionKey"}
-	queryOptions.Top = 100
-	log.Debugf("Fetching oldest partition key for table %s with query %#v", d.tableName, queryOptions)
-	result, err := d.table.QueryEntities(timeout, storage.NoMetadata, queryOptions)
+	if d.backend == CosmosBackend {
+		return d.searchOldestPartition(timeout)
+	}
+	query := tablestore.Query{
+		Filter:  fmt.Sprintf("PartitionKey ne '%s'", ""),
+		Select:  []string{"PartitionKey"},
+		Top:     100,
+		Timeout: timeout,
+	}
+	d.logger.Debugf("Fetching oldest partition key with query %#v", query)
+	ctx := context.Background()
+	result, err := d.store.Query(ctx, query)
 	if err != nil {
-		log.Error("Error fetching oldest partition key", err)
+		util.WithError(d.logger, err).Error("Error fetching oldest partition key")
 		return "", err
 	}
 
 	if len(result.Entities) <= 0 {
-		tableOptions := &storage.TableOptions{}
-		for result != nil && result.QueryNextLink.NextLink != nil {
-			result, err = result.NextResults(tableOptions)
+		for result.HasNext() {
+			result, err = d.store.NextPage(ctx, result)
 			if err != nil {
-				log.Error("Error fetching oldest partition key", err)
+				util.WithError(d.logger, err).Error("Error fetching oldest partition key")
 				return "", err
 			}
 			if result != nil && len(result.Entities) > 0 {
@@ -418,30 +590,100 @@ func (d *DefaultTablePurger) getOldestPartition(timeout uint) (string, error) {
 	if result != nil && len(result.Entities) > 0 {
 		oldestEntity := result.Entities[0]
 		oldestPartitionKey := oldestEntity.PartitionKey
-		log.Infof("Oldest partition key in '%s' table is %s (%s)", d.tableName, oldestPartitionKey, util.TimeFromTicksAscendingWithLeadingZero(oldestPartitionKey))
+		d.logger.WithField(util.LogFieldPartitionKey, oldestPartitionKey).Infof("Oldest partition key is %s (%s)", oldestPartitionKey, util.TimeFromTicksAscendingWithLeadingZero(oldestPartitionKey))
 		return oldestPartitionKey, nil
 	}
 
 	return "", errors.New("Oldest record not found")
 }
 
-func (d *DefaultTablePurger) periodQueryOptionsGenerator(done <-chan interface{}, start, end time.Time) <-chan *storage.QueryOptions {
-	queryOptionsStream := make(chan *storage.QueryOptions)
+// periodQueryOptionsGenerator yields the range queries of the period.
+// A single query covers the period, except on Cosmos DB where it is queried window by window
+// so the partition keys processed, and so the progress, move forward in order.
+func (d *DefaultTablePurger) periodQueryOptionsGenerator(logger *log.Entry, done <-chan interface{}, start, end time.Time) <-chan tablestore.Query {
+	queryStream := make(chan tablestore.Query)
+	windows := []util.Period{{Start: start, End: end}}
+	if d.backend == CosmosBackend {
+		windows = queryWindows(start, end, cosmosQueryWindow)
+	}
 	go func() {
-		defer close(queryOptionsStream)
-		from := start
-		to := end
-		log.Debugf("Creating queryOptions: from %s to %s", from, to)
-		fromTicks := util.TicksAscendingWithLeadingZero(util.TicksFromTime(from))
-		toTicks := util.TicksAscendingWithLeadingZero(util.TicksFromTime(to))
-		queryOptions := &storage.QueryOptions{}
-		queryOptions.Filter = fmt.Sprintf("PartitionKey ge '%s' and PartitionKey lt '%s'", fromTicks, toTicks)
-		queryOptions.Select = []string{"PartitionKey", "RowKey"}
-		select {
-		case <-done:
-			return
-		case queryOptionsStream <- queryOptions:
+		defer close(queryStream)
+		for _, window := range windows {
+			from := window.Start
+			to := window.End
+			logger.Debugf("Creating queryOptions: from %s to %s", from, to)
+			fromTicks := util.TicksAscendingWithLeadingZero(util.TicksFromTime(from))
+			toTicks := util.TicksAscendingWithLeadingZero(util.TicksFromTime(to))
+			query := tablestore.Query{
+				Filter: fmt.Sprintf("PartitionKey ge '%s' and PartitionKey lt '%s'", fromTicks, toTicks),
+				Select: []string{"PartitionKey", "RowKey"},
+			}
+			select {
+			case <-done:
+				return
+			case queryStream <- query:
+			}
 		}
 	}()
-	return queryOptionsStream
+	return queryStream
+}
+
+func (d *DefaultTablePurger) startSplitSpan(ctx context.Context, split util.Period) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, "split", trace.WithAttributes(
+		attribute.String("azp.partition_key.from", util.TicksAscendingWithLeadingZero(util.TicksFromTime(split.Start))),
+		attribute.String("azp.partition_key.to", util.TicksAscendingWithLeadingZero(util.TicksFromTime(split.End))),
+		attribute.String("azp.period.start", split.Start.Format(time.RFC3339)),
+		attribute.String("azp.period.end", split.End.Format(time.RFC3339)),
+	))
+}
+
+// executeBatch executes the batch within a span, child of the split span in ctx
+func (d *DefaultTablePurger) executeBatch(ctx context.Context, batch *tablestore.Batch) error {
+	ctx, span := tracing.Tracer().Start(ctx, "ExecuteBatch", trace.WithAttributes(
+		attribute.String("azp.partition_key", batch.PartitionKey),
+		attribute.Int("azp.entity_count", batch.Size()),
+	))
+	err := d.store.DeleteBatch(ctx, batch)
+	tracing.EndSpan(span, err)
+	if err == nil && d.auditLog != nil {
+		d.audit(batch)
+	}
+	return err
+}
+
+// audit records the entities deleted by batch in the audit log. A failure marks the result errored.
+func (d *DefaultTablePurger) audit(batch *tablestore.Batch) {
+	if batch.Size() == 0 {
+		return
+	}
+	rowKeys := make([]string, batch.Size())
+	for i, entity := range batch.Entities {
+		rowKeys[i] = entity.RowKey
+	}
+	if err := d.auditLog.Append(d.Metrics.RunID, d.tableName, batch.PartitionKey, rowKeys); err != nil {
+		atomic.AddInt64(&d.auditErrorCount, 1)
+		util.WithError(d.logger.WithFields(util.BatchLogFields(batch.PartitionKey, batch.Size())), err).Error("Error writing audit log")
+	}
+}
+
+func startPageSpan(ctx context.Context, page int, query tablestore.Query) trace.Span {
+	_, span := tracing.Tracer().Start(ctx, "QueryPage", trace.WithAttributes(
+		attribute.Int("azp.page", page),
+		attribute.String("azp.filter", query.Filter),
+	))
+	return span
+}
+
+func endPageSpan(span trace.Span, result *tablestore.Page, err error) {
+	if result != nil {
+		span.SetAttributes(attribute.Int("azp.entity_count", len(result.Entities)))
+	}
+	tracing.EndSpan(span, err)
+}
+
+// advance records the position of the split after processing batch
+func (d *DefaultTablePurger) advance(split int, batch *tablestore.Batch, deleted int64) {
+	if batch.Size() > 0 {
+		d.progress.Advance(split, batch.PartitionKey, deleted)
+	}
 }
@@ -0,0 +1,148 @@
+package purger
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/audit"
+	"github.com/fabito/azure-storage-purger/pkg/progress"
+	"github.com/fabito/azure-storage-purger/pkg/tablestore"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// newStore creates a table with a partition of entitiesPerDay entities per day, from days ago up to today
+func newStore(t *testing.T, days, entitiesPerDay int) *tablestore.MemoryStore {
+	store := tablestore.NewMemoryStore("logs")
+	// small pages exercise the continuations
+	store.PageSize = 70
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for d := days; d >= 0; d-- {
+		pk := util.TicksAscendingWithLeadingZero(util.TicksFromTime(today.AddDate(0, 0, -d)))
+		entities := make([]*storage.Entity, entitiesPerDay)
+		for i := range entities {
+			entities[i] = &storage.Entity{PartitionKey: pk, RowKey: strconv.Itoa(i)}
+		}
+		for _, batch := range tablestore.Batches(pk, entities) {
+			assert.NoError(t, store.UpsertBatch(context.Background(), batch))
+		}
+	}
+	return store
+}
+
+// oldestDay the number of days since the oldest entity left in store
+func oldestDay(t *testing.T, store *tablestore.MemoryStore) int {
+	page, err := store.Query(context.Background(), tablestore.Query{Top: 1})
+	assert.NoError(t, err)
+	if len(page.Entities) == 0 {
+		return -1
+	}
+	created := util.TimeFromTicksAscendingWithLeadingZero(page.Entities[0].PartitionKey)
+	return int(time.Now().UTC().Truncate(24*time.Hour).Sub(created).Hours() / 24)
+}
+
+func TestPurgeEntities(t *testing.T) {
+	for _, usePool := range []bool{false, true} {
+		store := newStore(t, 10, 150)
+		tablePurger, err := NewTablePurgerWithStore(store, 5, 36, 3, usePool, false, progress.None, nil, StorageBackend)
+		assert.NoError(t, err)
+
+		result, err := tablePurger.PurgeEntities()
+		assert.NoError(t, err)
+		assert.False(t, result.HasErrors())
+		// the partitions of 10 to 6 days ago are deleted, in batches of up to 100 entities of a page
+		assert.Equal(t, int64(5*150), result.RowCount, "usePool=%v", usePool)
+		assert.True(t, result.BatchCount >= 10, "usePool=%v", usePool)
+		assert.Equal(t, 6*150, store.Len(), "usePool=%v", usePool)
+		assert.Equal(t, 5, oldestDay(t, store), "usePool=%v", usePool)
+	}
+}
+
+func TestPurgeEntitiesWithin(t *testing.T) {
+	store := newStore(t, 10, 10)
+	auditLog, err := audit.Open(filepath.Join(t.TempDir(), "audit.jsonl"))
+	assert.NoError(t, err)
+	defer auditLog.Close()
+	tablePurger, err := NewTablePurgerWithStore(store, 5, 24, 4, false, false, progress.None, auditLog, CosmosBackend)
+	assert.NoError(t, err)
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	period, _ := util.NewPeriod(today.AddDate(0, 0, -8), today.AddDate(0, 0, -6))
+	result, err := tablePurger.PurgeEntitiesWithin(period)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), result.RowCount)
+	assert.Equal(t, 9*10, store.Len())
+	assert.Nil(t, store.Get(util.TicksAscendingWithLeadingZero(util.TicksFromTime(today.AddDate(0, 0, -7))), "0"))
+	assert.NotNil(t, store.Get(util.TicksAscendingWithLeadingZero(util.TicksFromTime(today.AddDate(0, 0, -6))), "0"))
+}
+
+func TestPurgeEntitiesAuditLogError(t *testing.T) {
+	store := newStore(t, 10, 10)
+	auditLog, err := audit.Open(filepath.Join(t.TempDir(), "audit.jsonl"))
+	assert.NoError(t, err)
+	// appending to a closed audit log fails
+	assert.NoError(t, auditLog.Close())
+	tablePurger, err := NewTablePurgerWithStore(store, 5, 24, 2, false, false, progress.None, auditLog, StorageBackend)
+	assert.NoError(t, err)
+
+	result, err := tablePurger.PurgeEntities()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), result.BatchErrorCount)
+	assert.Equal(t, result.BatchCount, result.AuditErrorCount)
+	assert.True(t, result.HasErrors())
+}
+
+func TestPartitionsInKeyOrder(t *testing.T) {
+	tablePurger := newTablePurger("logs", 5, 24, 1, false, false, progress.None, nil, CosmosBackend)
+	page := &tablestore.Page{}
+	for _, pk := range []string{"03", "01", "04", "02", "01", "05"} {
+		page.Entities = append(page.Entities, &storage.Entity{PartitionKey: pk})
+	}
+	queryResults := make(chan QueryResult, 1)
+	queryResults <- QueryResult{Page: page}
+	close(queryResults)
+
+	keys := make([]string, 0)
+	for p := range tablePurger.partitions(tablePurger.logger, make(chan interface{}), queryResults) {
+		keys = append(keys, p.key)
+	}
+	assert.Equal(t, []string{"01", "02", "03", "04", "05"}, keys)
+}
+
+func TestPurgeEntitiesDryRun(t *testing.T) {
+	store := newStore(t, 10, 10)
+	tablePurger, err := NewTablePurgerWithStore(store, 5, 24, 2, false, true, progress.None, nil, StorageBackend)
+	assert.NoError(t, err)
+
+	_, err = tablePurger.PurgeEntities()
+	assert.NoError(t, err)
+	assert.Equal(t, 11*10, store.Len())
+}
+
+func TestPurgePeriod(t *testing.T) {
+	tablePurger, _ := NewTablePurgerWithStore(newStore(t, 3, 1), 5, 24, 2, false, false, progress.None, nil, StorageBackend)
+	period, err := tablePurger.PurgePeriod()
+	assert.NoError(t, err)
+	assert.Nil(t, period, "nothing older than 5 days")
+
+	tablePurger, _ = NewTablePurgerWithStore(tablestore.NewMemoryStore("empty"), 5, 24, 2, false, false, progress.None, nil, CosmosBackend)
+	_, err = tablePurger.PurgePeriod()
+	assert.Error(t, err)
+}
+
+func TestPurgeEntitiesWithinCancelled(t *testing.T) {
+	store := newStore(t, 10, 10)
+	tablePurger, err := NewTablePurgerWithStore(store, 5, 24, 2, false, false, progress.None, nil, StorageBackend)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	period, _ := util.NewPeriod(today.AddDate(0, 0, -10), today.AddDate(0, 0, -6))
+	_, err = tablePurger.PurgeEntitiesWithinContext(ctx, period)
+	assert.Equal(t, context.Canceled, err)
+}
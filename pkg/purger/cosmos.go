@@ -0,0 +1,224 @@
+package purger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/metrics"
+	"github.com/fabito/azure-storage-purger/pkg/tablestore"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+)
+
+// Backend the service behind the table API
+type Backend string
+
+const (
+	// StorageBackend Azure Table Storage
+	StorageBackend Backend = "storage"
+	// CosmosBackend Cosmos DB Table API
+	CosmosBackend Backend = "cosmos"
+)
+
+const (
+	// cosmosMaxRetries how many times a throttled request is retried
+	cosmosMaxRetries = 9
+	// cosmosDefaultRetryAfter the delay before retrying when the service doesn't tell
+	cosmosDefaultRetryAfter = time.Second
+	// cosmosQueryWindow the period covered by each range query.
+	// Cosmos DB doesn't return entities ordered by partition key so each split is queried window by window.
+	cosmosQueryWindow = time.Hour
+	// cosmosScanPageSize the page size used when scanning partition keys
+	cosmosScanPageSize = 1000
+	// ticksPerCosmosQueryWindow the length of cosmosQueryWindow in ticks of 100ns
+	ticksPerCosmosQueryWindow = int64(cosmosQueryWindow / 100)
+
+	headerRetryAfterMs   = "x-ms-retry-after-ms"
+	headerRequestCharge  = "x-ms-request-charge"
+	headerRetryAfterSecs = "Retry-After"
+)
+
+// ParseBackend parses a Backend
+func ParseBackend(s string) (Backend, error) {
+	switch b := Backend(s); b {
+	case StorageBackend, CosmosBackend:
+		return b, nil
+	}
+	return StorageBackend, fmt.Errorf("invalid backend %q. Expected one of storage or cosmos", s)
+}
+
+// cosmosTransport retries the requests throttled by Cosmos DB (429) after the delay it asks for
+// and records the request units charged for every attempt, throttled ones included.
+// It wraps the HTTP transport so the storage client doesn't retry 429s again with its own backoff.
+type cosmosTransport struct {
+	next       http.RoundTripper
+	metrics    *metrics.Metrics
+	maxRetries int
+}
+
+// newCosmosHTTPClient an HTTP client sending requests through a cosmosTransport
+func newCosmosHTTPClient(client *http.Client, m *metrics.Metrics) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	c := *client
+	c.Transport = &cosmosTransport{next: next, metrics: m, maxRetries: cosmosMaxRetries}
+	return &c
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *cosmosTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(r)
+		if err != nil {
+			return resp, err
+		}
+		if charge, err := strconv.ParseFloat(resp.Header.Get(headerRequestCharge), 64); err == nil {
+			t.metrics.RegisterRequestCharge(charge)
+		}
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= t.maxRetries || (r.Body != nil && r.GetBody == nil) {
+			return resp, nil
+		}
+		t.metrics.RegisterThrottledRequest()
+		delay := retryAfter(resp.Header)
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		retry := r.Clone(r.Context())
+		if r.GetBody != nil {
+			if retry.Body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		r = retry
+		select {
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryAfter the delay given by x-ms-retry-after-ms, or Retry-After in seconds
+func retryAfter(h http.Header) time.Duration {
+	if ms, err := strconv.ParseFloat(h.Get(headerRetryAfterMs), 64); err == nil && ms >= 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	if secs, err := strconv.Atoi(h.Get(headerRetryAfterSecs)); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return cosmosDefaultRetryAfter
+}
+
+// queryWindows splits the [start, end) range into consecutive windows of the given length.
+// The last one ends at end.
+func queryWindows(start, end time.Time, window time.Duration) []util.Period {
+	windows := make([]util.Period, 0)
+	for from := start; from.Before(end); from = from.Add(window) {
+		to := from.Add(window)
+		if to.After(end) {
+			to = end
+		}
+		windows = append(windows, util.Period{Start: from, End: to})
+	}
+	return windows
+}
+
+// searchOldestPartition finds the lowest partition key, which Cosmos DB can't return by ordering.
+// It bisects the ticks of the partition keys, asking at each step for one partition key below the middle
+// with $top=1. Such range queries are served by the index and charge a few request units each, about 25 of
+// them for tables spanning decades, where reading every partition key charges for the whole table.
+// Only the last window of cosmosQueryWindow is scanned for its lowest key.
+func (d *DefaultTablePurger) searchOldestPartition(timeout uint) (string, error) {
+	d.logger.Info("Searching for the oldest partition key")
+	ctx := context.Background()
+	// there is no partition key below lo and at least one below hi, if any at all
+	lo, hi := int64(0), int64(math.MaxInt64)
+	for hi-lo > ticksPerCosmosQueryWindow {
+		mid := lo + (hi-lo)/2
+		partitionKey, err := d.partitionKeyBelow(ctx, ticksPartitionKey(mid), timeout)
+		if err != nil {
+			util.WithError(d.logger, err).Error("Error fetching oldest partition key")
+			return "", err
+		}
+		if partitionKey == "" {
+			lo = mid
+			continue
+		}
+		ticks, err := strconv.ParseInt(partitionKey, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("partition key %q doesn't hold ticks", partitionKey)
+		}
+		hi = ticks + 1
+	}
+	return d.scanOldestPartition(ticksPartitionKey(lo), ticksPartitionKey(hi), timeout)
+}
+
+// partitionKeyBelow any partition key lower than below, empty when there is none
+func (d *DefaultTablePurger) partitionKeyBelow(ctx context.Context, below string, timeout uint) (string, error) {
+	query := tablestore.Query{
+		Filter:  fmt.Sprintf("PartitionKey lt '%s'", below),
+		Select:  []string{"PartitionKey"},
+		Top:     1,
+		Timeout: timeout,
+	}
+	d.logger.Debugf("Fetching a partition key with query %#v", query)
+	result, err := d.store.Query(ctx, query)
+	// Cosmos DB may return empty pages with a continuation
+	for err == nil && len(result.Entities) == 0 && result.HasNext() {
+		result, err = d.store.NextPage(ctx, result)
+	}
+	if err != nil || len(result.Entities) == 0 {
+		return "", err
+	}
+	return result.Entities[0].PartitionKey, nil
+}
+
+// scanOldestPartition scans the partition keys from from to to, exclusive, for the lowest one
+func (d *DefaultTablePurger) scanOldestPartition(from, to string, timeout uint) (string, error) {
+	query := tablestore.Query{
+		Filter:  fmt.Sprintf("PartitionKey ge '%s' and PartitionKey lt '%s'", from, to),
+		Select:  []string{"PartitionKey"},
+		Top:     cosmosScanPageSize,
+		Timeout: timeout,
+	}
+	d.logger.Debugf("Scanning partition keys for the oldest one with query %#v", query)
+	ctx := context.Background()
+	result, err := d.store.Query(ctx, query)
+	oldestPartitionKey := ""
+	for {
+		if err != nil {
+			util.WithError(d.logger, err).Error("Error fetching oldest partition key")
+			return "", err
+		}
+		for _, entity := range result.Entities {
+			if oldestPartitionKey == "" || entity.PartitionKey < oldestPartitionKey {
+				oldestPartitionKey = entity.PartitionKey
+			}
+		}
+		if !result.HasNext() {
+			break
+		}
+		result, err = d.store.NextPage(ctx, result)
+	}
+	if oldestPartitionKey == "" {
+		return "", errors.New("Oldest record not found")
+	}
+	d.logger.WithField(util.LogFieldPartitionKey, oldestPartitionKey).Infof("Oldest partition key is %s (%s)", oldestPartitionKey, util.TimeFromTicksAscendingWithLeadingZero(oldestPartitionKey))
+	return oldestPartitionKey, nil
+}
+
+// ticksPartitionKey the partition key of ticks, padded with leading zeros to 19 digits
+func ticksPartitionKey(ticks int64) string {
+	return fmt.Sprintf("%019d", ticks)
+}
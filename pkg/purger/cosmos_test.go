@@ -0,0 +1,122 @@
+package purger
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/metrics"
+	"github.com/fabito/azure-storage-purger/pkg/progress"
+	"github.com/fabito/azure-storage-purger/pkg/tablestore"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCosmosTransportRetriesThrottledRequests(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.Header().Set(headerRequestCharge, "1.5")
+		if len(bodies) < 3 {
+			w.Header().Set(headerRetryAfterMs, "10")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	m := metrics.NewCosmosMetrics("logs", "cosmos-transport")
+	client := newCosmosHTTPClient(nil, m)
+	start := time.Now()
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("batch"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	assert.Equal(t, []string{"batch", "batch", "batch"}, bodies)
+	assert.Equal(t, 4.5, m.RequestCharge())
+}
+
+func TestCosmosTransportGivesUp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerRetryAfterMs, "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &cosmosTransport{next: http.DefaultTransport, metrics: metrics.NewCosmosMetrics("logs", "cosmos-give-up"), maxRetries: 2}}
+	resp, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, 1500*time.Microsecond, retryAfter(http.Header{"X-Ms-Retry-After-Ms": {"1.5"}}))
+	assert.Equal(t, 2*time.Second, retryAfter(http.Header{"Retry-After": {"2"}}))
+	assert.Equal(t, cosmosDefaultRetryAfter, retryAfter(http.Header{}))
+}
+
+func TestQueryWindows(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	windows := queryWindows(start, start.Add(150*time.Minute), time.Hour)
+	if assert.Len(t, windows, 3) {
+		assert.Equal(t, start, windows[0].Start)
+		assert.Equal(t, start.Add(time.Hour), windows[0].End)
+		assert.Equal(t, windows[0].End, windows[1].Start)
+		assert.Equal(t, start.Add(150*time.Minute), windows[2].End)
+	}
+	assert.Empty(t, queryWindows(start, start, time.Hour))
+}
+
+func TestParseBackend(t *testing.T) {
+	b, err := ParseBackend("cosmos")
+	assert.NoError(t, err)
+	assert.Equal(t, CosmosBackend, b)
+	_, err = ParseBackend("mongo")
+	assert.Error(t, err)
+}
+
+// countingStore counts the entities read by queries
+type countingStore struct {
+	*tablestore.MemoryStore
+	queries  int
+	entities int
+}
+
+func (s *countingStore) Query(ctx context.Context, query tablestore.Query) (*tablestore.Page, error) {
+	s.queries++
+	page, err := s.MemoryStore.Query(ctx, query)
+	if page != nil {
+		s.entities += len(page.Entities)
+	}
+	return page, err
+}
+
+func (s *countingStore) NextPage(ctx context.Context, page *tablestore.Page) (*tablestore.Page, error) {
+	next, err := s.MemoryStore.NextPage(ctx, page)
+	if next != nil {
+		s.entities += len(next.Entities)
+	}
+	return next, err
+}
+
+func TestSearchOldestPartition(t *testing.T) {
+	store := &countingStore{MemoryStore: newStore(t, 400, 10)}
+	tablePurger, err := NewTablePurgerWithStore(store, 5, 24, 2, false, false, progress.None, nil, CosmosBackend)
+	assert.NoError(t, err)
+
+	period, err := tablePurger.PurgePeriod()
+	assert.NoError(t, err)
+	oldest := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -400)
+	assert.Equal(t, oldest, period.Start)
+	// the search reads one entity per step and the entities of the oldest hour, not the whole table
+	assert.True(t, store.queries <= 30, "queries=%d", store.queries)
+	assert.True(t, store.entities <= 30, "entities=%d", store.entities)
+	assert.Equal(t, "0000000000000000042", ticksPartitionKey(42))
+	assert.Equal(t, util.TicksAscendingWithLeadingZero(util.TicksFromTime(oldest)), ticksPartitionKey(util.TicksFromTime(oldest)))
+}
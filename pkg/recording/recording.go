@@ -0,0 +1,194 @@
+// Package recording records the traffic of storage clients to go-vcr cassettes and replays it,
+// so issues seen against real accounts can be reproduced offline.
+package recording
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/dnaeon/go-vcr/cassette"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+)
+
+// redacted replaces the secrets in cassettes
+const redacted = "REDACTED"
+
+// secretHeaders the request headers scrubbed from cassettes
+var secretHeaders = []string{"Authorization", "x-ms-copy-source-authorization"}
+
+// secretParams the query parameters scrubbed from cassettes, the signature of SAS tokens
+var secretParams = []string{"sig"}
+
+// boundaries matches the random multipart boundaries of batch requests
+var boundaries = regexp.MustCompile(`(batch|changeset)_[0-9a-fA-F-]{36}`)
+
+// bodySecrets matches the authorization headers and SAS signatures of the sub-requests of blob batches
+var bodySecrets = regexp.MustCompile(`(?mi)(^Authorization: )[^\r\n]*|([?&]sig=)[^\r\n& ]*`)
+
+// bodyDates matches the dates of the sub-requests of blob batches
+var bodyDates = regexp.MustCompile(`(?mi)^(x-ms-date: )[^\r\n]*`)
+
+// Record creates an empty cassette saved to path, with or without the .yaml extension, by Save.
+// The secrets of the requests are scrubbed before they are added to the cassette.
+func Record(path string) *cassette.Cassette {
+	c := cassette.New(strings.TrimSuffix(path, ".yaml"))
+	c.Filters = append(c.Filters, Scrub)
+	return c
+}
+
+// Replay loads the cassette at path, with or without the .yaml extension
+func Replay(path string) (*cassette.Cassette, error) {
+	c, err := cassette.Load(strings.TrimSuffix(path, ".yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("loading cassette %s: %v", path, err)
+	}
+	c.Matcher = Matcher
+	return c, nil
+}
+
+// Scrub redacts the keys, bearer tokens and SAS signatures of the request of i, batch sub-requests included
+func Scrub(i *cassette.Interaction) error {
+	i.Request.Body = scrubBody(i.Request.Body)
+	for name := range i.Request.Headers {
+		for _, secret := range secretHeaders {
+			if strings.EqualFold(name, secret) {
+				i.Request.Headers[name] = []string{redacted}
+			}
+		}
+	}
+	u, err := url.Parse(i.Request.URL)
+	if err != nil {
+		return err
+	}
+	i.Request.URL = scrubURL(u, redacted).String()
+	return nil
+}
+
+// scrubURL replaces the value of the secret query parameters of u, removing them when value is empty
+func scrubURL(u *url.URL, value string) *url.URL {
+	query := u.Query()
+	for _, secret := range secretParams {
+		if _, ok := query[secret]; !ok {
+			continue
+		}
+		if value == "" {
+			query.Del(secret)
+		} else {
+			query.Set(secret, value)
+		}
+	}
+	scrubbed := *u
+	scrubbed.RawQuery = query.Encode()
+	return &scrubbed
+}
+
+// Matcher matches requests on their method, URL and body, ignoring signatures, the boundaries of batches
+// and the dates of their sub-requests
+func Matcher(r *http.Request, i cassette.Request) bool {
+	if r.Method != i.Method {
+		return false
+	}
+	recorded, err := url.Parse(i.URL)
+	if err != nil || scrubURL(r.URL, "").String() != scrubURL(recorded, "").String() {
+		return false
+	}
+	body, err := requestBody(r)
+	if err != nil {
+		return false
+	}
+	return normalize(string(body)) == normalize(i.Body)
+}
+
+func scrubBody(body string) string {
+	return bodySecrets.ReplaceAllString(body, "${1}${2}"+redacted)
+}
+
+// normalize the body without the boundaries, dates and signatures changing from one run to the other
+func normalize(body string) string {
+	body = boundaries.ReplaceAllString(scrubBody(body), "${1}_boundary")
+	return bodyDates.ReplaceAllString(body, "${1}date")
+}
+
+// requestBody reads the body of r, which can be read again afterwards
+func requestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// SenderWithRecording returns a Sender adding the requests sent by s and their responses to c.
+// Requests failing without a response aren't recorded.
+func SenderWithRecording(s storage.Sender, c *cassette.Cassette) storage.Sender {
+	return util.SenderFunc(func(client *storage.Client, r *http.Request) (*http.Response, error) {
+		requestBody, err := requestBody(r)
+		if err != nil {
+			return nil, err
+		}
+		interaction := &cassette.Interaction{
+			Request: cassette.Request{
+				Body:    string(requestBody),
+				Headers: r.Header.Clone(),
+				URL:     r.URL.String(),
+				Method:  r.Method,
+			},
+		}
+		resp, err := s.Send(client, r)
+		if err != nil {
+			return resp, err
+		}
+		responseBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(responseBody))
+		interaction.Response = cassette.Response{
+			Body:    string(responseBody),
+			Headers: resp.Header.Clone(),
+			Status:  resp.Status,
+			Code:    resp.StatusCode,
+		}
+		for _, filter := range c.Filters {
+			if err := filter(interaction); err != nil {
+				return nil, err
+			}
+		}
+		c.AddInteraction(interaction)
+		return resp, nil
+	})
+}
+
+// SenderWithReplay returns a Sender serving the responses recorded in c, each one once, without sending the requests.
+// Requests which weren't recorded fail.
+func SenderWithReplay(c *cassette.Cassette) storage.Sender {
+	return util.SenderFunc(func(client *storage.Client, r *http.Request) (*http.Response, error) {
+		interaction, err := c.GetInteraction(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", r.Method, scrubURL(r.URL, redacted), err)
+		}
+		return &http.Response{
+			Status:        interaction.Response.Status,
+			StatusCode:    interaction.Response.Code,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        interaction.Response.Headers.Clone(),
+			ContentLength: int64(len(interaction.Response.Body)),
+			Body:          ioutil.NopCloser(strings.NewReader(interaction.Response.Body)),
+			Request:       r,
+		}, nil
+	})
+}
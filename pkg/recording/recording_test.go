@@ -0,0 +1,98 @@
+package recording
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/dnaeon/go-vcr/cassette"
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	"github.com/fabito/azure-storage-purger/pkg/fakestorage"
+	"github.com/fabito/azure-storage-purger/pkg/populator"
+	"github.com/fabito/azure-storage-purger/pkg/progress"
+	"github.com/fabito/azure-storage-purger/pkg/purger"
+	"github.com/stretchr/testify/assert"
+)
+
+// populateAndPurge populates 10 days of entities and purges the ones older than 5 days
+func populateAndPurge(t *testing.T, credentials auth.Credentials) purger.PurgeResult {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	assert.NoError(t, populator.PopulateTable(credentials, "logs", today.AddDate(0, 0, -9), today, 150, 2))
+	tablePurger, err := purger.NewTablePurger(credentials, "logs", 5, 24, 3, false, false, progress.None, nil, purger.StorageBackend)
+	assert.NoError(t, err)
+	result, err := tablePurger.PurgeEntities()
+	assert.NoError(t, err)
+	return result
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "purge.yaml")
+	server := fakestorage.NewServer()
+	server.PageSize = 100
+	recorded := Record(path)
+	credentials := auth.Credentials{AccountName: "acme", AccountKey: "YWNtZQ==", TableEndpoint: server.URL}
+	credentials.Sender = func(s storage.Sender) storage.Sender {
+		return SenderWithRecording(s, recorded)
+	}
+	expected := populateAndPurge(t, credentials)
+	server.Close()
+	assert.Equal(t, int64(4*150), expected.RowCount)
+	assert.NoError(t, recorded.Save())
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "SharedKey")
+	assert.Contains(t, string(data), redacted)
+
+	// the server is gone, the responses come from the cassette
+	replayed, err := Replay(path)
+	assert.NoError(t, err)
+	credentials.Sender = func(storage.Sender) storage.Sender {
+		return SenderWithReplay(replayed)
+	}
+	result := populateAndPurge(t, credentials)
+	assert.Equal(t, expected.RowCount, result.RowCount)
+	assert.Equal(t, expected.BatchCount, result.BatchCount)
+	assert.False(t, result.HasErrors())
+
+	// every response is served once
+	client, err := credentials.NewClient()
+	assert.NoError(t, err)
+	tableService := client.GetTableService()
+	table := tableService.GetTableReference("logs")
+	assert.Error(t, table.Get(5, storage.MinimalMetadata))
+}
+
+func TestScrub(t *testing.T) {
+	i := &cassette.Interaction{Request: cassette.Request{
+		Method:  http.MethodPost,
+		URL:     "https://acme.blob.core.windows.net/logs?comp=list&restype=container&sig=secret&sv=2019-02-02",
+		Headers: http.Header{"Authorization": {"Bearer token"}, "x-ms-version": {"2019-02-02"}},
+	}}
+	assert.NoError(t, Scrub(i))
+	assert.Equal(t, "https://acme.blob.core.windows.net/logs?comp=list&restype=container&sig=REDACTED&sv=2019-02-02", i.Request.URL)
+	assert.Equal(t, redacted, i.Request.Headers.Get("Authorization"))
+	assert.Equal(t, "2019-02-02", i.Request.Headers["x-ms-version"][0])
+
+	// signatures and batch boundaries are ignored by the matcher
+	r, _ := http.NewRequest(http.MethodPost, "https://acme.blob.core.windows.net/logs?comp=list&restype=container&sig=other&sv=2019-02-02", nil)
+	assert.True(t, Matcher(r, i.Request))
+	i.Request.Method = http.MethodGet
+	assert.False(t, Matcher(r, i.Request))
+
+	// the sub-requests of blob batches are scrubbed and matched without their dates
+	subRequest := "DELETE /logs/%s?sig=%s HTTP/1.1\r\nAuthorization: %s\r\nx-ms-date: %s\r\n\r\n"
+	i.Request.Method = http.MethodPost
+	i.Request.Body = fmt.Sprintf(subRequest, "a.json", "secret", "Bearer token", "Mon, 01 Jun 2020 10:00:00 GMT")
+	assert.NoError(t, Scrub(i))
+	assert.Equal(t, fmt.Sprintf(subRequest, "a.json", redacted, redacted, "Mon, 01 Jun 2020 10:00:00 GMT"), i.Request.Body)
+	r, _ = http.NewRequest(http.MethodPost, i.Request.URL, strings.NewReader(fmt.Sprintf(subRequest, "a.json", "other", "Bearer other", "Mon, 01 Jun 2020 11:00:00 GMT")))
+	assert.True(t, Matcher(r, i.Request))
+	r, _ = http.NewRequest(http.MethodPost, i.Request.URL, strings.NewReader(fmt.Sprintf(subRequest, "b.json", "other", "Bearer other", "Mon, 01 Jun 2020 11:00:00 GMT")))
+	assert.False(t, Matcher(r, i.Request))
+}
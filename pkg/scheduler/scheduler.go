@@ -0,0 +1,281 @@
+// Package scheduler runs purge jobs periodically based on cron expressions.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	"github.com/fabito/azure-storage-purger/pkg/lock"
+	"github.com/fabito/azure-storage-purger/pkg/progress"
+	"github.com/fabito/azure-storage-purger/pkg/purger"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultHistorySize = 10
+
+// Job describes a purge job and when it should run
+type Job struct {
+	auth.Credentials `mapstructure:",squash"`
+
+	Name                string        `mapstructure:"name" json:"name"`
+	Schedule            string        `mapstructure:"schedule" json:"schedule"`
+	Jitter              time.Duration `mapstructure:"jitter" json:"jitter"`
+	TableName           string        `mapstructure:"table-name" json:"table_name"`
+	NumDaysToKeep       int           `mapstructure:"num-days-to-keep" json:"num_days_to_keep"`
+	PeriodLengthInHours int           `mapstructure:"num-hours-per-worker" json:"num_hours_per_worker"`
+	NumWorkers          int           `mapstructure:"num-workers" json:"num_workers"`
+	UsePool             bool          `mapstructure:"use-pool" json:"use_pool"`
+	DryRun              bool          `mapstructure:"dry-run" json:"dry_run"`
+	Lock                bool          `mapstructure:"lock" json:"lock"`
+	Backend             string        `mapstructure:"backend" json:"backend,omitempty"`
+}
+
+// RunFunc executes a single run of a Job
+type RunFunc func(job Job) (purger.PurgeResult, error)
+
+// PurgeRunFunc runs the job using a purger.DefaultTablePurger.
+// When job.Lock is set the table lock must be acquired before purging.
+func PurgeRunFunc(job Job) (purger.PurgeResult, error) {
+	backend, err := purger.ParseBackend(job.Backend)
+	if err != nil {
+		return purger.PurgeResult{}, err
+	}
+	// the purge stops once the lock is lost, as another instance may then acquire it
+	ctx := context.Background()
+	var tableLock *lock.BlobLock
+	if job.Lock {
+		client, err := job.Credentials.NewClient()
+		if err != nil {
+			return purger.PurgeResult{}, err
+		}
+		tableLock = lock.NewBlobLock(client, lock.DefaultContainerName, lock.TableLockName(job.Account(), job.TableName), lock.DefaultLeaseDuration)
+		if err := tableLock.Acquire(); err != nil {
+			return purger.PurgeResult{}, err
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = tableLock.Context(ctx)
+		defer cancel()
+		defer func() {
+			if err := tableLock.Release(); err != nil {
+				log.Errorf("Error releasing lock of job %s: %s", job.Name, err)
+			}
+		}()
+	}
+	tablePurger, err := purger.NewTablePurger(job.Credentials, job.TableName, job.NumDaysToKeep, job.PeriodLengthInHours, job.NumWorkers, job.UsePool, job.DryRun, progress.Log, nil, backend)
+	if err != nil {
+		return purger.PurgeResult{}, err
+	}
+	defer tablePurger.Finish()
+	result, err := tablePurger.PurgeEntitiesContext(ctx)
+	if tableLock != nil && tableLock.IsLost() {
+		return result, lock.ErrLost
+	}
+	return result, err
+}
+
+// RunResult holds the outcome of a single job run
+type RunResult struct {
+	StartTime time.Time           `json:"start_time"`
+	EndTime   time.Time           `json:"end_time"`
+	Skipped   bool                `json:"skipped"`
+	Error     string              `json:"error,omitempty"`
+	Result    *purger.PurgeResult `json:"result,omitempty"`
+}
+
+// JobStatus is the externally visible state of a scheduled job
+type JobStatus struct {
+	Job     Job         `json:"job"`
+	Running bool        `json:"running"`
+	NextRun time.Time   `json:"next_run"`
+	Results []RunResult `json:"results"`
+}
+
+type scheduledJob struct {
+	sync.Mutex
+	job         Job
+	entryID     cron.EntryID
+	running     bool
+	results     []RunResult
+	historySize int
+	run         RunFunc
+	// stopping is closed when the scheduler stops, cutting the jitter short
+	stopping <-chan struct{}
+}
+
+func (s *scheduledJob) tryStart() bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.running {
+		return false
+	}
+	s.running = true
+	return true
+}
+
+func (s *scheduledJob) finish(r RunResult) {
+	s.Lock()
+	defer s.Unlock()
+	s.running = false
+	s.record(r)
+}
+
+func (s *scheduledJob) record(r RunResult) {
+	s.results = append(s.results, r)
+	if len(s.results) > s.historySize {
+		s.results = s.results[len(s.results)-s.historySize:]
+	}
+}
+
+func (s *scheduledJob) skip() {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now().UTC()
+	s.record(RunResult{StartTime: now, EndTime: now, Skipped: true})
+}
+
+// Run implements cron.Job. A run is skipped when the previous run of the same job is still going.
+func (s *scheduledJob) Run() {
+	if !s.tryStart() {
+		log.Warnf("Skipping job %s: previous run still in progress", s.job.Name)
+		s.skip()
+		return
+	}
+	if s.job.Jitter > 0 {
+		delay := time.Duration(rand.Int63n(int64(s.job.Jitter)))
+		log.Debugf("Delaying job %s by %s", s.job.Name, delay)
+		select {
+		case <-s.stopping:
+			log.Infof("Skipping job %s: shutting down", s.job.Name)
+			now := time.Now().UTC()
+			s.finish(RunResult{StartTime: now, EndTime: now, Skipped: true})
+			return
+		case <-time.After(delay):
+		}
+	}
+	log.Infof("Starting job %s", s.job.Name)
+	r := RunResult{StartTime: time.Now().UTC()}
+	result, err := s.run(s.job)
+	r.EndTime = time.Now().UTC()
+	r.Result = &result
+	if err != nil {
+		log.Errorf("Job %s failed: %s", s.job.Name, err)
+		r.Error = err.Error()
+	}
+	log.Infof("Job %s finished in %s", s.job.Name, r.EndTime.Sub(r.StartTime))
+	s.finish(r)
+}
+
+func (s *scheduledJob) status(c *cron.Cron) JobStatus {
+	s.Lock()
+	defer s.Unlock()
+	results := make([]RunResult, len(s.results))
+	copy(results, s.results)
+	return JobStatus{
+		Job:     s.job,
+		Running: s.running,
+		NextRun: c.Entry(s.entryID).Next,
+		Results: results,
+	}
+}
+
+// Scheduler runs jobs based on their cron schedule
+type Scheduler struct {
+	cron        *cron.Cron
+	jobs        map[string]*scheduledJob
+	historySize int
+	run         RunFunc
+	stopping    chan struct{}
+	stopOnce    sync.Once
+}
+
+// New creates a new Scheduler keeping the last historySize results of each job
+func New(historySize int, run RunFunc) *Scheduler {
+	if historySize <= 0 {
+		historySize = defaultHistorySize
+	}
+	rand.Seed(time.Now().UnixNano())
+	return &Scheduler{
+		cron:        cron.New(cron.WithLocation(time.UTC)),
+		jobs:        make(map[string]*scheduledJob),
+		historySize: historySize,
+		run:         run,
+		stopping:    make(chan struct{}),
+	}
+}
+
+// Add schedules a new job
+func (s *Scheduler) Add(job Job) error {
+	if job.Name == "" {
+		return errors.New("Job name is required")
+	}
+	if _, ok := s.jobs[job.Name]; ok {
+		return fmt.Errorf("Duplicated job name %s", job.Name)
+	}
+	sj := &scheduledJob{job: job, historySize: s.historySize, run: s.run, stopping: s.stopping}
+	id, err := s.cron.AddJob(job.Schedule, sj)
+	if err != nil {
+		return fmt.Errorf("Invalid schedule for job %s: %s", job.Name, err)
+	}
+	sj.entryID = id
+	s.jobs[job.Name] = sj
+	log.Infof("Scheduled job %s (%s) for table %s", job.Name, job.Schedule, job.TableName)
+	return nil
+}
+
+// Start starts the scheduler in its own goroutine
+func (s *Scheduler) Start() {
+	s.cron.Start()
+}
+
+// Stop stops the scheduler and waits for running jobs to complete. Jobs still delayed by their jitter are skipped.
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() { close(s.stopping) })
+	<-s.cron.Stop().Done()
+}
+
+// Status returns the status of all jobs sorted by name
+func (s *Scheduler) Status() []JobStatus {
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		statuses = append(statuses, j.status(s.cron))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Job.Name < statuses[j].Job.Name
+	})
+	return statuses
+}
+
+// ServeHTTP exposes the jobs status.
+// GET /jobs lists all jobs and GET /jobs/{name} a single one.
+func (s *Scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	var body interface{}
+	if name == "" {
+		body = s.Status()
+	} else {
+		j, ok := s.jobs[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		body = j.status(s.cron)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,110 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fabito/azure-storage-purger/pkg/auth"
+	"github.com/fabito/azure-storage-purger/pkg/purger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipWhenStillRunning(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := New(10, func(job Job) (purger.PurgeResult, error) {
+		close(started)
+		<-release
+		return purger.PurgeResult{RowCount: 10}, nil
+	})
+	assert.NoError(t, s.Add(Job{Name: "logs", Schedule: "@every 1h"}))
+
+	done := make(chan struct{})
+	go func() {
+		s.jobs["logs"].Run()
+		close(done)
+	}()
+	<-started
+	s.jobs["logs"].Run()
+	close(release)
+	<-done
+
+	results := s.Status()[0].Results
+	if assert.Len(t, results, 2) {
+		assert.True(t, results[0].Skipped)
+		assert.False(t, results[1].Skipped)
+		assert.Equal(t, int64(10), results[1].Result.RowCount)
+	}
+}
+
+func TestStopSkipsJitter(t *testing.T) {
+	ran := false
+	s := New(10, func(job Job) (purger.PurgeResult, error) {
+		ran = true
+		return purger.PurgeResult{}, nil
+	})
+	assert.NoError(t, s.Add(Job{Name: "logs", Schedule: "@every 1h", Jitter: time.Hour}))
+
+	done := make(chan struct{})
+	go func() {
+		s.jobs["logs"].Run()
+		close(done)
+	}()
+	s.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("jitter not cut short")
+	}
+	assert.False(t, ran)
+	results := s.Status()[0].Results
+	if assert.Len(t, results, 1) {
+		assert.True(t, results[0].Skipped)
+	}
+}
+
+func TestHistorySize(t *testing.T) {
+	s := New(2, func(job Job) (purger.PurgeResult, error) {
+		return purger.PurgeResult{}, errors.New("boom")
+	})
+	assert.NoError(t, s.Add(Job{Name: "logs", Schedule: "0 2 * * *"}))
+	for i := 0; i < 5; i++ {
+		s.jobs["logs"].Run()
+	}
+	results := s.Status()[0].Results
+	assert.Len(t, results, 2)
+	assert.Equal(t, "boom", results[1].Error)
+}
+
+func TestAddInvalidJobs(t *testing.T) {
+	s := New(2, PurgeRunFunc)
+	assert.Error(t, s.Add(Job{Name: "logs", Schedule: "not a cron"}))
+	assert.Error(t, s.Add(Job{Schedule: "0 2 * * *"}))
+	assert.NoError(t, s.Add(Job{Name: "logs", Schedule: "0 2 * * *"}))
+	assert.Error(t, s.Add(Job{Name: "logs", Schedule: "0 3 * * *"}))
+}
+
+func TestServeHTTP(t *testing.T) {
+	s := New(2, PurgeRunFunc)
+	assert.NoError(t, s.Add(Job{Name: "logs", Schedule: "0 2 * * *", Credentials: auth.Credentials{AccountKey: "secret"}}))
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "secret")
+	var statuses []JobStatus
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &statuses))
+	assert.Len(t, statuses, 1)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/logs", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,101 @@
+package tablestore
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/tracing"
+)
+
+// AzureStore a Store backed by an Azure Storage, or Cosmos DB Table API, table.
+// Requests are traced as children of the span in the context of each call.
+type AzureStore struct {
+	client storage.Client
+	table  *storage.Table
+}
+
+// NewAzureStore creates a Store for the table tableName of the account of client
+func NewAzureStore(client storage.Client, tableName string) *AzureStore {
+	tableService := client.GetTableService()
+	return &AzureStore{client: client, table: tableService.GetTableReference(tableName)}
+}
+
+// Name the table name
+func (s *AzureStore) Name() string {
+	return s.table.Name
+}
+
+// tableWithContext returns a table whose requests are traced as children of the span in ctx
+func (s *AzureStore) tableWithContext(ctx context.Context) *storage.Table {
+	if !tracing.Enabled(ctx) {
+		return s.table
+	}
+	client := s.client
+	client.Sender = tracing.SenderWithTracing(ctx, client.Sender)
+	tableService := client.GetTableService()
+	return tableService.GetTableReference(s.table.Name)
+}
+
+// CreateIfNotExists creates the table unless it already exists
+func (s *AzureStore) CreateIfNotExists(ctx context.Context) error {
+	table := s.tableWithContext(ctx)
+	if err := table.Get(5, storage.MinimalMetadata); err == nil {
+		return nil
+	}
+	return table.Create(5, storage.MinimalMetadata, &storage.TableOptions{})
+}
+
+// Query fetches the first page of the entities matching query
+func (s *AzureStore) Query(ctx context.Context, query Query) (*Page, error) {
+	options := &storage.QueryOptions{Filter: query.Filter, Select: query.Select, Top: query.Top}
+	result, err := s.tableWithContext(ctx).QueryEntities(query.Timeout, storage.NoMetadata, options)
+	return azurePage(result), err
+}
+
+// NextPage fetches the page following page. The requests are sent through the table of the first page.
+func (s *AzureStore) NextPage(ctx context.Context, page *Page) (*Page, error) {
+	result, ok := page.Continuation.(*storage.EntityQueryResult)
+	if !ok {
+		return nil, errors.New("not a page of an Azure table")
+	}
+	next, err := result.NextResults(&storage.TableOptions{})
+	return azurePage(next), err
+}
+
+func azurePage(result *storage.EntityQueryResult) *Page {
+	if result == nil {
+		return nil
+	}
+	page := &Page{Entities: result.Entities}
+	if result.NextLink != nil {
+		page.Continuation = result
+	}
+	return page
+}
+
+// DeleteBatch deletes the entities of batch, regardless of their ETag, in a single entity group transaction
+func (s *AzureStore) DeleteBatch(ctx context.Context, batch *Batch) error {
+	return s.execute(ctx, batch, func(tableBatch *storage.TableBatch, entity *storage.Entity) {
+		tableBatch.DeleteEntityByForce(entity, true)
+	})
+}
+
+// UpsertBatch inserts or merges the entities of batch in a single entity group transaction
+func (s *AzureStore) UpsertBatch(ctx context.Context, batch *Batch) error {
+	return s.execute(ctx, batch, func(tableBatch *storage.TableBatch, entity *storage.Entity) {
+		tableBatch.InsertOrMergeEntityByForce(entity)
+	})
+}
+
+func (s *AzureStore) execute(ctx context.Context, batch *Batch, add func(*storage.TableBatch, *storage.Entity)) error {
+	table := s.tableWithContext(ctx)
+	tableBatch := table.NewBatch()
+	for _, entity := range batch.Entities {
+		// the paths of the batch operations are built from the table of each entity
+		e := *entity
+		e.Table = table
+		add(tableBatch, &e)
+	}
+	return tableBatch.ExecuteBatch()
+}
@@ -0,0 +1,218 @@
+package tablestore
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// Filter tells whether an entity matches an OData filter
+type Filter func(entity *storage.Entity) bool
+
+// ParseFilter parses the subset of the OData filter syntax used to query tables:
+// comparisons (eq, ne, gt, ge, lt and le) of a property with a string literal, combined with and, or, not and parentheses.
+// Strings are compared ordinally, like the table service does. An empty filter matches all entities.
+func ParseFilter(filter string) (Filter, error) {
+	if strings.TrimSpace(filter) == "" {
+		return func(*storage.Entity) bool { return true }, nil
+	}
+	tokens, err := tokenize(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter %q", p.tokens[p.pos].text, filter)
+	}
+	return f, nil
+}
+
+type tokenKind int
+
+const (
+	identToken tokenKind = iota
+	stringToken
+	openToken
+	closeToken
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, token{openToken, "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{closeToken, ")"})
+			i++
+		case c == '\'':
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(s) {
+					return nil, fmt.Errorf("unterminated string in filter %q", s)
+				}
+				if s[i] == '\'' {
+					// quotes are escaped by doubling them
+					if i+1 < len(s) && s[i+1] == '\'' {
+						b.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(s[i])
+				i++
+			}
+			tokens = append(tokens, token{stringToken, b.String()})
+		default:
+			start := i
+			for i < len(s) && !unicode.IsSpace(rune(s[i])) && s[i] != '(' && s[i] != ')' && s[i] != '\'' {
+				i++
+			}
+			tokens = append(tokens, token{identToken, s[start:i]})
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *filterParser) peekKeyword(keyword string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == identToken && strings.EqualFold(p.tokens[p.pos].text, keyword)
+}
+
+func (p *filterParser) next() (token, error) {
+	if p.pos >= len(p.tokens) {
+		return token{}, fmt.Errorf("unexpected end of filter")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *filterParser) or() (Filter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("or") {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(e *storage.Entity) bool { return l(e) || right(e) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) and() (Filter, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("and") {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(e *storage.Entity) bool { return l(e) && right(e) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) unary() (Filter, error) {
+	if p.peekKeyword("not") {
+		p.pos++
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(e *storage.Entity) bool { return !f(e) }, nil
+	}
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == openToken {
+		p.pos++
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t, err := p.next(); err != nil || t.kind != closeToken {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return f, nil
+	}
+	return p.comparison()
+}
+
+var comparisons = map[string]func(c int) bool{
+	"eq": func(c int) bool { return c == 0 },
+	"ne": func(c int) bool { return c != 0 },
+	"gt": func(c int) bool { return c > 0 },
+	"ge": func(c int) bool { return c >= 0 },
+	"lt": func(c int) bool { return c < 0 },
+	"le": func(c int) bool { return c <= 0 },
+}
+
+func (p *filterParser) comparison() (Filter, error) {
+	property, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if property.kind != identToken {
+		return nil, fmt.Errorf("expected a property name, got %q", property.text)
+	}
+	operator, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	compare, ok := comparisons[strings.ToLower(operator.text)]
+	if operator.kind != identToken || !ok {
+		return nil, fmt.Errorf("unsupported operator %q", operator.text)
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if value.kind != stringToken {
+		return nil, fmt.Errorf("only string literals are supported, got %q", value.text)
+	}
+	return func(e *storage.Entity) bool {
+		v, ok := stringProperty(e, property.text)
+		// like the table service, comparisons with missing properties are false
+		return ok && compare(strings.Compare(v, value.text))
+	}, nil
+}
+
+func stringProperty(e *storage.Entity, name string) (string, bool) {
+	switch name {
+	case "PartitionKey":
+		return e.PartitionKey, true
+	case "RowKey":
+		return e.RowKey, true
+	}
+	v, ok := e.Properties[name].(string)
+	return v, ok
+}
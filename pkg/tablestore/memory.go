@@ -0,0 +1,233 @@
+package tablestore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// defaultPageSize the maximum number of entities per page of the table service
+const defaultPageSize = 1000
+
+// MemoryStore an in-memory Store following the table service semantics:
+// entities are returned ordered by partition and row key, pages hold at most 1000 entities
+// and batches must hold up to 100 distinct entities of a single partition, applied all or nothing.
+type MemoryStore struct {
+	mu         sync.RWMutex
+	name       string
+	partitions map[string]map[string]map[string]interface{}
+	// PageSize caps the size of the pages, 1000 when 0
+	PageSize int
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore(name string) *MemoryStore {
+	return &MemoryStore{name: name, partitions: make(map[string]map[string]map[string]interface{})}
+}
+
+// MemoryContinuation the continuation of the pages of a MemoryStore: the key of the first entity of the next page
+type MemoryContinuation struct {
+	Query        Query
+	PartitionKey string
+	RowKey       string
+}
+
+// Name the table name
+func (s *MemoryStore) Name() string {
+	return s.name
+}
+
+// CreateIfNotExists is a no-op, the table always exists
+func (s *MemoryStore) CreateIfNotExists(ctx context.Context) error {
+	return nil
+}
+
+// Len the number of entities in the table
+func (s *MemoryStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	count := 0
+	for _, rows := range s.partitions {
+		count += len(rows)
+	}
+	return count
+}
+
+// Get returns the entity with the given keys, nil when it doesn't exist
+func (s *MemoryStore) Get(partitionKey, rowKey string) *storage.Entity {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	properties, ok := s.partitions[partitionKey][rowKey]
+	if !ok {
+		return nil
+	}
+	return s.entity(partitionKey, rowKey, properties, nil)
+}
+
+// Query fetches the first page of the entities matching query
+func (s *MemoryStore) Query(ctx context.Context, query Query) (*Page, error) {
+	return s.page(query, "", "")
+}
+
+// NextPage fetches the page following page
+func (s *MemoryStore) NextPage(ctx context.Context, page *Page) (*Page, error) {
+	c, ok := page.Continuation.(MemoryContinuation)
+	if !ok {
+		return nil, fmt.Errorf("not a page of an in-memory table")
+	}
+	return s.page(c.Query, c.PartitionKey, c.RowKey)
+}
+
+// page the entities matching query starting at the given keys
+func (s *MemoryStore) page(query Query, partitionKey, rowKey string) (*Page, error) {
+	filter, err := ParseFilter(query.Filter)
+	if err != nil {
+		return nil, badRequest("InvalidInput", err.Error())
+	}
+	size := s.PageSize
+	if size <= 0 || size > defaultPageSize {
+		size = defaultPageSize
+	}
+	if query.Top > 0 && int(query.Top) < size {
+		size = int(query.Top)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	page := &Page{Entities: make([]*storage.Entity, 0)}
+	for _, pk := range s.partitionKeys() {
+		if pk < partitionKey {
+			continue
+		}
+		rows := s.partitions[pk]
+		for _, rk := range rowKeys(rows) {
+			if pk == partitionKey && rk < rowKey {
+				continue
+			}
+			e := s.entity(pk, rk, rows[rk], nil)
+			if !filter(e) {
+				continue
+			}
+			if len(page.Entities) == size {
+				page.Continuation = MemoryContinuation{Query: query, PartitionKey: pk, RowKey: rk}
+				return page, nil
+			}
+			page.Entities = append(page.Entities, s.entity(pk, rk, rows[rk], query.Select))
+		}
+	}
+	return page, nil
+}
+
+// entity copies the stored entity keeping only the selected properties
+func (s *MemoryStore) entity(partitionKey, rowKey string, properties map[string]interface{}, selected []string) *storage.Entity {
+	e := &storage.Entity{PartitionKey: partitionKey, RowKey: rowKey, Properties: make(map[string]interface{})}
+	if len(selected) == 0 {
+		for k, v := range properties {
+			e.Properties[k] = v
+		}
+		return e
+	}
+	for _, k := range selected {
+		if v, ok := properties[k]; ok {
+			e.Properties[k] = v
+		}
+	}
+	return e
+}
+
+// DeleteBatch deletes the entities of batch. Fails without deleting any when one of them doesn't exist.
+func (s *MemoryStore) DeleteBatch(ctx context.Context, batch *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.validate(batch); err != nil {
+		return err
+	}
+	rows := s.partitions[batch.PartitionKey]
+	for i, e := range batch.Entities {
+		if _, ok := rows[e.RowKey]; !ok {
+			return storage.AzureStorageServiceError{
+				StatusCode: http.StatusNotFound,
+				Code:       "ResourceNotFound",
+				Message:    fmt.Sprintf("%d:The specified resource does not exist.", i),
+			}
+		}
+	}
+	for _, e := range batch.Entities {
+		delete(rows, e.RowKey)
+	}
+	if len(rows) == 0 {
+		delete(s.partitions, batch.PartitionKey)
+	}
+	return nil
+}
+
+// UpsertBatch inserts the entities of batch or merges their properties into the existing ones
+func (s *MemoryStore) UpsertBatch(ctx context.Context, batch *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.validate(batch); err != nil {
+		return err
+	}
+	rows, ok := s.partitions[batch.PartitionKey]
+	if !ok {
+		rows = make(map[string]map[string]interface{})
+		s.partitions[batch.PartitionKey] = rows
+	}
+	for _, e := range batch.Entities {
+		properties, ok := rows[e.RowKey]
+		if !ok {
+			properties = make(map[string]interface{})
+			rows[e.RowKey] = properties
+		}
+		for k, v := range e.Properties {
+			properties[k] = v
+		}
+	}
+	return nil
+}
+
+// validate checks the constraints of entity group transactions
+func (s *MemoryStore) validate(batch *Batch) error {
+	if batch.Size() == 0 || batch.Size() > MaxBatchSize {
+		return badRequest("InvalidInput", fmt.Sprintf("a batch holds from 1 to %d operations, got %d", MaxBatchSize, batch.Size()))
+	}
+	seen := make(map[string]bool, batch.Size())
+	for i, e := range batch.Entities {
+		if e.PartitionKey != batch.PartitionKey {
+			return badRequest("CommandsInBatchActOnDifferentPartitions", fmt.Sprintf("%d:All commands in a batch must operate on same entity group.", i))
+		}
+		if seen[e.RowKey] {
+			return badRequest("InvalidDuplicateRow", fmt.Sprintf("%d:The batch request contains multiple changes with same row key.", i))
+		}
+		seen[e.RowKey] = true
+	}
+	return nil
+}
+
+func badRequest(code, message string) error {
+	return storage.AzureStorageServiceError{StatusCode: http.StatusBadRequest, Code: code, Message: message}
+}
+
+// partitionKeys the sorted partition keys
+func (s *MemoryStore) partitionKeys() []string {
+	keys := make([]string, 0, len(s.partitions))
+	for k := range s.partitions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// rowKeys the sorted row keys of a partition
+func rowKeys(rows map[string]map[string]interface{}) []string {
+	keys := make([]string, 0, len(rows))
+	for k := range rows {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,121 @@
+package tablestore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func entities(partitionKey string, count int) []*storage.Entity {
+	result := make([]*storage.Entity, count)
+	for i := range result {
+		result[i] = &storage.Entity{PartitionKey: partitionKey, RowKey: fmt.Sprintf("%03d", i), Properties: map[string]interface{}{"Level": "info"}}
+	}
+	return result
+}
+
+func fill(t *testing.T, store *MemoryStore, partitionKeys ...string) {
+	for _, pk := range partitionKeys {
+		for _, batch := range Batches(pk, entities(pk, 150)) {
+			assert.NoError(t, store.UpsertBatch(context.Background(), batch))
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	e := &storage.Entity{PartitionKey: "0637", RowKey: "1", Properties: map[string]interface{}{"Level": "it's"}}
+	for filter, expected := range map[string]bool{
+		"":                       true,
+		"PartitionKey eq '0637'": true,
+		"PartitionKey ne ''":     true,
+		"PartitionKey ge '0637' and PartitionKey lt '0638'": true,
+		"PartitionKey gt '0637'":                            false,
+		"PartitionKey lt '06370'":                           true,
+		"RowKey le '0' or Level eq 'it''s'":                 true,
+		"not (PartitionKey eq '0637')":                      false,
+		"Missing ne 'x'":                                    false,
+	} {
+		f, err := ParseFilter(filter)
+		if assert.NoError(t, err, filter) {
+			assert.Equal(t, expected, f(e), filter)
+		}
+	}
+	for _, filter := range []string{"PartitionKey", "PartitionKey eq 1", "PartitionKey like 'x'", "(PartitionKey eq 'x'", "PartitionKey eq 'x"} {
+		_, err := ParseFilter(filter)
+		assert.Error(t, err, filter)
+	}
+}
+
+func TestMemoryStorePages(t *testing.T) {
+	store := NewMemoryStore("logs")
+	store.PageSize = 100
+	fill(t, store, "0002", "0001", "0003")
+	assert.Equal(t, 450, store.Len())
+
+	ctx := context.Background()
+	page, err := store.Query(ctx, Query{Filter: "PartitionKey ge '0001' and PartitionKey lt '0003'", Select: []string{"PartitionKey", "RowKey"}})
+	assert.NoError(t, err)
+	var keys []string
+	for {
+		for _, e := range page.Entities {
+			assert.Empty(t, e.Properties)
+			keys = append(keys, e.PartitionKey+"/"+e.RowKey)
+		}
+		if !page.HasNext() {
+			break
+		}
+		page, err = store.NextPage(ctx, page)
+		assert.NoError(t, err)
+	}
+	if assert.Len(t, keys, 300) {
+		assert.Equal(t, "0001/000", keys[0])
+		assert.Equal(t, "0002/000", keys[150])
+		assert.Equal(t, "0002/149", keys[299])
+	}
+
+	page, err = store.Query(ctx, Query{Top: 10})
+	assert.NoError(t, err)
+	assert.Len(t, page.Entities, 10)
+	assert.True(t, page.HasNext())
+	assert.Equal(t, "info", page.Entities[0].Properties["Level"])
+}
+
+func TestMemoryStoreBatches(t *testing.T) {
+	store := NewMemoryStore("logs")
+	fill(t, store, "0001")
+	ctx := context.Background()
+
+	err := store.DeleteBatch(ctx, &Batch{PartitionKey: "0001", Entities: entities("0001", 101)})
+	assert.Error(t, err)
+
+	mixed := &Batch{PartitionKey: "0001", Entities: append(entities("0001", 1), entities("0002", 1)...)}
+	err = store.DeleteBatch(ctx, mixed)
+	assert.Equal(t, "CommandsInBatchActOnDifferentPartitions", err.(storage.AzureStorageServiceError).Code)
+
+	duplicated := &Batch{PartitionKey: "0001", Entities: append(entities("0001", 1), entities("0001", 1)...)}
+	assert.Error(t, store.UpsertBatch(ctx, duplicated))
+
+	// the batch fails as a whole when an entity is missing
+	missing := &Batch{PartitionKey: "0001", Entities: append(entities("0001", 1), &storage.Entity{PartitionKey: "0001", RowKey: "x"})}
+	err = store.DeleteBatch(ctx, missing)
+	assert.Equal(t, "ResourceNotFound", err.(storage.AzureStorageServiceError).Code)
+	assert.NotNil(t, store.Get("0001", "000"))
+
+	for _, batch := range Batches("0001", entities("0001", 150)) {
+		assert.NoError(t, store.DeleteBatch(ctx, batch))
+	}
+	assert.Equal(t, 0, store.Len())
+}
+
+func TestBatches(t *testing.T) {
+	batches := Batches("0001", entities("0001", 250))
+	if assert.Len(t, batches, 3) {
+		assert.Equal(t, 100, batches[0].Size())
+		assert.Equal(t, 50, batches[2].Size())
+		assert.Equal(t, "0001", batches[2].PartitionKey)
+	}
+	assert.Empty(t, Batches("0001", nil))
+}
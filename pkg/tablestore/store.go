@@ -0,0 +1,76 @@
+// Package tablestore abstracts the table operations used by the purger and the populator,
+// so they run against Azure tables or against an in-memory table in tests.
+package tablestore
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// MaxBatchSize the maximum number of operations of an entity group transaction
+const MaxBatchSize = 100
+
+// Store the operations on a single table
+type Store interface {
+	// Name the table name
+	Name() string
+	// CreateIfNotExists creates the table unless it already exists
+	CreateIfNotExists(ctx context.Context) error
+	// Query fetches the first page of the entities matching query
+	Query(ctx context.Context, query Query) (*Page, error)
+	// NextPage fetches the page following page. Only valid when page.HasNext()
+	NextPage(ctx context.Context, page *Page) (*Page, error)
+	// DeleteBatch deletes the entities of batch, regardless of their ETag, in a single entity group transaction
+	DeleteBatch(ctx context.Context, batch *Batch) error
+	// UpsertBatch inserts or merges the entities of batch in a single entity group transaction
+	UpsertBatch(ctx context.Context, batch *Batch) error
+}
+
+// Query an OData filtered query
+type Query struct {
+	Filter string
+	// Select the properties returned, all of them when empty
+	Select []string
+	// Top the maximum number of entities per page
+	Top uint
+	// Timeout the server timeout in seconds, none when 0
+	Timeout uint
+}
+
+// Page a page of query results
+type Page struct {
+	Entities []*storage.Entity
+	// Continuation the Store specific state needed to fetch the next page, nil on the last page
+	Continuation interface{}
+}
+
+// HasNext whether there is a page after this one
+func (p *Page) HasNext() bool {
+	return p != nil && p.Continuation != nil
+}
+
+// Batch entities of a single partition changed in one entity group transaction.
+// Holds up to MaxBatchSize entities.
+type Batch struct {
+	PartitionKey string
+	Entities     []*storage.Entity
+}
+
+// Size the number of entities of the batch
+func (b *Batch) Size() int {
+	return len(b.Entities)
+}
+
+// Batches chunks the entities of a partition into batches of at most MaxBatchSize entities
+func Batches(partitionKey string, entities []*storage.Entity) []*Batch {
+	batches := make([]*Batch, 0, (len(entities)+MaxBatchSize-1)/MaxBatchSize)
+	for i := 0; i < len(entities); i += MaxBatchSize {
+		end := i + MaxBatchSize
+		if end > len(entities) {
+			end = len(entities)
+		}
+		batches = append(batches, &Batch{PartitionKey: partitionKey, Entities: entities[i:end]})
+	}
+	return batches
+}
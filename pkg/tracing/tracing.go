@@ -0,0 +1,81 @@
+// Package tracing configures OpenTelemetry tracing and instruments the storage client.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/fabito/azure-storage-purger"
+
+// Init sets up the global tracer provider exporting spans to an OTLP/HTTP collector at endpoint (host:port).
+// Returns a function which flushes the remaining spans.
+func Init(endpoint string, insecure bool) (func(context.Context) error, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("azp"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the azp tracer. It is a no-op unless Init was called.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Enabled whether spans started from ctx are recorded
+func Enabled(ctx context.Context) bool {
+	return trace.SpanFromContext(ctx).IsRecording()
+}
+
+// EndSpan records err, if any, and ends the span
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// SenderWithTracing returns a Sender decorator creating a client span, child of the span in ctx, for every request.
+// The storage client does not propagate contexts so the parent must be bound when decorating.
+func SenderWithTracing(ctx context.Context, s storage.Sender) storage.Sender {
+	return util.SenderFunc(func(c *storage.Client, r *http.Request) (*http.Response, error) {
+		_, span := Tracer().Start(ctx, fmt.Sprintf("HTTP %s", r.Method), trace.WithSpanKind(trace.SpanKindClient))
+		// the query string is left out since it may contain SAS signatures
+		span.SetAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPHostKey.String(r.URL.Host),
+			semconv.HTTPTargetKey.String(r.URL.Path),
+			attribute.Int64("http.request_content_length", r.ContentLength),
+		)
+		resp, err := s.Send(c, r)
+		if resp != nil {
+			span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(resp.StatusCode)...)
+			span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(resp.StatusCode))
+		}
+		EndSpan(span, err)
+		return resp, err
+	})
+}
@@ -0,0 +1,51 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/fabito/azure-storage-purger/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSenderWithTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	ctx, parent := Tracer().Start(context.Background(), "parent")
+	assert.True(t, Enabled(ctx))
+	sender := SenderWithTracing(ctx, util.SenderFunc(func(c *storage.Client, r *http.Request) (*http.Response, error) {
+		return http.DefaultClient.Do(r)
+	}))
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/logs?sig=secret", nil)
+	resp, err := sender.Send(nil, req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	parent.End()
+
+	ended := recorder.Ended()
+	if !assert.Len(t, ended, 2) {
+		return
+	}
+	span := ended[0]
+	assert.Equal(t, "HTTP DELETE", span.Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	assert.Equal(t, "/logs", attrs["http.target"].AsString())
+	assert.Equal(t, int64(http.StatusNoContent), attrs["http.status_code"].AsInt64())
+}
@@ -0,0 +1,4 @@
+package util
+
+// MaxBlobBatchSize the maximum number of sub-requests of a blob batch, shared by the purger and the fake Blob service
+const MaxBlobBatchSize = 256
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"strconv"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Structured log field names shared by the purger, populator and stats gatherer
+const (
+	LogFieldTable        = "table"
+	LogFieldContainer    = "container"
+	LogFieldBlob         = "blob"
+	LogFieldSnapshot     = "snapshot"
+	LogFieldVersion      = "version_id"
+	LogFieldTier         = "tier"
+	LogFieldSplit        = "split"
+	LogFieldPartitionKey = "partition_key"
+	LogFieldBatchSize    = "batch_size"
+	LogFieldErrorCode    = "error_code"
+)
+
+// BatchLogFields the partition key and size of a table batch
+func BatchLogFields(partitionKey string, size int) log.Fields {
+	return log.Fields{LogFieldPartitionKey: partitionKey, LogFieldBatchSize: size}
+}
+
+// WithError adds err and, for storage service errors, its error code to entry
+func WithError(entry *log.Entry, err error) *log.Entry {
+	if code := ErrorCode(err); code != "" {
+		entry = entry.WithField(LogFieldErrorCode, code)
+	}
+	return entry.WithError(err)
+}
+
+// ErrorCode the storage service error code of err, falling back to its HTTP status code.
+// Returns an empty string for other errors.
+func ErrorCode(err error) string {
+	var serviceErr storage.AzureStorageServiceError
+	switch e := err.(type) {
+	case storage.AzureStorageServiceError:
+		serviceErr = e
+	case *storage.AzureStorageServiceError:
+		serviceErr = *e
+	default:
+		return ""
+	}
+	if serviceErr.Code != "" {
+		return serviceErr.Code
+	}
+	return strconv.Itoa(serviceErr.StatusCode)
+}
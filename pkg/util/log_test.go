@@ -0,0 +1,31 @@
+package util
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCode(t *testing.T) {
+	assert.Equal(t, "EntityNotFound", ErrorCode(storage.AzureStorageServiceError{Code: "EntityNotFound", StatusCode: http.StatusNotFound}))
+	assert.Equal(t, "503", ErrorCode(&storage.AzureStorageServiceError{StatusCode: http.StatusServiceUnavailable}))
+	assert.Equal(t, "", ErrorCode(errors.New("boom")))
+}
+
+func TestWithError(t *testing.T) {
+	err := storage.AzureStorageServiceError{Code: "InvalidInput", StatusCode: http.StatusBadRequest}
+	entry := WithError(log.WithField(LogFieldTable, "logs"), err)
+	assert.Equal(t, "InvalidInput", entry.Data[LogFieldErrorCode])
+	assert.Equal(t, err, entry.Data[log.ErrorKey])
+	assert.Equal(t, "logs", entry.Data[LogFieldTable])
+}
+
+func TestBatchLogFields(t *testing.T) {
+	fields := BatchLogFields("0636603290790000000", 1)
+	assert.Equal(t, 1, fields[LogFieldBatchSize])
+	assert.Equal(t, "0636603290790000000", fields[LogFieldPartitionKey])
+}
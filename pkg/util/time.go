@@ -73,9 +73,13 @@ func (p *Period) SplitsFrom(numSplits int) []Period {
 	return splits
 }
 
+// Split splits the period into periods of about duration. Periods shorter than duration make a single split.
 func (p *Period) Split(duration time.Duration) []Period {
 	totalDuration := p.Duration()
 	numSplits := totalDuration.Milliseconds() / duration.Milliseconds()
+	if numSplits < 1 {
+		numSplits = 1
+	}
 	return p.SplitsFrom(int(numSplits))
 }
 
@@ -119,6 +119,16 @@ func TestSplitPeriodsOneDay(t *testing.T) {
 	LogPeriods(splits)
 }
 
+func TestSplitPeriodShorterThanDuration(t *testing.T) {
+	start := time.Date(2018, 7, 11, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2018, 7, 11, 6, 0, 0, 0, time.UTC)
+
+	p := Period{Start: start, End: end}
+	splits := p.Split(24 * time.Hour)
+
+	assert.Equal(t, []Period{p}, splits)
+}
+
 func TestParsePeriod(t *testing.T) {
 	start := time.Date(2018, 7, 11, 0, 0, 0, 0, time.UTC)
 	end := time.Date(2018, 7, 12, 23, 59, 59, 0, time.UTC)